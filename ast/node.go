@@ -95,6 +95,7 @@ type MatchesNode struct {
 	Regexp *regexp.Regexp
 	Left   Node
 	Right  Node
+	Flags  Node // optional, e.g. "i" in matches(s, pattern, "i")
 }
 
 type PropertyNode struct {
@@ -106,8 +107,9 @@ type PropertyNode struct {
 
 type IndexNode struct {
 	base
-	Node  Node
-	Index Node
+	Node    Node
+	Index   Node
+	NilSafe bool
 }
 
 type SliceNode struct {
@@ -125,11 +127,21 @@ type MethodNode struct {
 	NilSafe   bool
 }
 
+// CallNode calls the function which is the value of the callee, such as
+// in m["k"]() or f()().
+type CallNode struct {
+	base
+	Callee    Node
+	Arguments []Node
+}
+
 type FunctionNode struct {
 	base
 	Name      string
 	Arguments []Node
 	Fast      bool
+	Builtin   bool          // resolved to vm.Builtins by the checker
+	Func      reflect.Value // function of an overloaded operator, if set
 }
 
 type BuiltinNode struct {
@@ -159,6 +171,30 @@ type ArrayNode struct {
 	Nodes []Node
 }
 
+// LetNode binds the value to the name within the body, e.g.
+// "let x = 1; x + 1". Index is unique for every LetNode of a tree.
+type LetNode struct {
+	base
+	Name  string
+	Index int
+	Value Node
+	Body  Node
+}
+
+// VariableNode refers to the value bound by the LetNode with the same Index.
+type VariableNode struct {
+	base
+	Name  string
+	Index int
+}
+
+// SequenceNode holds the top-level expressions of "a, b", whose values are
+// all the results of the program, see conf.Config.MultipleResults.
+type SequenceNode struct {
+	base
+	Nodes []Node
+}
+
 type MapNode struct {
 	base
 	Pairs []Node
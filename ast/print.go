@@ -57,3 +57,24 @@ var isCapital = regexp.MustCompile("^[A-Z]")
 func isPrivate(s string) bool {
 	return !isCapital.Match([]byte(s))
 }
+
+// Path returns the access path of node, such as a.b[0].c, if node only
+// accesses properties and constant indexes of a variable.
+func Path(node Node) (string, bool) {
+	switch n := node.(type) {
+	case *IdentifierNode:
+		return n.Value, true
+	case *PropertyNode:
+		p, ok := Path(n.Node)
+		return p + "." + n.Property, ok
+	case *IndexNode:
+		p, ok := Path(n.Node)
+		switch i := n.Index.(type) {
+		case *IntegerNode:
+			return fmt.Sprintf("%v[%v]", p, i.Value), ok
+		case *StringNode:
+			return fmt.Sprintf("%v[%q]", p, i.Value), ok
+		}
+	}
+	return "", false
+}
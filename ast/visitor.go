@@ -46,6 +46,9 @@ func (w *walker) walk(node *Node) {
 	case *MatchesNode:
 		w.walk(&n.Left)
 		w.walk(&n.Right)
+		if n.Flags != nil {
+			w.walk(&n.Flags)
+		}
 		w.visitor.Exit(node)
 	case *PropertyNode:
 		w.walk(&n.Node)
@@ -69,6 +72,12 @@ func (w *walker) walk(node *Node) {
 			w.walk(&n.Arguments[i])
 		}
 		w.visitor.Exit(node)
+	case *CallNode:
+		w.walk(&n.Callee)
+		for i := range n.Arguments {
+			w.walk(&n.Arguments[i])
+		}
+		w.visitor.Exit(node)
 	case *FunctionNode:
 		for i := range n.Arguments {
 			w.walk(&n.Arguments[i])
@@ -94,6 +103,17 @@ func (w *walker) walk(node *Node) {
 			w.walk(&n.Nodes[i])
 		}
 		w.visitor.Exit(node)
+	case *SequenceNode:
+		for i := range n.Nodes {
+			w.walk(&n.Nodes[i])
+		}
+		w.visitor.Exit(node)
+	case *LetNode:
+		w.walk(&n.Value)
+		w.walk(&n.Body)
+		w.visitor.Exit(node)
+	case *VariableNode:
+		w.visitor.Exit(node)
 	case *MapNode:
 		for i := range n.Pairs {
 			w.walk(&n.Pairs[i])
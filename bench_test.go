@@ -64,6 +64,34 @@ func Benchmark_expr_reuseVm(b *testing.B) {
 	}
 }
 
+func Benchmark_notEqual(b *testing.B) {
+	params := make(map[string]interface{})
+	params["Origin"] = "MOW"
+	params["Country"] = "RU"
+	params["Adults"] = 1
+	params["Tags"] = []string{"a", "b"}
+
+	program, err := expr.Compile(`Origin != "LED" && !(Country == "US") && Adults != 2 && "c" not in Tags`, expr.Env(params))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var out interface{}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		out, err = vm.Run(program, params)
+	}
+	b.StopTimer()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !out.(bool) {
+		b.Fail()
+	}
+}
+
 func Benchmark_filter(b *testing.B) {
 	params := make(map[string]interface{})
 	params["max"] = 50
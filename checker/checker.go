@@ -8,20 +8,51 @@ import (
 	"github.com/ebusto/expr/conf"
 	"github.com/ebusto/expr/file"
 	"github.com/ebusto/expr/parser"
+	"github.com/ebusto/expr/vm"
 )
 
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
 
 func Check(tree *parser.Tree, config *conf.Config) (reflect.Type, error) {
+	t, _, err := CheckWithWarnings(tree, config)
+	return t, err
+}
+
+// CheckWithWarnings is like Check, but also returns warnings about problems
+// which do not prevent compilation, such as an unused let binding.
+func CheckWithWarnings(tree *parser.Tree, config *conf.Config) (reflect.Type, []file.Warning, error) {
 	v := &visitor{
 		collections: make([]reflect.Type, 0),
+		lets:        make(map[int]reflect.Type),
+		used:        make(map[int]bool),
 	}
 	if config != nil {
 		v.types = config.Types
 		v.operators = config.Operators
+		v.operatorFns = config.OperatorFns
 		v.expect = config.Expect
 		v.strict = config.Strict
 		v.defaultType = config.DefaultType
+		v.builtinsFirst = config.BuiltinsFirst
+		v.noShadowing = config.NoShadowing
+		v.noMethodCalls = config.NoMethodCalls
+		v.int64Literals = config.Int64Literals
+		v.multipleResults = config.MultipleResults
+		v.divideInf = config.DivideByZeroInf
+		v.numericStrings = config.NumericStrings
+		v.maxPattern = config.MaxPatternLength
+		if config.AllowedFunctions != nil {
+			v.allowed = make(map[string]bool)
+			for name := range config.AllowedFunctions {
+				v.allowed[name] = true
+			}
+			for _, fns := range config.Operators {
+				for _, fn := range fns {
+					v.allowed[fn] = true
+				}
+			}
+		}
+		v.constants = config.Constants
 	}
 
 	t := v.visit(tree.Node)
@@ -30,30 +61,46 @@ func Check(tree *parser.Tree, config *conf.Config) (reflect.Type, error) {
 		switch v.expect {
 		case reflect.Int64, reflect.Float64:
 			if !isNumber(t) {
-				return nil, fmt.Errorf("expected %v, but got %v", v.expect, t)
+				return nil, v.warnings, fmt.Errorf("expected %v, but got %v", v.expect, t)
 			}
 		default:
 			if t.Kind() != v.expect {
-				return nil, fmt.Errorf("expected %v, but got %v", v.expect, t)
+				return nil, v.warnings, fmt.Errorf("expected %v, but got %v", v.expect, t)
 			}
 		}
 	}
 
 	if v.err != nil {
-		return t, v.err.Bind(tree.Source)
+		return t, v.warnings, v.err.Bind(tree.Source)
 	}
 
-	return t, nil
+	return t, v.warnings, nil
 }
 
 type visitor struct {
 	types       conf.TypesTable
 	operators   conf.OperatorsTable
+	operatorFns map[string][]reflect.Value
 	expect      reflect.Kind
 	collections []reflect.Type
 	strict      bool
 	defaultType reflect.Type
+	lets        map[int]reflect.Type
+	scope       []string     // names of let bindings in scope
+	used        map[int]bool // let bindings which are referred to
+	constants   map[string]interface{}
 	err         *file.Error
+	warnings    []file.Warning
+
+	builtinsFirst   bool
+	noShadowing     bool
+	noMethodCalls   bool
+	int64Literals   bool
+	multipleResults bool
+	divideInf       bool            // integer division by zero gives a float
+	numericStrings  bool            // strings may be numbers of builtins
+	maxPattern      int             // limit of constant regexps, if not 0
+	allowed         map[string]bool // functions which may be called, if not nil
 }
 
 func (v *visitor) visit(node ast.Node) reflect.Type {
@@ -87,6 +134,8 @@ func (v *visitor) visit(node ast.Node) reflect.Type {
 		t = v.SliceNode(n)
 	case *ast.MethodNode:
 		t = v.MethodNode(n)
+	case *ast.CallNode:
+		t = v.CallNode(n)
 	case *ast.FunctionNode:
 		t = v.FunctionNode(n)
 	case *ast.BuiltinNode:
@@ -99,6 +148,12 @@ func (v *visitor) visit(node ast.Node) reflect.Type {
 		t = v.ConditionalNode(n)
 	case *ast.ArrayNode:
 		t = v.ArrayNode(n)
+	case *ast.SequenceNode:
+		t = v.SequenceNode(n)
+	case *ast.LetNode:
+		t = v.LetNode(n)
+	case *ast.VariableNode:
+		t = v.VariableNode(n)
 	case *ast.MapNode:
 		t = v.MapNode(n)
 	case *ast.PairNode:
@@ -120,11 +175,21 @@ func (v *visitor) error(node ast.Node, format string, args ...interface{}) refle
 	return interfaceType // interface represent undefined type
 }
 
+func (v *visitor) warn(node ast.Node, format string, args ...interface{}) {
+	v.warnings = append(v.warnings, file.Warning{
+		Location: node.Location(),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
 func (v *visitor) NilNode(*ast.NilNode) reflect.Type {
 	return nilType
 }
 
 func (v *visitor) IdentifierNode(node *ast.IdentifierNode) reflect.Type {
+	if value, ok := v.constants[node.Value]; ok {
+		return reflect.TypeOf(value)
+	}
 	if v.types == nil {
 		return interfaceType
 	}
@@ -147,6 +212,9 @@ func (v *visitor) IdentifierNode(node *ast.IdentifierNode) reflect.Type {
 }
 
 func (v *visitor) IntegerNode(*ast.IntegerNode) reflect.Type {
+	if v.int64Literals {
+		return int64Type
+	}
 	return integerType
 }
 
@@ -188,6 +256,19 @@ func (v *visitor) UnaryNode(node *ast.UnaryNode) reflect.Type {
 	return v.error(node, `invalid operation: %v (mismatched type %v)`, node.Operator, t)
 }
 
+// checkSignedness warns about comparisons of signed and unsigned integers.
+// They are evaluated correctly, but often hint at mismatched fields.
+func (v *visitor) checkSignedness(node *ast.BinaryNode, l, r reflect.Type) {
+	_, leftLiteral := node.Left.(*ast.IntegerNode)
+	_, rightLiteral := node.Right.(*ast.IntegerNode)
+	if leftLiteral || rightLiteral {
+		return
+	}
+	if (isSigned(l) && isUnsigned(r)) || (isUnsigned(l) && isSigned(r)) {
+		v.warn(node, "comparison of signed %v and unsigned %v", l, r)
+	}
+}
+
 func (v *visitor) BinaryNode(node *ast.BinaryNode) reflect.Type {
 	l := v.visit(node.Left)
 	r := v.visit(node.Right)
@@ -199,15 +280,35 @@ func (v *visitor) BinaryNode(node *ast.BinaryNode) reflect.Type {
 			return t
 		}
 	}
+	if fns, ok := v.operatorFns[node.Operator]; ok {
+		if fn, ok := conf.FindSuitableOperatorFunc(fns, l, r); ok {
+			return fn.Type().Out(0)
+		}
+	}
+
+	switch node.Operator {
+	case "<", ">", "<=", ">=", "+", "-", "*", "/", "%", "**":
+		if isTime(l) || isTime(r) || isDuration(l) || isDuration(r) {
+			if t, ok := timeOperation(node.Operator, l, r); ok {
+				return t
+			}
+			return v.error(node, `invalid operation: %v (mismatched types %v and %v)`, node.Operator, l, r)
+		}
+	}
 
 	switch node.Operator {
 	case "==", "!=":
 		if isNumber(l) && isNumber(r) {
+			v.checkSignedness(node, l, r)
 			return boolType
 		}
 		if isComparable(l, r) {
 			return boolType
 		}
+		// Values with their own equality decide what they equal.
+		if isEqualer(l) || isEqualer(r) {
+			return boolType
+		}
 
 	case "or", "||", "and", "&&":
 		if isBool(l) && isBool(r) {
@@ -227,13 +328,21 @@ func (v *visitor) BinaryNode(node *ast.BinaryNode) reflect.Type {
 
 	case "<", ">", ">=", "<=":
 		if isNumber(l) && isNumber(r) {
+			v.checkSignedness(node, l, r)
 			return boolType
 		}
 		if isString(l) && isString(r) {
 			return boolType
 		}
+		if isComparer(l) || isComparer(r) {
+			return boolType
+		}
 
 	case "/", "-", "*":
+		// Integers divided by zero give a float, so the type is unknown.
+		if node.Operator == "/" && v.divideInf && isInteger(l) && isInteger(r) {
+			return interfaceType
+		}
 		if isNumber(l) && isNumber(r) {
 			return combined(l, r)
 		}
@@ -267,17 +376,34 @@ func (v *visitor) BinaryNode(node *ast.BinaryNode) reflect.Type {
 		}
 
 	default:
-		return v.error(node, "unknown operator (%v)", node.Operator)
-
+		// Operators defined with expr.Infix have only their functions.
+		if _, ok := v.operatorFns[node.Operator]; !ok {
+			return v.error(node, "unknown operator (%v)", node.Operator)
+		}
 	}
 
 	return v.error(node, `invalid operation: %v (mismatched types %v and %v)`, node.Operator, l, r)
 }
 
 func (v *visitor) MatchesNode(node *ast.MatchesNode) reflect.Type {
+	if v.allowed != nil && !v.allowed["matches"] {
+		return v.error(node, "func matches is not allowed")
+	}
 	l := v.visit(node.Left)
 	r := v.visit(node.Right)
 
+	if node.Regexp != nil {
+		if err := vm.ValidatePatternLength(node.Regexp.String(), v.maxPattern); err != nil {
+			return v.error(node.Right, "%v", err)
+		}
+	}
+
+	if node.Flags != nil {
+		if f := v.visit(node.Flags); !isString(f) {
+			return v.error(node.Flags, `invalid operation: matches flags must be a string (got %v)`, f)
+		}
+	}
+
 	if isString(l) && isString(r) {
 		return boolType
 	}
@@ -300,6 +426,9 @@ func (v *visitor) IndexNode(node *ast.IndexNode) reflect.Type {
 	t := v.visit(node.Node)
 	i := v.visit(node.Index)
 
+	if t == nil && node.NilSafe {
+		return nil
+	}
 	if t, ok := indexType(t); ok {
 		if !isInteger(i) && !isString(i) {
 			return v.error(node, "invalid operation: cannot use %v as index to %v", i, t)
@@ -334,7 +463,67 @@ func (v *visitor) SliceNode(node *ast.SliceNode) reflect.Type {
 	return v.error(node, "invalid operation: cannot slice %v", t)
 }
 
+func (v *visitor) CallNode(node *ast.CallNode) reflect.Type {
+	name := calleeName(node.Callee)
+	switch node.Callee.(type) {
+	case *ast.PropertyNode, *ast.IndexNode:
+		// A func taken from a value by name is called like a method of it.
+		// Other elements, as in [fn][0](), are called like fn().
+		if v.noMethodCalls && name != "" {
+			return v.error(node, "method calls are not allowed (%v)", name)
+		}
+	}
+	if v.allowed != nil && !v.allowed[name] {
+		if name == "" {
+			return v.error(node, "calls of function values are not allowed")
+		}
+		return v.error(node, "func %v is not allowed", name)
+	}
+
+	t := v.visit(node.Callee)
+	if fn, ok := isFuncType(t); ok {
+		if isInterface(fn) {
+			for _, arg := range node.Arguments {
+				v.visit(arg)
+			}
+		}
+		return v.checkFunc(fn, false, node, "func", node.Arguments)
+	}
+	return v.error(node, "cannot call non-function (type %v)", t)
+}
+
+// calleeName returns the name under which the callee of a CallNode was
+// accessed, or "" if it is computed some other way.
+func calleeName(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.IdentifierNode:
+		return n.Value
+	case *ast.PropertyNode:
+		return n.Property
+	case *ast.IndexNode:
+		if s, ok := n.Index.(*ast.StringNode); ok {
+			return s.Value
+		}
+	}
+	return ""
+}
+
 func (v *visitor) FunctionNode(node *ast.FunctionNode) reflect.Type {
+	if node.Func.IsValid() {
+		return v.checkFunc(node.Func.Type(), false, node, node.Name, node.Arguments)
+	}
+	if v.allowed != nil && !v.allowed[node.Name] {
+		return v.error(node, "func %v is not allowed", node.Name)
+	}
+	if b, ok := vm.Builtins[node.Name]; ok {
+		_, inEnv := v.types[node.Name]
+		if inEnv && v.noShadowing {
+			return v.error(node, "func %v of env shadows builtin", node.Name)
+		}
+		if !inEnv || v.builtinsFirst {
+			return v.builtin(node, b)
+		}
+	}
 	if f, ok := v.types[node.Name]; ok {
 		if fn, ok := isFuncType(f.Type); ok {
 
@@ -369,7 +558,141 @@ func (v *visitor) FunctionNode(node *ast.FunctionNode) reflect.Type {
 	return v.error(node, "unknown func %v", node.Name)
 }
 
+func (v *visitor) builtin(node *ast.FunctionNode, b *vm.Builtin) reflect.Type {
+	if node.Name == "orDefault" && len(node.Arguments) > 0 {
+		nilSafe(node.Arguments[0])
+	}
+	for _, arg := range node.Arguments {
+		v.visit(arg)
+	}
+	node.Builtin = true
+	if b.Args != nil {
+		if t, ok := v.builtinArgs(node, b); !ok {
+			return t
+		}
+	}
+	if node.Name == "try" || node.Name == "onError" {
+		t := node.Arguments[0].Type()
+		if len(node.Arguments) == 1 || t == nil || t != node.Arguments[1].Type() {
+			return interfaceType
+		}
+		return t
+	}
+	if node.Name == "apply" {
+		if t := node.Arguments[0].Type(); t != nil && !isInterface(t) && t != programType {
+			return v.error(node.Arguments[0], "cannot use %v as program in apply", t)
+		}
+	}
+	if node.Name == "sprintf" && len(node.Arguments) > 0 {
+		if format, ok := node.Arguments[0].(*ast.StringNode); ok {
+			if n, ok := countVerbs(format.Value); ok && n != len(node.Arguments)-1 {
+				return v.error(node, "sprintf format %q needs %v arguments, but got %v", format.Value, n, len(node.Arguments)-1)
+			}
+		}
+	}
+	return b.Type
+}
+
+// builtinArgs checks the number of arguments of the builtin and their types,
+// if they are known.
+func (v *visitor) builtinArgs(node *ast.FunctionNode, b *vm.Builtin) (reflect.Type, bool) {
+	min, max := len(b.Args)-b.Optional, len(b.Args)
+	if b.Variadic {
+		min, max = min-1, -1
+	}
+	if n := len(node.Arguments); n < min || (max >= 0 && n > max) {
+		var expected string
+		switch {
+		case max < 0:
+			expected = fmt.Sprintf("at least %d", min)
+		case min == max:
+			expected = fmt.Sprintf("%d", min)
+		case min+1 == max:
+			expected = fmt.Sprintf("%d or %d", min, max)
+		default:
+			expected = fmt.Sprintf("%d to %d", min, max)
+		}
+		return v.error(node, "invalid number of arguments for %v (expected %v, got %d)", node.Name, expected, n), false
+	}
+	for i, arg := range node.Arguments {
+		kind := b.Args[len(b.Args)-1]
+		if i < len(b.Args) {
+			kind = b.Args[i]
+		}
+		if t := arg.Type(); !isArgKind(t, kind) && !(kind == vm.ArgNumber && v.numericStrings && isString(t)) {
+			return v.error(arg, "cannot use %v as %v in %v", t, kind, node.Name), false
+		}
+		if b.Literal != nil {
+			if value, ok := literal(arg); ok {
+				if err := b.Literal(i, value); err != nil {
+					return v.error(arg, "%v", err), false
+				}
+			}
+		}
+	}
+	return nil, true
+}
+
+// literal returns the value of node if it is a literal.
+func literal(node ast.Node) (interface{}, bool) {
+	switch n := node.(type) {
+	case *ast.StringNode:
+		return n.Value, true
+	case *ast.IntegerNode:
+		return n.Value, true
+	case *ast.FloatNode:
+		return n.Value, true
+	case *ast.BoolNode:
+		return n.Value, true
+	}
+	return nil, false
+}
+
+// isArgKind reports whether a value of type t may be an argument of kind k.
+// Values of unknown types, including nil, are checked at runtime.
+func isArgKind(t reflect.Type, k vm.ArgKind) bool {
+	if t == nil || isInterface(t) {
+		return true
+	}
+	switch k {
+	case vm.ArgString:
+		return isString(t)
+	case vm.ArgNumber:
+		return isNumber(t) || t == jsonNumberType
+	case vm.ArgBool:
+		return isBool(t)
+	case vm.ArgArray:
+		return isArray(t)
+	case vm.ArgMap:
+		return isMap(t)
+	case vm.ArgTime:
+		return isTime(t)
+	}
+	return true
+}
+
+// nilSafe turns the chain of property and method accesses of node into
+// nil-safe ones, as if written with "?.".
+func nilSafe(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.IdentifierNode:
+		n.NilSafe = true
+	case *ast.PropertyNode:
+		n.NilSafe = true
+		nilSafe(n.Node)
+	case *ast.MethodNode:
+		n.NilSafe = true
+		nilSafe(n.Node)
+	case *ast.IndexNode:
+		n.NilSafe = true
+		nilSafe(n.Node)
+	}
+}
+
 func (v *visitor) MethodNode(node *ast.MethodNode) reflect.Type {
+	if v.noMethodCalls {
+		return v.error(node, "method calls are not allowed (%v)", node.Method)
+	}
 	t := v.visit(node.Node)
 	if f, method, ok := methodType(t, node.Method); ok {
 		if fn, ok := isFuncType(f); ok {
@@ -454,6 +777,10 @@ func (v *visitor) checkFunc(fn reflect.Type, method bool, node ast.Node, name st
 }
 
 func (v *visitor) BuiltinNode(node *ast.BuiltinNode) reflect.Type {
+	// The between operator is parsed into a builtin, but is not a call.
+	if v.allowed != nil && !v.allowed[node.Name] && node.Name != "between" {
+		return v.error(node, "func %v is not allowed", node.Name)
+	}
 	switch node.Name {
 
 	case "len":
@@ -465,8 +792,8 @@ func (v *visitor) BuiltinNode(node *ast.BuiltinNode) reflect.Type {
 
 	case "all", "none", "any", "one":
 		collection := v.visit(node.Arguments[0])
-		if !isArray(collection) {
-			return v.error(node.Arguments[0], "builtin %v takes only array (got %v)", node.Name, collection)
+		if !isArray(collection) && !isMap(collection) {
+			return v.error(node.Arguments[0], "builtin %v takes only array or map (got %v)", node.Name, collection)
 		}
 
 		v.collections = append(v.collections, collection)
@@ -486,8 +813,8 @@ func (v *visitor) BuiltinNode(node *ast.BuiltinNode) reflect.Type {
 
 	case "filter":
 		collection := v.visit(node.Arguments[0])
-		if !isArray(collection) {
-			return v.error(node.Arguments[0], "builtin %v takes only array (got %v)", node.Name, collection)
+		if !isArray(collection) && !isMap(collection) {
+			return v.error(node.Arguments[0], "builtin %v takes only array or map (got %v)", node.Name, collection)
 		}
 
 		v.collections = append(v.collections, collection)
@@ -510,8 +837,8 @@ func (v *visitor) BuiltinNode(node *ast.BuiltinNode) reflect.Type {
 
 	case "map":
 		collection := v.visit(node.Arguments[0])
-		if !isArray(collection) {
-			return v.error(node.Arguments[0], "builtin %v takes only array (got %v)", node.Name, collection)
+		if !isArray(collection) && !isMap(collection) {
+			return v.error(node.Arguments[0], "builtin %v takes only array or map (got %v)", node.Name, collection)
 		}
 
 		v.collections = append(v.collections, collection)
@@ -526,10 +853,27 @@ func (v *visitor) BuiltinNode(node *ast.BuiltinNode) reflect.Type {
 		}
 		return v.error(node.Arguments[1], "closure should has one input and one output param")
 
+	case "fill":
+		if n := v.visit(node.Arguments[0]); !isInteger(n) && !isInterface(n) {
+			return v.error(node.Arguments[0], "builtin fill takes an integer count (got %v)", n)
+		}
+
+		v.collections = append(v.collections, reflect.SliceOf(integerType))
+		closure := v.visit(node.Arguments[1])
+		v.collections = v.collections[:len(v.collections)-1]
+
+		if isFunc(closure) &&
+			closure.NumOut() == 1 &&
+			closure.NumIn() == 1 && isInterface(closure.In(0)) {
+
+			return reflect.SliceOf(closure.Out(0))
+		}
+		return v.error(node.Arguments[1], "closure should has one input and one output param")
+
 	case "count":
 		collection := v.visit(node.Arguments[0])
-		if !isArray(collection) {
-			return v.error(node.Arguments[0], "builtin %v takes only array (got %v)", node.Name, collection)
+		if !isArray(collection) && !isMap(collection) {
+			return v.error(node.Arguments[0], "builtin %v takes only array or map (got %v)", node.Name, collection)
 		}
 
 		v.collections = append(v.collections, collection)
@@ -547,6 +891,26 @@ func (v *visitor) BuiltinNode(node *ast.BuiltinNode) reflect.Type {
 		}
 		return v.error(node.Arguments[1], "closure should has one input and one output param")
 
+	case "between":
+		x := v.visit(node.Arguments[0])
+		from := v.visit(node.Arguments[1])
+		to := v.visit(node.Arguments[2])
+		if isNumber(x) && isNumber(from) && isNumber(to) {
+			return boolType
+		}
+		if isString(x) && isString(from) && isString(to) {
+			return boolType
+		}
+		if t, ok := timeOperation("<=", x, from); ok && t == boolType {
+			if t, ok := timeOperation("<=", x, to); ok && t == boolType {
+				return boolType
+			}
+		}
+		if isComparer(x) || isComparer(from) || isComparer(to) {
+			return boolType
+		}
+		return v.error(node, `invalid operation: between (mismatched types %v, %v and %v)`, x, from, to)
+
 	default:
 		return v.error(node, "unknown builtin %v", node.Name)
 	}
@@ -601,6 +965,45 @@ func (v *visitor) ArrayNode(node *ast.ArrayNode) reflect.Type {
 	return arrayType
 }
 
+func (v *visitor) SequenceNode(node *ast.SequenceNode) reflect.Type {
+	if !v.multipleResults {
+		return v.error(node, "multiple results are not allowed")
+	}
+	for _, node := range node.Nodes {
+		v.visit(node)
+	}
+	return arrayType
+}
+
+func (v *visitor) LetNode(node *ast.LetNode) reflect.Type {
+	v.lets[node.Index] = v.visit(node.Value)
+	if _, ok := v.constants[node.Name]; ok {
+		return v.error(node, "let %v redefines constant", node.Name)
+	}
+	if v.noShadowing {
+		if _, ok := v.types[node.Name]; ok {
+			return v.error(node, "let %v shadows variable of env", node.Name)
+		}
+		for _, name := range v.scope {
+			if name == node.Name {
+				return v.error(node, "let %v shadows outer let", node.Name)
+			}
+		}
+	}
+	v.scope = append(v.scope, node.Name)
+	defer func() { v.scope = v.scope[:len(v.scope)-1] }()
+	t := v.visit(node.Body)
+	if !v.used[node.Index] {
+		v.warn(node, "let %v is unused", node.Name)
+	}
+	return t
+}
+
+func (v *visitor) VariableNode(node *ast.VariableNode) reflect.Type {
+	v.used[node.Index] = true
+	return v.lets[node.Index]
+}
+
 func (v *visitor) MapNode(node *ast.MapNode) reflect.Type {
 	for _, pair := range node.Pairs {
 		v.visit(pair)
@@ -460,7 +460,7 @@ cannot use string as argument (type int) to call Variadic  (1:18)
  | .................^
 
 count(1, {#})
-builtin count takes only array (got int) (1:7)
+builtin count takes only array or map (got int) (1:7)
  | count(1, {#})
  | ......^
 
@@ -480,7 +480,7 @@ closure should return boolean (got int64) (1:20)
  | ...................^
 
 map(1, {2})
-builtin map takes only array (got int) (1:5)
+builtin map takes only array or map (got int) (1:5)
  | map(1, {2})
  | ....^
 
@@ -488,6 +488,51 @@ map(filter(ArrayOfFoo, {.Int64 > 0}), {.Var})
 type *checker_test.foo has no field Var (1:41)
  | map(filter(ArrayOfFoo, {.Int64 > 0}), {.Var})
  | ........................................^
+
+sprintf("%d of %5.2f%%", 1)
+sprintf format "%d of %5.2f%%" needs 2 arguments, but got 1 (1:1)
+ | sprintf("%d of %5.2f%%", 1)
+ | ^
+
+date()
+invalid number of arguments for date (expected 1 or 2, got 0) (1:1)
+ | date()
+ | ^
+
+take(ArrayOfInt, 1, 2)
+invalid number of arguments for take (expected 2, got 3) (1:1)
+ | take(ArrayOfInt, 1, 2)
+ | ^
+
+pick()
+invalid number of arguments for pick (expected at least 1, got 0) (1:1)
+ | pick()
+ | ^
+
+ifNull(Any, 1, 2)
+invalid number of arguments for ifNull (expected 2, got 3) (1:1)
+ | ifNull(Any, 1, 2)
+ | ^
+
+coalesce()
+invalid number of arguments for coalesce (expected at least 1, got 0) (1:1)
+ | coalesce()
+ | ^
+
+padLeft(Int, 3)
+cannot use int as string in padLeft (1:9)
+ | padLeft(Int, 3)
+ | ........^
+
+format(String, "2006")
+cannot use string as time in format (1:8)
+ | format(String, "2006")
+ | .......^
+
+percentile(ArrayOfInt, String)
+cannot use string as number in percentile (1:24)
+ | percentile(ArrayOfInt, String)
+ | .......................^
 `
 
 func TestCheck_error(t *testing.T) {
@@ -526,6 +571,24 @@ func TestCheck_AsBool(t *testing.T) {
 	assert.Equal(t, "expected bool, but got int", err.Error())
 }
 
+func TestCheckWithWarnings(t *testing.T) {
+	config := &conf.Config{}
+
+	tree, err := parser.Parse(`let x = 1; 2`)
+	assert.NoError(t, err)
+	_, warnings, err := checker.CheckWithWarnings(tree, config)
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, "let x is unused (1:1)", warnings[0].String())
+
+	// Warnings are not kept by the config, which may be used again.
+	tree, err = parser.Parse(`let x = 1; x`)
+	assert.NoError(t, err)
+	_, warnings, err = checker.CheckWithWarnings(tree, config)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
 //
 // Mock types
 //
@@ -1,20 +1,32 @@
 package checker
 
 import (
+	"encoding/json"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/ebusto/expr/ast"
+	"github.com/ebusto/expr/vm"
 )
 
 var (
-	nilType       = reflect.TypeOf(nil)
-	boolType      = reflect.TypeOf(true)
-	integerType   = reflect.TypeOf(int(0))
-	floatType     = reflect.TypeOf(float64(0))
-	stringType    = reflect.TypeOf("")
-	arrayType     = reflect.TypeOf([]interface{}{})
-	mapType       = reflect.TypeOf(map[string]interface{}{})
-	interfaceType = reflect.TypeOf(new(interface{})).Elem()
+	nilType        = reflect.TypeOf(nil)
+	boolType       = reflect.TypeOf(true)
+	integerType    = reflect.TypeOf(int(0))
+	int64Type      = reflect.TypeOf(int64(0))
+	floatType      = reflect.TypeOf(float64(0))
+	stringType     = reflect.TypeOf("")
+	arrayType      = reflect.TypeOf([]interface{}{})
+	mapType        = reflect.TypeOf(map[string]interface{}{})
+	bytesType      = reflect.TypeOf([]byte{})
+	interfaceType  = reflect.TypeOf(new(interface{})).Elem()
+	comparerType   = reflect.TypeOf((*vm.Comparer)(nil)).Elem()
+	equalerType    = reflect.TypeOf((*vm.Equaler)(nil)).Elem()
+	programType    = reflect.TypeOf(&vm.Program{})
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	jsonNumberType = reflect.TypeOf(json.Number(""))
 )
 
 func typeWeight(t reflect.Type) int {
@@ -76,6 +88,9 @@ func isComparable(l, r reflect.Type) bool {
 	if l.Kind() == r.Kind() {
 		return true
 	}
+	if (l == bytesType && r.Kind() == reflect.String) || (r == bytesType && l.Kind() == reflect.String) {
+		return true
+	}
 	if isInterface(l) || isInterface(r) {
 		return true
 	}
@@ -177,6 +192,65 @@ func isMap(t reflect.Type) bool {
 	return false
 }
 
+func isComparer(t reflect.Type) bool {
+	return t != nil && t.Implements(comparerType)
+}
+
+func isEqualer(t reflect.Type) bool {
+	return t != nil && t.Implements(equalerType)
+}
+
+func isTime(t reflect.Type) bool {
+	return dereference(t) == timeType
+}
+
+func isDuration(t reflect.Type) bool {
+	return dereference(t) == durationType
+}
+
+// timeOperation returns the type of a binary operation with a time.Time or
+// time.Duration operand. It returns false if the operation is not defined.
+func timeOperation(operator string, l, r reflect.Type) (reflect.Type, bool) {
+	if isInterface(l) || isInterface(r) {
+		return interfaceType, true
+	}
+	switch operator {
+	case "<", ">", "<=", ">=":
+		if (isTime(l) && isTime(r)) || (isDuration(l) && isDuration(r)) {
+			return boolType, true
+		}
+	case "+":
+		if (isTime(l) && isDuration(r)) || (isDuration(l) && isTime(r)) {
+			return timeType, true
+		}
+		if isDuration(l) && isDuration(r) {
+			return durationType, true
+		}
+	case "-":
+		if isTime(l) && isTime(r) {
+			return durationType, true
+		}
+		if isTime(l) && isDuration(r) {
+			return timeType, true
+		}
+		if isDuration(l) && isDuration(r) {
+			return durationType, true
+		}
+	case "*":
+		if (isDuration(l) && isNumber(r) && !isDuration(r)) || (isNumber(l) && !isDuration(l) && isDuration(r)) {
+			return durationType, true
+		}
+	case "/":
+		if isDuration(l) && isDuration(r) {
+			return floatType, true
+		}
+		if isDuration(l) && isNumber(r) {
+			return durationType, true
+		}
+	}
+	return nil, false
+}
+
 func isStruct(t reflect.Type) bool {
 	t = dereference(t)
 	if t != nil {
@@ -312,6 +386,28 @@ func isFuncType(ntype reflect.Type) (reflect.Type, bool) {
 	return nil, false
 }
 
+func isSigned(t reflect.Type) bool {
+	t = dereference(t)
+	if t != nil {
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return true
+		}
+	}
+	return false
+}
+
+func isUnsigned(t reflect.Type) bool {
+	t = dereference(t)
+	if t != nil {
+		switch t.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return true
+		}
+	}
+	return false
+}
+
 func isIntegerOrArithmeticOperation(node ast.Node) bool {
 	switch n := node.(type) {
 	case *ast.IntegerNode:
@@ -347,3 +443,31 @@ func setTypeForIntegers(node ast.Node, t reflect.Type) {
 		}
 	}
 }
+
+// countVerbs returns the number of arguments used by the fmt format. It
+// returns false for formats with explicit argument indexes.
+func countVerbs(format string) (int, bool) {
+	count := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		for i++; i < len(format); i++ {
+			c := format[i]
+			if c == '[' {
+				return 0, false
+			}
+			if c == '*' {
+				count++
+				continue
+			}
+			if strings.IndexByte("+-# 0.123456789", c) < 0 {
+				break
+			}
+		}
+		if i < len(format) && format[i] != '%' {
+			count++
+		}
+	}
+	return count, true
+}
@@ -79,11 +79,18 @@ func (v *visitor) Exit(ref *Node) {
 		v.link(b)
 
 	case *MatchesNode:
+		var c int
+		if node.Flags != nil {
+			c = v.pop()
+		}
 		b := v.pop()
 		a := v.pop()
 		v.push("matches")
 		v.link(a)
 		v.link(b)
+		if node.Flags != nil {
+			v.link(c)
+		}
 
 	case *PropertyNode:
 		a := v.pop()
@@ -101,6 +108,18 @@ func (v *visitor) Exit(ref *Node) {
 		v.link(a)
 		v.link(b)
 
+	case *CallNode:
+		args := make([]int, 0)
+		for range node.Arguments {
+			args = append(args, v.pop())
+		}
+		a := v.pop()
+		v.push("(...)")
+		v.link(a)
+		for i := len(args) - 1; i >= 0; i-- {
+			v.link(args[i])
+		}
+
 	case *MethodNode:
 		args := make([]int, 0)
 		for range node.Arguments {
@@ -164,6 +183,16 @@ func (v *visitor) Exit(ref *Node) {
 			v.link(n[i])
 		}
 
+	case *SequenceNode:
+		n := make([]int, 0)
+		for range node.Nodes {
+			n = append(n, v.pop())
+		}
+		v.push("...,...")
+		for i := len(n) - 1; i >= 0; i-- {
+			v.link(n[i])
+		}
+
 	case *MapNode:
 		n := make([]int, 0)
 		for range node.Pairs {
@@ -174,6 +203,16 @@ func (v *visitor) Exit(ref *Node) {
 			v.link(n[i])
 		}
 
+	case *LetNode:
+		b := v.pop()
+		a := v.pop()
+		v.push("let " + node.Name)
+		v.link(a)
+		v.link(b)
+
+	case *VariableNode:
+		v.push(node.Name)
+
 	case *PairNode:
 		b := v.pop()
 		a := v.pop()
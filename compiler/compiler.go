@@ -23,11 +23,36 @@ func Compile(tree *parser.Tree, config *conf.Config) (program *Program, err erro
 	c := &compiler{
 		index:     make(map[interface{}]uint16),
 		locations: make(map[int]file.Location),
+		lets:      make(map[int]uint16),
+		paths:     make(map[int]string),
 	}
 
 	if config != nil {
 		c.mapEnv = config.MapEnv
+		c.consts = config.Constants
+		c.strict = config.NoUndefinedVariables
+		c.divideInf = config.DivideByZeroInf
+		c.multipleResults = config.MultipleResults
+		c.options.MissingKey = config.MissingKey
+		c.options.MaxApplyDepth = config.MaxApplyDepth
+		c.options.RegexpCache = config.RegexpCache
+		c.options.MaxRecursion = config.MaxRecursion
+		c.options.NumericStrings = config.NumericStrings
+		c.options.NoNaNComparison = config.NoNaNComparison
+		c.options.MaxPatternLength = config.MaxPatternLength
+		c.options.MaxMatchLength = config.MaxMatchLength
 		c.cast = config.Expect
+		if config.Optimize {
+			pure := make(map[string]bool)
+			for name := range config.ConstExprFns {
+				pure[name] = true
+			}
+			for name := range config.Pure {
+				pure[name] = true
+			}
+			c.cse = newCSE(pure)
+			ast.Walk(&tree.Node, c.cse)
+		}
 	}
 
 	c.compile(tree.Node)
@@ -44,6 +69,11 @@ func Compile(tree *parser.Tree, config *conf.Config) (program *Program, err erro
 		Locations: c.locations,
 		Constants: c.constants,
 		Bytecode:  c.bytecode,
+		Locals:    c.locals,
+		Paths:     c.paths,
+		Options:   c.options,
+
+		MultipleResults: c.multipleResults,
 	}
 	return
 }
@@ -56,6 +86,16 @@ type compiler struct {
 	mapEnv    bool
 	cast      reflect.Kind
 	nodes     []ast.Node
+	cse       *cse
+	locals    int            // number of local slots
+	lets      map[int]uint16 // local slots of let bindings
+	paths     map[int]string // access paths by ip, for runtime errors
+	consts    map[string]interface{}
+	strict    bool // fail fetching undefined variables
+	divideInf bool // integer division by zero gives Inf
+	options   Options
+
+	multipleResults bool // return all the values left on the stack
 }
 
 func (c *compiler) emit(op byte, b ...byte) int {
@@ -76,17 +116,23 @@ func (c *compiler) emitPush(value interface{}) int {
 	return c.emit(OpPush, c.makeConstant(value)...)
 }
 
+// makeConstant returns the index of i in the constants pool, adding it unless
+// an identical constant is already there. Constants which can not be map keys,
+// such as arrays folded by the optimizer, are compared deeply. The types must
+// match too, so 1 and 1.0 are kept apart, unlike in == of the vm.
 func (c *compiler) makeConstant(i interface{}) []byte {
-	hashable := true
-	switch reflect.TypeOf(i).Kind() {
-	case reflect.Slice, reflect.Map:
-		hashable = false
-	}
+	hashable := reflect.TypeOf(i).Comparable()
 
 	if hashable {
 		if p, ok := c.index[i]; ok {
 			return encode(p)
 		}
+	} else {
+		for p, constant := range c.constants {
+			if reflect.DeepEqual(constant, i) {
+				return encode(uint16(p))
+			}
+		}
 	}
 
 	c.constants = append(c.constants, i)
@@ -101,6 +147,15 @@ func (c *compiler) makeConstant(i interface{}) []byte {
 	return encode(p)
 }
 
+// local allocates a new local slot.
+func (c *compiler) local() uint16 {
+	if c.locals >= math.MaxUint16 {
+		panic("exceeded locals max space limit")
+	}
+	c.locals++
+	return uint16(c.locals - 1)
+}
+
 func (c *compiler) placeholder() []byte {
 	return []byte{0xFF, 0xFF}
 }
@@ -122,6 +177,14 @@ func (c *compiler) compile(node ast.Node) {
 		c.nodes = c.nodes[:len(c.nodes)-1]
 	}()
 
+	var key string
+	if c.cse != nil {
+		var loaded bool
+		if key, loaded = c.cse.load(c, node); loaded {
+			return
+		}
+	}
+
 	switch n := node.(type) {
 	case *ast.NilNode:
 		c.NilNode(n)
@@ -151,6 +214,8 @@ func (c *compiler) compile(node ast.Node) {
 		c.SliceNode(n)
 	case *ast.MethodNode:
 		c.MethodNode(n)
+	case *ast.CallNode:
+		c.CallNode(n)
 	case *ast.FunctionNode:
 		c.FunctionNode(n)
 	case *ast.BuiltinNode:
@@ -163,6 +228,12 @@ func (c *compiler) compile(node ast.Node) {
 		c.ConditionalNode(n)
 	case *ast.ArrayNode:
 		c.ArrayNode(n)
+	case *ast.SequenceNode:
+		c.SequenceNode(n)
+	case *ast.LetNode:
+		c.LetNode(n)
+	case *ast.VariableNode:
+		c.VariableNode(n)
 	case *ast.MapNode:
 		c.MapNode(n)
 	case *ast.PairNode:
@@ -170,6 +241,10 @@ func (c *compiler) compile(node ast.Node) {
 	default:
 		panic(fmt.Sprintf("undefined node type (%T)", node))
 	}
+
+	if key != "" {
+		c.cse.store(c, key)
+	}
 }
 
 func (c *compiler) NilNode(node *ast.NilNode) {
@@ -177,54 +252,24 @@ func (c *compiler) NilNode(node *ast.NilNode) {
 }
 
 func (c *compiler) IdentifierNode(node *ast.IdentifierNode) {
+	if value, ok := c.consts[node.Value]; ok {
+		c.emitPush(value)
+		return
+	}
 	v := c.makeConstant(node.Value)
-	if c.mapEnv {
-		c.emit(OpFetchMap, v...)
-	} else if node.NilSafe {
+	if node.NilSafe {
 		c.emit(OpFetchNilSafe, v...)
+	} else if c.strict {
+		c.emit(OpFetchStrict, v...)
+	} else if c.mapEnv {
+		c.emit(OpFetchMap, v...)
 	} else {
 		c.emit(OpFetch, v...)
 	}
 }
 
 func (c *compiler) IntegerNode(node *ast.IntegerNode) {
-	t := node.Type()
-	if t == nil {
-		c.emitPush(node.Value)
-		return
-	}
-
-	switch t.Kind() {
-	case reflect.Float32:
-		c.emitPush(float32(node.Value))
-	case reflect.Float64:
-		c.emitPush(float64(node.Value))
-
-	case reflect.Int:
-		c.emitPush(int(node.Value))
-	case reflect.Int8:
-		c.emitPush(int8(node.Value))
-	case reflect.Int16:
-		c.emitPush(int16(node.Value))
-	case reflect.Int32:
-		c.emitPush(int32(node.Value))
-	case reflect.Int64:
-		c.emitPush(int64(node.Value))
-
-	case reflect.Uint:
-		c.emitPush(uint(node.Value))
-	case reflect.Uint8:
-		c.emitPush(uint8(node.Value))
-	case reflect.Uint16:
-		c.emitPush(uint16(node.Value))
-	case reflect.Uint32:
-		c.emitPush(uint32(node.Value))
-	case reflect.Uint64:
-		c.emitPush(uint64(node.Value))
-
-	default:
-		c.emitPush(node.Value)
-	}
+	c.emitPush(Integer(node.Value, node.Type()))
 }
 
 func (c *compiler) FloatNode(node *ast.FloatNode) {
@@ -248,6 +293,26 @@ func (c *compiler) ConstantNode(node *ast.ConstantNode) {
 }
 
 func (c *compiler) UnaryNode(node *ast.UnaryNode) {
+	// The negation of an equality or of a membership test is fused into
+	// the opposite opcode. Orderings are not, as with NaN !(a < b) is true
+	// but a >= b is false.
+	if b, ok := node.Node.(*ast.BinaryNode); ok && (node.Operator == "!" || node.Operator == "not") &&
+		(c.cse == nil || !c.cse.shared(b)) {
+		// The fused opcode reports failures at b, as if b were compiled.
+		switch b.Operator {
+		case "==", "!=":
+			c.nodes = append(c.nodes, b)
+			c.equal(b, b.Operator == "==")
+			c.nodes = c.nodes[:len(c.nodes)-1]
+			return
+		case "in", "not in":
+			c.nodes = append(c.nodes, b)
+			c.in(b, b.Operator == "in")
+			c.nodes = c.nodes[:len(c.nodes)-1]
+			return
+		}
+	}
+
 	c.compile(node.Node)
 
 	switch node.Operator {
@@ -267,52 +332,32 @@ func (c *compiler) UnaryNode(node *ast.UnaryNode) {
 }
 
 func (c *compiler) BinaryNode(node *ast.BinaryNode) {
-	l := kind(node.Left)
-	r := kind(node.Right)
-
 	switch node.Operator {
 	case "==":
-		c.compile(node.Left)
-		c.compile(node.Right)
-
-		if l == r && l == reflect.Int {
-			c.emit(OpEqualInt)
-		} else if l == r && l == reflect.String {
-			c.emit(OpEqualString)
-		} else {
-			c.emit(OpEqual)
-		}
+		c.equal(node, false)
 
 	case "!=":
-		c.compile(node.Left)
-		c.compile(node.Right)
-		c.emit(OpEqual)
-		c.emit(OpNot)
+		c.equal(node, true)
 
 	case "or", "||":
 		c.compile(node.Left)
 		end := c.emit(OpJumpIfTrue, c.placeholder()...)
 		c.emit(OpPop)
-		c.compile(node.Right)
+		c.compileConditional(node.Right)
 		c.patchJump(end)
 
 	case "and", "&&":
 		c.compile(node.Left)
 		end := c.emit(OpJumpIfFalse, c.placeholder()...)
 		c.emit(OpPop)
-		c.compile(node.Right)
+		c.compileConditional(node.Right)
 		c.patchJump(end)
 
 	case "in":
-		c.compile(node.Left)
-		c.compile(node.Right)
-		c.emit(OpIn)
+		c.in(node, false)
 
 	case "not in":
-		c.compile(node.Left)
-		c.compile(node.Right)
-		c.emit(OpIn)
-		c.emit(OpNot)
+		c.in(node, true)
 
 	case "<":
 		c.compile(node.Left)
@@ -352,7 +397,11 @@ func (c *compiler) BinaryNode(node *ast.BinaryNode) {
 	case "/":
 		c.compile(node.Left)
 		c.compile(node.Right)
-		c.emit(OpDivide)
+		if c.divideInf {
+			c.emit(OpDivideInf)
+		} else {
+			c.emit(OpDivide)
+		}
 
 	case "%":
 		c.compile(node.Left)
@@ -398,13 +447,19 @@ func (c *compiler) MatchesNode(node *ast.MatchesNode) {
 	}
 	c.compile(node.Left)
 	c.compile(node.Right)
+	if node.Flags != nil {
+		c.compile(node.Flags)
+		c.emit(OpMatchesFlags)
+		return
+	}
 	c.emit(OpMatches)
 }
 
 func (c *compiler) PropertyNode(node *ast.PropertyNode) {
 	c.compile(node.Node)
 	if !node.NilSafe {
-		c.emit(OpProperty, c.makeConstant(node.Property)...)
+		ip := c.emit(OpProperty, c.makeConstant(node.Property)...)
+		c.addPath(ip, node)
 	} else {
 		c.emit(OpPropertyNilSafe, c.makeConstant(node.Property)...)
 	}
@@ -413,7 +468,20 @@ func (c *compiler) PropertyNode(node *ast.PropertyNode) {
 func (c *compiler) IndexNode(node *ast.IndexNode) {
 	c.compile(node.Node)
 	c.compile(node.Index)
-	c.emit(OpIndex)
+	op := OpIndex
+	if node.NilSafe {
+		op = OpIndexNilSafe
+	}
+	ip := c.emit(op)
+	c.addPath(ip, node)
+}
+
+// addPath records the access path of node for the instruction emitted
+// right before ip.
+func (c *compiler) addPath(ip int, node ast.Node) {
+	if p, ok := ast.Path(node); ok {
+		c.paths[ip-1] = p
+	}
 }
 
 func (c *compiler) SliceNode(node *ast.SliceNode) {
@@ -443,7 +511,64 @@ func (c *compiler) MethodNode(node *ast.MethodNode) {
 	}
 }
 
+func (c *compiler) CallNode(node *ast.CallNode) {
+	c.compile(node.Callee)
+	for _, arg := range node.Arguments {
+		c.compile(arg)
+	}
+	c.emit(OpCallValue, c.makeConstant(Call{Size: len(node.Arguments)})...)
+}
+
 func (c *compiler) FunctionNode(node *ast.FunctionNode) {
+	if node.Builtin && node.Name == "ifNull" && len(node.Arguments) != 2 {
+		panic(fmt.Sprintf("invalid number of arguments for ifNull (expected 2, got %v)", len(node.Arguments)))
+	}
+	if node.Builtin && (node.Name == "coalesce" || node.Name == "ifNull") {
+		c.emitCoalesce(node.Arguments)
+		return
+	}
+	if node.Builtin && node.Name == "require" {
+		c.compile(node.Arguments[0])
+		if len(node.Arguments) > 1 {
+			c.compile(node.Arguments[1])
+		} else {
+			c.emitPush("requirement failed")
+		}
+		c.emit(OpRequire)
+		return
+	}
+	if node.Builtin && (node.Name == "try" || node.Name == "onError") {
+		fallback := c.emit(OpTry, c.placeholder()...)
+		c.compileConditional(node.Arguments[0])
+		end := c.emit(OpJump, c.placeholder()...)
+		c.patchJump(fallback)
+		if len(node.Arguments) > 1 {
+			c.compileConditional(node.Arguments[1])
+		} else {
+			c.emit(OpNil)
+		}
+		c.patchJump(end)
+		return
+	}
+	if node.Builtin && node.Name == "var" {
+		c.compile(node.Arguments[0])
+		if c.strict {
+			c.emit(OpFetchVarStrict)
+		} else {
+			c.emit(OpFetchVar)
+		}
+		return
+	}
+	if node.Builtin && node.Name == "apply" {
+		c.compile(node.Arguments[0])
+		if len(node.Arguments) > 1 {
+			c.compile(node.Arguments[1])
+		} else {
+			c.emit(OpNil)
+		}
+		c.emit(OpApply)
+		return
+	}
 	for _, arg := range node.Arguments {
 		c.compile(arg)
 	}
@@ -451,9 +576,39 @@ func (c *compiler) FunctionNode(node *ast.FunctionNode) {
 	if node.Fast {
 		op = OpCallFast
 	}
+	if node.Builtin {
+		op = OpCallBuiltin
+	}
+	if node.Func.IsValid() {
+		c.emit(OpCallFunc, c.makeConstant(Func{Name: node.Name, Fn: node.Func, Size: len(node.Arguments)})...)
+		return
+	}
 	c.emit(op, c.makeConstant(Call{Name: node.Name, Size: len(node.Arguments)})...)
 }
 
+// emitCoalesce evaluates the arguments in order until one is not nil.
+func (c *compiler) emitCoalesce(arguments []ast.Node) {
+	if len(arguments) == 0 {
+		c.emit(OpNil)
+		return
+	}
+	var ends []int
+	for i, arg := range arguments {
+		if i == 0 {
+			c.compile(arg)
+		} else {
+			c.compileConditional(arg)
+		}
+		if i < len(arguments)-1 {
+			ends = append(ends, c.emit(OpJumpIfNotNil, c.placeholder()...))
+			c.emit(OpPop)
+		}
+	}
+	for _, end := range ends {
+		c.patchJump(end)
+	}
+}
+
 func (c *compiler) BuiltinNode(node *ast.BuiltinNode) {
 	switch node.Name {
 	case "len":
@@ -549,6 +704,17 @@ func (c *compiler) BuiltinNode(node *ast.BuiltinNode) {
 		c.emit(OpEnd)
 		c.emit(OpArray)
 
+	case "fill":
+		c.compile(node.Arguments[0])
+		c.emit(OpCallBuiltin, c.makeConstant(Call{Name: "fill", Size: 1})...)
+		c.emit(OpBegin)
+		size := c.emitLoop(func() {
+			c.compile(node.Arguments[1])
+		})
+		c.emit(OpLoad, size...)
+		c.emit(OpEnd)
+		c.emit(OpArray)
+
 	case "count":
 		count := c.makeConstant("count")
 		c.compile(node.Arguments[0])
@@ -564,6 +730,12 @@ func (c *compiler) BuiltinNode(node *ast.BuiltinNode) {
 		c.emit(OpLoad, count...)
 		c.emit(OpEnd)
 
+	case "between":
+		c.compile(node.Arguments[0])
+		c.compile(node.Arguments[1])
+		c.compile(node.Arguments[2])
+		c.emit(OpBetween)
+
 	default:
 		panic(fmt.Sprintf("unknown builtin %v", node.Name))
 	}
@@ -586,6 +758,7 @@ func (c *compiler) emitLoop(body func()) []byte {
 	size := c.makeConstant("size")
 	array := c.makeConstant("array")
 
+	c.emit(OpValues)
 	c.emit(OpLen)
 	c.emit(OpStore, size...)
 	c.emit(OpStore, array...)
@@ -611,7 +784,17 @@ func (c *compiler) emitLoop(body func()) []byte {
 }
 
 func (c *compiler) ClosureNode(node *ast.ClosureNode) {
-	c.compile(node.Node)
+	c.compileConditional(node.Node)
+}
+
+// compileConditional compiles node which may not be evaluated, or may be
+// evaluated many times, so its subexpressions are never stored.
+func (c *compiler) compileConditional(node ast.Node) {
+	if c.cse != nil {
+		c.cse.conditional++
+		defer func() { c.cse.conditional-- }()
+	}
+	c.compile(node)
 }
 
 func (c *compiler) PointerNode(node *ast.PointerNode) {
@@ -625,12 +808,12 @@ func (c *compiler) ConditionalNode(node *ast.ConditionalNode) {
 	otherwise := c.emit(OpJumpIfFalse, c.placeholder()...)
 
 	c.emit(OpPop)
-	c.compile(node.Exp1)
+	c.compileConditional(node.Exp1)
 	end := c.emit(OpJump, c.placeholder()...)
 
 	c.patchJump(otherwise)
 	c.emit(OpPop)
-	c.compile(node.Exp2)
+	c.compileConditional(node.Exp2)
 
 	c.patchJump(end)
 }
@@ -644,6 +827,26 @@ func (c *compiler) ArrayNode(node *ast.ArrayNode) {
 	c.emit(OpArray)
 }
 
+// SequenceNode leaves the values of all the nodes on the stack, which are
+// the results of the program.
+func (c *compiler) SequenceNode(node *ast.SequenceNode) {
+	for _, node := range node.Nodes {
+		c.compile(node)
+	}
+}
+
+func (c *compiler) LetNode(node *ast.LetNode) {
+	c.compile(node.Value)
+	slot := c.local()
+	c.lets[node.Index] = slot
+	c.emit(OpStoreLocal, encode(slot)...)
+	c.compile(node.Body)
+}
+
+func (c *compiler) VariableNode(node *ast.VariableNode) {
+	c.emit(OpLoadLocal, encode(c.lets[node.Index])...)
+}
+
 func (c *compiler) MapNode(node *ast.MapNode) {
 	for _, pair := range node.Pairs {
 		c.compile(pair)
@@ -664,6 +867,49 @@ func encode(i uint16) []byte {
 	return b
 }
 
+// equal compiles the comparison of the operands of node for equality, or
+// for inequality if not is set.
+func (c *compiler) equal(node *ast.BinaryNode, not bool) {
+	l := kind(node.Left)
+	r := kind(node.Right)
+
+	c.compile(node.Left)
+	c.compile(node.Right)
+
+	// Named types may implement Equaler, so only plain ints and
+	// strings take the fast path.
+	if l == r && l == reflect.Int && isBasic(node.Left, node.Right) {
+		c.emit(choose(not, OpNotEqualInt, OpEqualInt))
+	} else if l == r && l == reflect.String && isBasic(node.Left, node.Right) {
+		c.emit(choose(not, OpNotEqualString, OpEqualString))
+	} else {
+		c.emit(choose(not, OpNotEqual, OpEqual))
+	}
+}
+
+// in compiles the membership test of node, negated if not is set.
+func (c *compiler) in(node *ast.BinaryNode, not bool) {
+	c.compile(node.Left)
+	c.compile(node.Right)
+	c.emit(choose(not, OpNotIn, OpIn))
+}
+
+func choose(cond bool, a, b byte) byte {
+	if cond {
+		return a
+	}
+	return b
+}
+
+func isBasic(nodes ...ast.Node) bool {
+	for _, node := range nodes {
+		if t := node.Type(); t == nil || t.PkgPath() != "" {
+			return false
+		}
+	}
+	return true
+}
+
 func kind(node ast.Node) reflect.Kind {
 	t := node.Type()
 	if t == nil {
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/ebusto/expr/ast"
 	"github.com/ebusto/expr/compiler"
 	"github.com/ebusto/expr/conf"
 	"github.com/ebusto/expr/parser"
@@ -107,6 +108,51 @@ func TestCompile(t *testing.T) {
 				},
 			},
 		},
+		{
+			`"a" != "b"`,
+			vm.Program{
+				Constants: []interface{}{"a", "b"},
+				Bytecode: []byte{
+					vm.OpPush, 0, 0,
+					vm.OpPush, 1, 0,
+					vm.OpNotEqual,
+				},
+			},
+		},
+		{
+			`!("a" == "b")`,
+			vm.Program{
+				Constants: []interface{}{"a", "b"},
+				Bytecode: []byte{
+					vm.OpPush, 0, 0,
+					vm.OpPush, 1, 0,
+					vm.OpNotEqual,
+				},
+			},
+		},
+		{
+			`not ("a" not in "b")`,
+			vm.Program{
+				Constants: []interface{}{"a", "b"},
+				Bytecode: []byte{
+					vm.OpPush, 0, 0,
+					vm.OpPush, 1, 0,
+					vm.OpIn,
+				},
+			},
+		},
+		{
+			`!(1 < 2)`,
+			vm.Program{
+				Constants: []interface{}{1, 2},
+				Bytecode: []byte{
+					vm.OpPush, 0, 0,
+					vm.OpPush, 1, 0,
+					vm.OpLess,
+					vm.OpNot,
+				},
+			},
+		},
 		{
 			`-1`,
 			vm.Program{
@@ -144,6 +190,15 @@ func TestCompile(t *testing.T) {
 	}
 }
 
+func TestCompile_ifNull(t *testing.T) {
+	tree, err := parser.Parse(`ifNull(a, b, c)`)
+	require.NoError(t, err)
+	tree.Node.(*ast.FunctionNode).Builtin = true
+
+	_, err = compiler.Compile(tree, nil)
+	require.EqualError(t, err, "invalid number of arguments for ifNull (expected 2, got 3)")
+}
+
 func TestCompile_cast(t *testing.T) {
 	input := `1`
 	expected := &vm.Program{
@@ -164,3 +219,109 @@ func TestCompile_cast(t *testing.T) {
 
 	assert.Equal(t, expected.Disassemble(), program.Disassemble())
 }
+
+func TestCompile_cse(t *testing.T) {
+	var tests = []struct {
+		input   string
+		program vm.Program
+	}{
+		{
+			`(a + b) * (a + b)`,
+			vm.Program{
+				Constants: []interface{}{"a", "b"},
+				Bytecode: []byte{
+					vm.OpFetch, 0, 0,
+					vm.OpFetch, 1, 0,
+					vm.OpAdd,
+					vm.OpStoreLocal, 0, 0,
+					vm.OpLoadLocal, 0, 0,
+					vm.OpLoadLocal, 0, 0,
+					vm.OpMultiply,
+				},
+			},
+		},
+		{
+			// The first occurrence may be skipped, so it is not stored.
+			`c ? -a : -a`,
+			vm.Program{
+				Constants: []interface{}{"c", "a"},
+				Bytecode: []byte{
+					vm.OpFetch, 0, 0,
+					vm.OpJumpIfFalse, 8, 0,
+					vm.OpPop,
+					vm.OpFetch, 1, 0,
+					vm.OpNegate,
+					vm.OpJump, 5, 0,
+					vm.OpPop,
+					vm.OpFetch, 1, 0,
+					vm.OpNegate,
+				},
+			},
+		},
+		{
+			// A shared comparison is stored, so its negation is not fused.
+			`!(a == b) || a == b`,
+			vm.Program{
+				Constants: []interface{}{"a", "b"},
+				Bytecode: []byte{
+					vm.OpFetch, 0, 0,
+					vm.OpFetch, 1, 0,
+					vm.OpEqual,
+					vm.OpStoreLocal, 0, 0,
+					vm.OpLoadLocal, 0, 0,
+					vm.OpNot,
+					vm.OpJumpIfTrue, 4, 0,
+					vm.OpPop,
+					vm.OpLoadLocal, 0, 0,
+				},
+			},
+		},
+		{
+			`f(a) + f(a)`,
+			vm.Program{
+				Constants: []interface{}{"a", vm.Call{Name: "f", Size: 1}},
+				Bytecode: []byte{
+					vm.OpFetch, 0, 0,
+					vm.OpCall, 1, 0,
+					vm.OpFetch, 0, 0,
+					vm.OpCall, 1, 0,
+					vm.OpAdd,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		tree, err := parser.Parse(test.input)
+		require.NoError(t, err)
+
+		program, err := compiler.Compile(tree, &conf.Config{Optimize: true})
+		require.NoError(t, err, test.input)
+
+		assert.Equal(t, test.program.Disassemble(), program.Disassemble(), test.input)
+	}
+}
+
+func TestCompile_fusedNegation(t *testing.T) {
+	tree, err := parser.Parse(`true && !(A in B) && not (A == B)`)
+	require.NoError(t, err)
+
+	program, err := compiler.Compile(tree, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "0\tOpTrue\n"+
+		"1\tOpJumpIfFalse\t8\t(12)\n"+
+		"4\tOpPop\n"+
+		"5\tOpFetch\t0\t\"A\"\n"+
+		"8\tOpFetch\t1\t\"B\"\n"+
+		"11\tOpNotIn\n"+
+		"12\tOpJumpIfFalse\t8\t(23)\n"+
+		"15\tOpPop\n"+
+		"16\tOpFetch\t0\t\"A\"\n"+
+		"19\tOpFetch\t1\t\"B\"\n"+
+		"22\tOpNotEqual\n", program.Disassemble())
+
+	// The fused opcodes are located at the operators they negate.
+	assert.Equal(t, 12, program.Locations[11].Column)
+	assert.Equal(t, 28, program.Locations[22].Column)
+}
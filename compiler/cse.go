@@ -0,0 +1,108 @@
+package compiler
+
+import (
+	"github.com/ebusto/expr/ast"
+	. "github.com/ebusto/expr/vm"
+)
+
+// cse implements common subexpression elimination. A subexpression which
+// occurs more than once is stored into a local slot the first time it is
+// evaluated unconditionally, and later occurrences load it from the slot.
+type cse struct {
+	pure        map[string]bool // functions without side effects
+	counts      map[string]int
+	slots       map[string]uint16
+	conditional int // depth of code which may not be evaluated
+}
+
+func newCSE(pure map[string]bool) *cse {
+	return &cse{
+		pure:   pure,
+		counts: make(map[string]int),
+		slots:  make(map[string]uint16),
+	}
+}
+
+func (s *cse) Enter(*ast.Node) {}
+func (s *cse) Exit(node *ast.Node) {
+	if key, ok := s.key(*node); ok {
+		s.counts[key]++
+	}
+}
+
+// key returns the structural key of node, if node is worth caching.
+func (s *cse) key(node ast.Node) (string, bool) {
+	switch node.(type) {
+	case *ast.UnaryNode, *ast.BinaryNode, *ast.MatchesNode, *ast.PropertyNode,
+		*ast.IndexNode, *ast.SliceNode, *ast.FunctionNode, *ast.BuiltinNode,
+		*ast.ConditionalNode, *ast.ArrayNode, *ast.MapNode:
+	default:
+		return "", false
+	}
+	if !s.isPure(node) {
+		return "", false
+	}
+	return ast.Dump(node), true
+}
+
+func (s *cse) isPure(node ast.Node) bool {
+	p := &purity{pure: s.pure, ok: true}
+	ast.Walk(&node, p)
+	return p.ok
+}
+
+type purity struct {
+	pure map[string]bool
+	ok   bool
+}
+
+func (p *purity) Enter(*ast.Node) {}
+func (p *purity) Exit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.MethodNode, *ast.CallNode:
+		p.ok = false
+	case *ast.ConstantNode:
+		// Dump does not distinguish types of constants.
+		p.ok = false
+	case *ast.FunctionNode:
+		if n.Builtin {
+			if Builtins[n.Name].Impure {
+				p.ok = false
+			}
+		} else if !p.pure[n.Name] {
+			p.ok = false
+		}
+	}
+}
+
+// shared reports whether node occurs more than once, so that it must be
+// compiled on its own to be stored.
+func (s *cse) shared(node ast.Node) bool {
+	key, ok := s.key(node)
+	return ok && s.counts[key] > 1
+}
+
+// load emits a load of node if its value is already stored. Otherwise it
+// returns the key to store the value under once node is compiled, if any.
+func (s *cse) load(c *compiler, node ast.Node) (string, bool) {
+	key, ok := s.key(node)
+	if !ok || s.counts[key] < 2 {
+		return "", false
+	}
+	if slot, ok := s.slots[key]; ok {
+		c.emit(OpLoadLocal, encode(slot)...)
+		return "", true
+	}
+	if s.conditional > 0 {
+		return "", false
+	}
+	return key, false
+}
+
+// store stores the value on top of the stack, keeping it on the stack.
+func (s *cse) store(c *compiler, key string) {
+	slot := c.local()
+	s.slots[key] = slot
+	c.emit(OpStoreLocal, encode(slot)...)
+	c.emit(OpLoadLocal, encode(slot)...)
+}
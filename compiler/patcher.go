@@ -1,12 +1,15 @@
 package compiler
 
 import (
+	"reflect"
+
 	"github.com/ebusto/expr/ast"
 	"github.com/ebusto/expr/conf"
 )
 
 type operatorPatcher struct {
 	ops   map[string][]string
+	fns   map[string][]reflect.Value
 	types conf.TypesTable
 }
 
@@ -17,28 +20,37 @@ func (p *operatorPatcher) Exit(node *ast.Node) {
 		return
 	}
 
-	fns, ok := p.ops[binaryNode.Operator]
-	if !ok {
-		return
-	}
-
 	leftType := binaryNode.Left.Type()
 	rightType := binaryNode.Right.Type()
 
-	_, fn, ok := conf.FindSuitableOperatorOverload(fns, p.types, leftType, rightType)
-	if ok {
-		newNode := &ast.FunctionNode{
-			Name:      fn,
-			Arguments: []ast.Node{binaryNode.Left, binaryNode.Right},
+	if fns, ok := p.ops[binaryNode.Operator]; ok {
+		_, fn, ok := conf.FindSuitableOperatorOverload(fns, p.types, leftType, rightType)
+		if ok {
+			newNode := &ast.FunctionNode{
+				Name:      fn,
+				Arguments: []ast.Node{binaryNode.Left, binaryNode.Right},
+			}
+			ast.Patch(node, newNode)
+			return
+		}
+	}
+
+	if fns, ok := p.fns[binaryNode.Operator]; ok {
+		if fn, ok := conf.FindSuitableOperatorFunc(fns, leftType, rightType); ok {
+			newNode := &ast.FunctionNode{
+				Name:      binaryNode.Operator,
+				Arguments: []ast.Node{binaryNode.Left, binaryNode.Right},
+				Func:      fn,
+			}
+			ast.Patch(node, newNode)
 		}
-		ast.Patch(node, newNode)
 	}
 }
 
 func PatchOperators(node *ast.Node, config *conf.Config) {
-	if len(config.Operators) == 0 {
+	if len(config.Operators) == 0 && len(config.OperatorFns) == 0 {
 		return
 	}
-	patcher := &operatorPatcher{ops: config.Operators, types: config.Types}
+	patcher := &operatorPatcher{ops: config.Operators, fns: config.OperatorFns, types: config.Types}
 	ast.Walk(node, patcher)
 }
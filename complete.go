@@ -0,0 +1,130 @@
+package expr
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ebusto/expr/ast"
+	"github.com/ebusto/expr/checker"
+	"github.com/ebusto/expr/conf"
+	"github.com/ebusto/expr/parser"
+	"github.com/ebusto/expr/parser/lexer"
+)
+
+// Candidate is a name suggested by Complete.
+type Candidate struct {
+	Name   string
+	Type   reflect.Type // type of the field, or of the method
+	Method bool
+}
+
+// placeholder stands for the name being completed, so the input before it
+// parses as a property access.
+const placeholder = "$complete"
+
+// Complete returns the names which may complete the word ending at byte
+// offset pos of input, for an editor. After a dot, as in "User.Na", they
+// are the fields and methods of the type of the expression before the dot,
+// which is resolved by the checker with the types of env. Otherwise they
+// are the variables and functions of env. Candidates start with the part of
+// the word before pos and are sorted by name. Options such as Infix make
+// input parse as it would compile.
+func Complete(input string, pos int, env interface{}, ops ...Option) []Candidate {
+	if pos < 0 || pos > len(input) {
+		pos = len(input)
+	}
+	text := input[:pos]
+
+	start := len(text)
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(text[:start])
+		if !lexer.IsAlphaNumeric(r) {
+			break
+		}
+		start -= size
+	}
+	prefix, before := text[start:], text[:start]
+
+	var types conf.TypesTable
+	if strings.HasSuffix(before, ".") && !strings.HasSuffix(before, "..") {
+		config := conf.New(env)
+		config.Operators = make(conf.OperatorsTable)
+		for _, op := range ops {
+			op(config)
+		}
+		t, ok := baseType(before+placeholder, config)
+		if !ok {
+			return nil
+		}
+		types = members(t)
+	} else {
+		types = conf.CreateTypesTable(env)
+		if reflect.ValueOf(env).Kind() != reflect.Map {
+			types = exported(types)
+		}
+	}
+
+	var candidates []Candidate
+	for name, tag := range types {
+		if tag.Ambiguous || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		candidates = append(candidates, Candidate{Name: name, Type: tag.Type, Method: tag.Method})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates
+}
+
+// baseType returns the type of the expression of which the placeholder is
+// accessed in input.
+func baseType(input string, config *conf.Config) (reflect.Type, bool) {
+	tree, _ := parser.ParseTolerantWith(input, infixOperators(config))
+	finder := &propertyFinder{}
+	ast.Walk(&tree.Node, finder)
+	if finder.node == nil {
+		return nil, false
+	}
+
+	t, err := checker.Check(&parser.Tree{Node: finder.node, Source: tree.Source}, config)
+	if err != nil || t == nil || t.Kind() == reflect.Interface {
+		return nil, false
+	}
+	return t, true
+}
+
+type propertyFinder struct {
+	node ast.Node
+}
+
+func (f *propertyFinder) Enter(*ast.Node) {}
+func (f *propertyFinder) Exit(node *ast.Node) {
+	if n, ok := (*node).(*ast.PropertyNode); ok && n.Property == placeholder {
+		f.node = n.Node
+	}
+}
+
+// members returns the fields and methods of values of type t.
+func members(t reflect.Type) conf.TypesTable {
+	types := conf.FieldsFromStruct(t)
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		types[m.Name] = conf.Tag{Type: m.Type, Method: true}
+	}
+	return exported(types)
+}
+
+// exported returns the names of types which are exported Go identifiers.
+func exported(types conf.TypesTable) conf.TypesTable {
+	out := make(conf.TypesTable, len(types))
+	for name, tag := range types {
+		if r, _ := utf8.DecodeRuneInString(name); unicode.IsUpper(r) {
+			out[name] = tag
+		}
+	}
+	return out
+}
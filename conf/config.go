@@ -13,13 +13,55 @@ type Config struct {
 	MapEnv       bool
 	Types        TypesTable
 	Operators    OperatorsTable
+	OperatorFns  map[string][]reflect.Value
+	Infix        map[string]Infix
 	Expect       reflect.Kind
 	Optimize     bool
 	Strict       bool
 	DefaultType  reflect.Type
 	ConstExprFns map[string]reflect.Value
+	Pure         map[string]bool
+	Constants    map[string]interface{}
 	Visitors     []ast.Visitor
-	err          error
+
+	// BuiltinsFirst resolves calls to builtins before functions of env.
+	BuiltinsFirst bool
+	// NoShadowing makes it an error for a name to hide another one.
+	NoShadowing bool
+	// NoMethodCalls makes it an error to call methods of values.
+	NoMethodCalls bool
+	// NoNaNComparison makes comparisons with NaN fail at runtime.
+	NoNaNComparison bool
+	// DivideByZeroInf makes integer division by zero give +Inf, -Inf or NaN.
+	DivideByZeroInf bool
+	// NoUndefinedVariables makes variables missing from env fail at runtime.
+	NoUndefinedVariables bool
+	// MultipleResults allows top-level expressions separated by commas,
+	// whose values are returned as an array.
+	MultipleResults bool
+	// MissingKey is the result of accessing a key which is not in a map.
+	MissingKey vm.MissingKeyPolicy
+	// MaxApplyDepth limits how deep programs run by apply may nest.
+	MaxApplyDepth int
+	// RegexpCache keeps the regexps compiled by matches at runtime.
+	RegexpCache *vm.RegexpCache
+	// MaxRecursion limits how deep closures, try() and apply may nest.
+	MaxRecursion int
+	// NumericStrings makes operators and builtins taking numbers accept
+	// strings holding numbers at runtime.
+	NumericStrings bool
+	// MaxPatternLength limits the length of regular expressions of matches.
+	MaxPatternLength int
+	// MaxMatchLength limits the length of strings matched by matches.
+	MaxMatchLength int
+	// AllowedFunctions, if not nil, are the only functions which may be
+	// called, including builtins.
+	AllowedFunctions map[string]bool
+
+	// Int64Literals makes integer literals int64 instead of int.
+	Int64Literals bool
+
+	err error
 }
 
 func New(env interface{}) *Config {
@@ -64,6 +106,22 @@ func (c *Config) Check() error {
 		}
 	}
 
+	// Check that functions of operators take two arguments and return one value.
+	for op, fns := range c.OperatorFns {
+		for _, fn := range fns {
+			if fn.Kind() != reflect.Func || fn.Type().NumIn() != 2 || fn.Type().NumOut() != 1 {
+				return fmt.Errorf("function %v for %s operator does not have a correct signature", fn.Type(), op)
+			}
+		}
+	}
+
+	// Check that constants do not hide variables of env.
+	for name := range c.Constants {
+		if _, ok := c.Types[name]; ok {
+			return fmt.Errorf("constant %v is also defined in environment", name)
+		}
+	}
+
 	// Check that all ConstExprFns are functions.
 	for name, fn := range c.ConstExprFns {
 		if fn.Kind() != reflect.Func {
@@ -82,6 +140,18 @@ func (c *Config) ConstExpr(name string) {
 	c.ConstExprFns[name] = vm.FetchFn(c.Env, name)
 }
 
+// Constant defines a named constant, which is inlined by the compiler.
+func (c *Config) Constant(name string, value interface{}) {
+	if _, ok := c.Constants[name]; ok {
+		c.Error(fmt.Errorf("constant %v is already defined", name))
+		return
+	}
+	if c.Constants == nil {
+		c.Constants = make(map[string]interface{})
+	}
+	c.Constants[name] = value
+}
+
 func (c *Config) Error(err error) {
 	if c.err == nil {
 		c.err = err
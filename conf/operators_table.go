@@ -6,6 +6,13 @@ import "reflect"
 // Functions should be provided in the environment to allow operator overloading.
 type OperatorsTable map[string][]string
 
+// Infix is the precedence and associativity of a binary operator defined
+// with expr.Infix, as in parser.Infix.
+type Infix struct {
+	Precedence int
+	Right      bool
+}
+
 func FindSuitableOperatorOverload(fns []string, types TypesTable, l, r reflect.Type) (reflect.Type, string, bool) {
 	for _, fn := range fns {
 		fnType := types[fn]
@@ -16,11 +23,24 @@ func FindSuitableOperatorOverload(fns []string, types TypesTable, l, r reflect.T
 		firstArgType := fnType.Type.In(firstInIndex)
 		secondArgType := fnType.Type.In(firstInIndex + 1)
 
-		firstArgumentFit := l == firstArgType || (firstArgType.Kind() == reflect.Interface && (l == nil || l.Implements(firstArgType)))
-		secondArgumentFit := r == secondArgType || (secondArgType.Kind() == reflect.Interface && (r == nil || r.Implements(secondArgType)))
-		if firstArgumentFit && secondArgumentFit {
+		if argumentFit(l, firstArgType) && argumentFit(r, secondArgType) {
 			return fnType.Type.Out(0), fn, true
 		}
 	}
 	return nil, "", false
 }
+
+// FindSuitableOperatorFunc returns the first of fns which accepts operands
+// of types l and r.
+func FindSuitableOperatorFunc(fns []reflect.Value, l, r reflect.Type) (reflect.Value, bool) {
+	for _, fn := range fns {
+		if argumentFit(l, fn.Type().In(0)) && argumentFit(r, fn.Type().In(1)) {
+			return fn, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func argumentFit(t, argType reflect.Type) bool {
+	return t == argType || (argType.Kind() == reflect.Interface && (t == nil || t.Implements(argType)))
+}
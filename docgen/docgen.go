@@ -34,18 +34,97 @@ type Type struct {
 }
 
 var (
-	Operators = []string{"matches", "contains", "startsWith", "endsWith"}
+	Operators = []string{"matches", "contains", "startsWith", "endsWith", "between"}
 	Builtins  = map[Identifier]*Type{
-		"true":   {Kind: "bool"},
-		"false":  {Kind: "bool"},
-		"len":    {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "int"}},
-		"all":    {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "bool"}},
-		"none":   {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "bool"}},
-		"any":    {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "bool"}},
-		"one":    {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "bool"}},
-		"filter": {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
-		"map":    {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
-		"count":  {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "int"}},
+		"true":           {Kind: "bool"},
+		"false":          {Kind: "bool"},
+		"size":           {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "int"}},
+		"len":            {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "int"}},
+		"all":            {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "bool"}},
+		"none":           {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "bool"}},
+		"any":            {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "bool"}},
+		"one":            {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "bool"}},
+		"filter":         {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"map":            {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"seq":            {Kind: "func", Arguments: []*Type{{Kind: "float"}, {Kind: "float"}, {Kind: "float"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "float"}}},
+		"fill":           {Kind: "func", Arguments: []*Type{{Kind: "int"}, {Kind: "func"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"padLeft":        {Kind: "func", Arguments: []*Type{{Kind: "string"}, {Kind: "int"}, {Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"padRight":       {Kind: "func", Arguments: []*Type{{Kind: "string"}, {Kind: "int"}, {Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"truncate":       {Kind: "func", Arguments: []*Type{{Kind: "string"}, {Kind: "int"}, {Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"repeat":         {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "int"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"count":          {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "func"}}, Return: &Type{Kind: "int"}},
+		"now":            {Kind: "func", Return: &Type{Name: "time.Time", Kind: "struct"}},
+		"date":           {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Name: "time.Time", Kind: "struct"}},
+		"format":         {Kind: "func", Arguments: []*Type{{Name: "time.Time", Kind: "struct"}, {Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"duration":       {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Name: "time.Duration", Kind: "int"}},
+		"coalesce":       {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"ifNull":         {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"contains":       {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"startsWith":     {Kind: "func", Arguments: []*Type{{Kind: "string"}, {Kind: "string"}}, Return: &Type{Kind: "bool"}},
+		"endsWith":       {Kind: "func", Arguments: []*Type{{Kind: "string"}, {Kind: "string"}}, Return: &Type{Kind: "bool"}},
+		"indexOf":        {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "int"}},
+		"lastIndexOf":    {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "int"}},
+		"toArray":        {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"orDefault":      {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"clamp":          {Kind: "func", Arguments: []*Type{{Kind: "float"}, {Kind: "float"}, {Kind: "float"}}, Return: &Type{Kind: "float"}},
+		"diff":           {Kind: "func", Arguments: []*Type{{Kind: "float"}, {Kind: "float"}}, Return: &Type{Kind: "float"}},
+		"fixed":          {Kind: "func", Arguments: []*Type{{Kind: "float"}, {Kind: "int"}}, Return: &Type{Kind: "string"}},
+		"inRange":        {Kind: "func", Arguments: []*Type{{Kind: "float"}, {Kind: "float"}, {Kind: "float"}, {Kind: "bool"}}, Return: &Type{Kind: "bool"}},
+		"parseInt":       {Kind: "func", Arguments: []*Type{{Kind: "string"}, {Kind: "int"}}, Return: &Type{Kind: "int"}},
+		"parseFloat":     {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Kind: "float"}},
+		"intOr":          {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"floatOr":        {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"path":           {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "string"}}, Return: &Type{Kind: "any"}},
+		"sprintf":        {Kind: "func", Arguments: []*Type{{Kind: "string"}, {Kind: "any"}}, Return: &Type{Kind: "string"}},
+		"at":             {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "int"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"union":          {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "array", Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"intersect":      {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "array", Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"difference":     {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "array", Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"zip":            {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "array", Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "array", Type: &Type{Kind: "array", Type: &Type{Kind: "any"}}}},
+		"reverse":        {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"take":           {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "int"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"skip":           {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "int"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "any"}}},
+		"chunk":          {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "int"}}, Return: &Type{Kind: "array", Type: &Type{Kind: "array", Type: &Type{Kind: "any"}}}},
+		"isNaN":          {Kind: "func", Arguments: []*Type{{Kind: "float"}}, Return: &Type{Kind: "bool"}},
+		"isInf":          {Kind: "func", Arguments: []*Type{{Kind: "float"}}, Return: &Type{Kind: "bool"}},
+		"finite":         {Kind: "func", Arguments: []*Type{{Kind: "float"}, {Kind: "any"}}, Return: &Type{Kind: "float"}},
+		"versionCompare": {Kind: "func", Arguments: []*Type{{Kind: "string"}, {Kind: "string"}}, Return: &Type{Kind: "int"}},
+		"isEmpty":        {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"isBlank":        {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"bool":           {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"isString":       {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"isNumber":       {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"isBool":         {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"isArray":        {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"isMap":          {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "bool"}},
+		"median":         {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "float"}},
+		"percentile":     {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}, {Kind: "float"}}, Return: &Type{Kind: "float"}},
+		"base64":         {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"base64decode":   {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"hex":            {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"hexdecode":      {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"fromJSON":       {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Kind: "any"}},
+		"fromJSONNumber": {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Kind: "any"}},
+		"toJSON":         {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "string"}},
+		"tag":            {Kind: "func", Arguments: []*Type{{Kind: "struct"}, {Kind: "string"}, {Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"hash":           {Kind: "func", Arguments: []*Type{{Kind: "any"}}, Return: &Type{Kind: "int"}},
+		"min":            {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"max":            {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"humanizeBytes":  {Kind: "func", Arguments: []*Type{{Kind: "float"}, {Kind: "int"}}, Return: &Type{Kind: "string"}},
+		"formatNumber":   {Kind: "func", Arguments: []*Type{{Kind: "float"}, {Kind: "string"}}, Return: &Type{Kind: "string"}},
+		"humanizeNumber": {Kind: "func", Arguments: []*Type{{Kind: "float"}}, Return: &Type{Kind: "string"}},
+		"merge":          {Kind: "func", Arguments: []*Type{{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}, {Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}},
+		"pick":           {Kind: "func", Arguments: []*Type{{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}, {Kind: "any"}}, Return: &Type{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}},
+		"omit":           {Kind: "func", Arguments: []*Type{{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}, {Kind: "any"}}, Return: &Type{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}},
+		"require":        {Kind: "func", Arguments: []*Type{{Kind: "bool"}, {Kind: "string"}}, Return: &Type{Kind: "bool"}},
+		"onError":        {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"try":            {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"var":            {Kind: "func", Arguments: []*Type{{Kind: "string"}}, Return: &Type{Kind: "any"}},
+		"apply":          {Kind: "func", Arguments: []*Type{{Kind: "any"}, {Kind: "any"}}, Return: &Type{Kind: "any"}},
+		"toMap":          {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "array", Type: &Type{Kind: "any"}}}}, Return: &Type{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}},
+		"fromPairs":      {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "array", Type: &Type{Kind: "any"}}}}, Return: &Type{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}},
+		"entries":        {Kind: "func", Arguments: []*Type{{Kind: "map", Key: &Type{Kind: "any"}, Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "array", Type: &Type{Kind: "array", Type: &Type{Kind: "any"}}}},
+		"enumerate":      {Kind: "func", Arguments: []*Type{{Kind: "array", Type: &Type{Kind: "any"}}}, Return: &Type{Kind: "array", Type: &Type{Kind: "array", Type: &Type{Kind: "any"}}}},
 	}
 )
 
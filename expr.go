@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"github.com/ebusto/expr/ast"
 	"github.com/ebusto/expr/file"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/ebusto/expr/checker"
 	"github.com/ebusto/expr/compiler"
@@ -28,6 +31,12 @@ func Eval(input string, env interface{}) (interface{}, error) {
 		return nil, err
 	}
 
+	// Without env types the check is lenient, but it resolves builtins.
+	_, err = checker.Check(tree, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	program, err := compiler.Compile(tree, nil)
 	if err != nil {
 		return nil, err
@@ -63,14 +72,165 @@ func Env(env interface{}) Option {
 
 // AllowUndefinedVariables allows to use undefined variables inside expressions.
 // This can be used with expr.Env option to partially define a few variables.
-// Note what this option is only works in map environment are used, otherwise
-// runtime.fetch will panic as there is no way to get missing field zero value.
+// Undefined variables are nil at runtime, see DisallowUndefinedVariables.
 func AllowUndefinedVariables() Option {
 	return func(c *conf.Config) {
 		c.Strict = false
 	}
 }
 
+// BuiltinsFirst resolves function calls to builtins, such as now(), even if
+// env has a function with the same name.
+//
+// By default a bare identifier is looked up in let bindings, innermost
+// first, and then in env. A function call is looked up in env and then in
+// builtins.
+func BuiltinsFirst() Option {
+	return func(c *conf.Config) {
+		c.BuiltinsFirst = true
+	}
+}
+
+// DisallowShadowing reports an error for let bindings hiding variables of
+// env or outer bindings, and for functions of env hiding builtins.
+func DisallowShadowing() Option {
+	return func(c *conf.Config) {
+		c.NoShadowing = true
+	}
+}
+
+// DisallowMethodCalls reports an error for calls of methods of values, such
+// as User.Delete(), and of funcs taken from values by name, such as
+// Funcs["delete"](), while fields and map items may still be accessed.
+func DisallowMethodCalls() Option {
+	return func(c *conf.Config) {
+		c.NoMethodCalls = true
+	}
+}
+
+// DisallowNaNComparison makes comparisons fail at runtime if either
+// operand is NaN, instead of being false, so that the result of an invalid
+// computation such as 0.0 / 0 does not silently pass a filter. This holds
+// for between and for builtins comparing numbers, such as min, clamp and
+// median, too.
+func DisallowNaNComparison() Option {
+	return func(c *conf.Config) {
+		c.NoNaNComparison = true
+	}
+}
+
+// DivideByZeroInf makes a division of integers by zero, such as 1 / 0, give
+// +Inf, -Inf or NaN like a division of floats, instead of failing. As the
+// result of dividing integers may then be an integer or a float64, its type
+// is unknown to the checker, so it does not fit AsInt64. Modulo by zero
+// still fails.
+func DivideByZeroInf() Option {
+	return func(c *conf.Config) {
+		c.DivideByZeroInf = true
+	}
+}
+
+// MissingKey sets the result of accessing a key which is not in a map, the
+// zero value of its elements by default. With vm.MissingKeyNil it is nil,
+// and with vm.MissingKeyError an error, unless accessed with "?.".
+func MissingKey(policy vm.MissingKeyPolicy) Option {
+	return func(c *conf.Config) {
+		c.MissingKey = policy
+	}
+}
+
+// MaxApplyDepth limits how deep programs run by apply may nest, counted
+// from the program compiled with the option, vm.DefaultMaxApplyDepth by
+// default. The programs it applies can not raise the limit.
+func MaxApplyDepth(depth int) Option {
+	return func(c *conf.Config) {
+		c.MaxApplyDepth = depth
+	}
+}
+
+// RegexpCache makes the program keep the regexps compiled by matches for
+// patterns computed at runtime in cache, instead of the cache shared by all
+// programs, which keeps vm.DefaultRegexpCacheSize regexps. Programs given
+// the same cache share it.
+func RegexpCache(cache *vm.RegexpCache) Option {
+	return func(c *conf.Config) {
+		c.RegexpCache = cache
+	}
+}
+
+// MaxRecursion limits how deep closures of builtins such as map, try() and
+// programs run by apply may nest, vm.DefaultMaxRecursion by default, or
+// not at all if negative. A run nesting deeper fails with vm.ErrMaxRecursion.
+func MaxRecursion(depth int) Option {
+	return func(c *conf.Config) {
+		c.MaxRecursion = depth
+	}
+}
+
+// MaxPatternLength limits the length in bytes of the regular expressions of
+// matches, which are then rejected at compile time if constant, and at
+// runtime otherwise. There is no limit by default.
+func MaxPatternLength(n int) Option {
+	return func(c *conf.Config) {
+		c.MaxPatternLength = n
+	}
+}
+
+// MaxMatchLength limits the length in bytes of the strings matched against
+// regular expressions at runtime. There is no limit by default.
+func MaxMatchLength(n int) Option {
+	return func(c *conf.Config) {
+		c.MaxMatchLength = n
+	}
+}
+
+// NumericStrings makes arithmetic, comparisons, negation and builtins
+// taking numbers accept strings holding numbers, such as "42" or "1.5", at
+// runtime. Operators defined on strings still apply to two strings, so
+// "1" + "2" is "12".
+func NumericStrings() Option {
+	return func(c *conf.Config) {
+		c.NumericStrings = true
+	}
+}
+
+// DisallowUndefinedVariables makes variables which are not in env fail at
+// runtime with an error naming them, instead of being nil. Keys missing
+// from a map env are undefined too, unless accessed with "?." or given to
+// orDefault. Unknown names are already reported at compile time with Env,
+// unless AllowUndefinedVariables is used for a partially defined env. A
+// vm.Fetcher env must also implement vm.Lookuper for its undefined
+// variables to be told apart from nil ones.
+func DisallowUndefinedVariables() Option {
+	return func(c *conf.Config) {
+		c.NoUndefinedVariables = true
+	}
+}
+
+// MultipleResults allows an expression to be several expressions separated
+// by commas, as in "Price * Quantity, Price * Tax", computing several values
+// at once. The result is then an array of their values. Without the option,
+// such expressions are a compile error.
+func MultipleResults() Option {
+	return func(c *conf.Config) {
+		c.MultipleResults = true
+	}
+}
+
+// AllowFunctions reports an error for calls of functions and builtins, such
+// as len() or matches, which are not listed. Functions given to Operator
+// are always allowed. The option may be used more than once.
+func AllowFunctions(names ...string) Option {
+	return func(c *conf.Config) {
+		if c.AllowedFunctions == nil {
+			c.AllowedFunctions = make(map[string]bool)
+		}
+		for _, name := range names {
+			c.AllowedFunctions[name] = true
+		}
+	}
+}
+
 // Operator allows to override binary operator with function.
 func Operator(operator string, fn ...string) Option {
 	return func(c *conf.Config) {
@@ -78,6 +238,54 @@ func Operator(operator string, fn ...string) Option {
 	}
 }
 
+// OperatorFunc overrides binary operator with fn, for operands of the types
+// of its arguments. Unlike Operator, fn does not have to be in env.
+func OperatorFunc(operator string, fn interface{}) Option {
+	return func(c *conf.Config) {
+		if c.OperatorFns == nil {
+			c.OperatorFns = make(map[string][]reflect.Value)
+		}
+		c.OperatorFns[operator] = append(c.OperatorFns[operator], reflect.ValueOf(fn))
+	}
+}
+
+// Infix defines a new binary operator, such as "~>" or a word like "near",
+// which calls fn, a function of two arguments, with its operands. It binds
+// tighter than operators of lower precedence, see parser.Infix, and is left
+// associative. The operator may be given more functions for other types of
+// operands with OperatorFunc.
+func Infix(symbol string, precedence int, fn interface{}) Option {
+	return infix(symbol, conf.Infix{Precedence: precedence}, fn)
+}
+
+// InfixRight is like Infix, but defines a right associative operator, so
+// a ~> b ~> c is a ~> (b ~> c).
+func InfixRight(symbol string, precedence int, fn interface{}) Option {
+	return infix(symbol, conf.Infix{Precedence: precedence, Right: true}, fn)
+}
+
+func infix(symbol string, op conf.Infix, fn interface{}) Option {
+	return func(c *conf.Config) {
+		if c.Infix == nil {
+			c.Infix = make(map[string]conf.Infix)
+		}
+		c.Infix[symbol] = op
+		OperatorFunc(symbol, fn)(c)
+	}
+}
+
+// infixOperators returns the operators defined with Infix for the parser.
+func infixOperators(config *conf.Config) map[string]parser.Infix {
+	if len(config.Infix) == 0 {
+		return nil
+	}
+	infix := make(map[string]parser.Infix, len(config.Infix))
+	for symbol, op := range config.Infix {
+		infix[symbol] = parser.Infix(op)
+	}
+	return infix
+}
+
 // ConstExpr defines func expression as constant. If all argument to this function is constants,
 // then it can be replaced by result of this func call on compile step.
 func ConstExpr(fn string) Option {
@@ -86,6 +294,22 @@ func ConstExpr(fn string) Option {
 	}
 }
 
+// Constant defines a named constant. References to it are replaced by the
+// value at compile time, and are type checked as the Go type of the value.
+func Constant(name string, value interface{}) Option {
+	return func(c *conf.Config) {
+		c.Constant(name, value)
+	}
+}
+
+// Int64Literals makes integer literals, such as 42, int64 instead of int.
+// Literals out of the range of int are always int64.
+func Int64Literals() Option {
+	return func(c *conf.Config) {
+		c.Int64Literals = true
+	}
+}
+
 // AsBool tells the compiler to expect boolean result.
 func AsBool() Option {
 	return func(c *conf.Config) {
@@ -114,6 +338,19 @@ func Optimize(b bool) Option {
 	}
 }
 
+// Pure marks functions of env as free of side effects, so repeated calls
+// with the same arguments may be evaluated only once.
+func Pure(names ...string) Option {
+	return func(c *conf.Config) {
+		if c.Pure == nil {
+			c.Pure = make(map[string]bool)
+		}
+		for _, name := range names {
+			c.Pure[name] = true
+		}
+	}
+}
+
 // Patch adds visitor to list of visitors what will be applied before compiling AST to bytecode.
 func Patch(visitor ast.Visitor) Option {
 	return func(c *conf.Config) {
@@ -123,6 +360,13 @@ func Patch(visitor ast.Visitor) Option {
 
 // Compile parses and compiles given input expression to bytecode program.
 func Compile(input string, ops ...Option) (*vm.Program, error) {
+	program, _, err := CompileWithWarnings(input, ops...)
+	return program, err
+}
+
+// CompileWithWarnings is like Compile, but also returns warnings about
+// problems which do not prevent compilation, such as an unused let binding.
+func CompileWithWarnings(input string, ops ...Option) (*vm.Program, []file.Warning, error) {
 	config := &conf.Config{
 		Operators:    make(map[string][]string),
 		ConstExprFns: make(map[string]reflect.Value),
@@ -134,20 +378,133 @@ func Compile(input string, ops ...Option) (*vm.Program, error) {
 	}
 
 	if err := config.Check(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	tree, err := parser.Parse(input)
+	tree, err := parser.ParseWith(input, infixOperators(config))
 	if err != nil {
+		return nil, nil, err
+	}
+
+	return compile(tree, config)
+}
+
+// CompileMap compiles several named expressions into one program, which
+// returns a map[string]interface{} with the result of every expression
+// under its name.
+func CompileMap(inputs map[string]string, ops ...Option) (*vm.Program, error) {
+	config := &conf.Config{
+		Operators:    make(map[string][]string),
+		ConstExprFns: make(map[string]reflect.Value),
+		Optimize:     true,
+	}
+
+	for _, op := range ops {
+		op(config)
+	}
+
+	if err := config.Check(); err != nil {
 		return nil, err
 	}
+	if config.Expect != reflect.Invalid {
+		return nil, fmt.Errorf("misused expr.CompileMap: result is a map, AsBool, AsInt64 and AsFloat64 cannot be used")
+	}
 
-	_, err = checker.Check(tree, config)
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Expressions are laid out line after line in a combined source, so
+	// runtime errors still point at the right expression.
+	contents := make([]string, 0, len(names))
+	pairs := make([]ast.Node, 0, len(names))
+	lets := &letShifter{}
+	line := 0
+	for _, name := range names {
+		tree, err := parser.ParseWith(inputs[name], infixOperators(config))
+		if err != nil {
+			return nil, keyError(name, err)
+		}
+		if len(config.Visitors) == 0 {
+			if _, err := checker.Check(tree, config); err != nil {
+				return nil, keyError(name, err)
+			}
+		}
+
+		ast.Walk(&tree.Node, &lineShifter{lines: line})
+		lets.offset = lets.next
+		ast.Walk(&tree.Node, lets)
+		key := &ast.StringNode{Value: name}
+		key.SetLocation(tree.Node.Location())
+		pair := &ast.PairNode{Key: key, Value: tree.Node}
+		pair.SetLocation(tree.Node.Location())
+		pairs = append(pairs, pair)
+
+		contents = append(contents, inputs[name])
+		line += strings.Count(inputs[name], "\n") + 1
+	}
+
+	node := &ast.MapNode{Pairs: pairs}
+	tree := &parser.Tree{
+		Node:   node,
+		Source: file.NewSource(strings.Join(contents, "\n")),
+	}
+	program, _, err := compile(tree, config)
+	return program, err
+}
+
+// keyError prefixes the error of an expression of CompileMap with its name.
+// A *file.Error stays one, with its location and snippet.
+func keyError(name string, err error) error {
+	if e, ok := err.(*file.Error); ok {
+		prefixed := *e
+		prefixed.Message = fmt.Sprintf("%v: %v", name, e.Message)
+		return &prefixed
+	}
+	return fmt.Errorf("%v: %v", name, err)
+}
+
+type lineShifter struct {
+	lines int
+}
+
+func (*lineShifter) Enter(*ast.Node) {}
+func (s *lineShifter) Exit(node *ast.Node) {
+	loc := (*node).Location()
+	loc.Line += s.lines
+	(*node).SetLocation(loc)
+}
+
+// letShifter renumbers the let bindings of an expression of CompileMap by
+// offset, so they stay unique in the combined tree. Next is the first index
+// not used yet.
+type letShifter struct {
+	offset int
+	next   int
+}
+
+func (*letShifter) Enter(*ast.Node) {}
+func (s *letShifter) Exit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.LetNode:
+		n.Index += s.offset
+		if n.Index >= s.next {
+			s.next = n.Index + 1
+		}
+	case *ast.VariableNode:
+		n.Index += s.offset
+	}
+}
+
+func compile(tree *parser.Tree, config *conf.Config) (*vm.Program, []file.Warning, error) {
+	_, warnings, err := checker.CheckWithWarnings(tree, config)
 
 	// If we have a patch to apply, it may fix out error and
 	// second type check is needed. Otherwise it is an error.
 	if err != nil && len(config.Visitors) == 0 {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Patch operators before Optimize, as we may also mark it as ConstExpr.
@@ -157,9 +514,9 @@ func Compile(input string, ops ...Option) (*vm.Program, error) {
 		for _, v := range config.Visitors {
 			ast.Walk(&tree.Node, v)
 		}
-		_, err = checker.Check(tree, config)
+		_, warnings, err = checker.CheckWithWarnings(tree, config)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
@@ -167,21 +524,111 @@ func Compile(input string, ops ...Option) (*vm.Program, error) {
 		err = optimizer.Optimize(&tree.Node, config)
 		if err != nil {
 			if fileError, ok := err.(*file.Error); ok {
-				return nil, fileError.Bind(tree.Source)
+				return nil, nil, fileError.Bind(tree.Source)
 			}
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	program, err := compiler.Compile(tree, config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return program, nil
+	return program, warnings, nil
 }
 
 // Run evaluates given bytecode program.
 func Run(program *vm.Program, env interface{}) (interface{}, error) {
 	return vm.Run(program, env)
 }
+
+// RunAs evaluates given bytecode program and stores the result in the value
+// pointed to by out. Numeric results are converted to the numeric type of out,
+// so an int result may be read into a float64. A conversion which would
+// truncate or overflow, such as 2.5 or 300 into an int8, and any other
+// mismatch are errors.
+func RunAs(program *vm.Program, env interface{}, out interface{}) error {
+	ptr := reflect.ValueOf(out)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("misused expr.RunAs: out should be a non-nil pointer (got %T)", out)
+	}
+
+	output, err := vm.Run(program, env)
+	if err != nil {
+		return err
+	}
+
+	target := ptr.Elem()
+	if output == nil {
+		switch target.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			target.Set(reflect.Zero(target.Type()))
+			return nil
+		}
+		return fmt.Errorf("cannot use nil as %v", target.Type())
+	}
+
+	value := reflect.ValueOf(output)
+	switch {
+	case value.Type().AssignableTo(target.Type()):
+		target.Set(value)
+	case isNumber(value.Kind()) && isNumber(target.Kind()):
+		if !convertible(value, target.Type()) {
+			return fmt.Errorf("cannot convert %v (%T) to %v without loss", output, output, target.Type())
+		}
+		target.Set(value.Convert(target.Type()))
+	default:
+		return fmt.Errorf("cannot use %T as %v", output, target.Type())
+	}
+	return nil
+}
+
+// convertible reports whether the number converts to the numeric type t
+// exactly, or for a float target, within its range.
+func convertible(value reflect.Value, t reflect.Type) bool {
+	zero := reflect.Zero(t)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x := value.Int()
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return !zero.OverflowInt(x)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return x >= 0 && !zero.OverflowUint(uint64(x))
+		}
+		return true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x := value.Uint()
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return x <= math.MaxInt64 && !zero.OverflowInt(int64(x))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return !zero.OverflowUint(x)
+		}
+		return true
+	}
+	x := value.Float()
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return math.IsInf(x, 0) || math.IsNaN(x) || !zero.OverflowFloat(x)
+	}
+	if x != math.Trunc(x) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return x >= math.MinInt64 && x < math.MaxInt64 && !zero.OverflowInt(int64(x))
+	}
+	return x >= 0 && x < math.MaxUint64 && !zero.OverflowUint(uint64(x))
+}
+
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
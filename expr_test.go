@@ -2,7 +2,9 @@ package expr_test
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 	"testing"
@@ -10,6 +12,8 @@ import (
 
 	"github.com/ebusto/expr/ast"
 	"github.com/ebusto/expr/file"
+	"github.com/ebusto/expr/internal/difftest"
+	"github.com/ebusto/expr/vm"
 	"github.com/wacul/ptr"
 
 	"github.com/ebusto/expr"
@@ -197,6 +201,55 @@ func ExampleAsInt64() {
 	// Output: 5
 }
 
+func ExampleRunAs() {
+	env := map[string]interface{}{
+		"price": 42,
+	}
+
+	program, err := expr.Compile("price * 2", expr.Env(env))
+	if err != nil {
+		fmt.Printf("%v", err)
+		return
+	}
+
+	var total float64
+	err = expr.RunAs(program, env, &total)
+	if err != nil {
+		fmt.Printf("%v", err)
+		return
+	}
+
+	fmt.Printf("%v", total)
+
+	// Output: 84
+}
+
+func ExampleCompileMap() {
+	env := map[string]interface{}{
+		"price":    40,
+		"quantity": 3,
+	}
+
+	program, err := expr.CompileMap(map[string]string{
+		"total":    "price * quantity",
+		"discount": "price * quantity > 100",
+	}, expr.Env(env))
+	if err != nil {
+		fmt.Printf("%v", err)
+		return
+	}
+
+	output, err := expr.Run(program, env)
+	if err != nil {
+		fmt.Printf("%v", err)
+		return
+	}
+
+	fmt.Printf("%v", output)
+
+	// Output: map[discount:true total:120]
+}
+
 func ExampleOperator() {
 	code := `
 		Now() > CreatedAt &&
@@ -637,10 +690,329 @@ func TestExpr(t *testing.T) {
 			`Two not    in 0..1`,
 			true,
 		},
+		{
+			`"baz" not in {foo: 0, bar: 1} && "Cost" not in Ticket && !("Price" not in Ticket)`,
+			true,
+		},
 		{
 			`Int32 in [10, 20]`,
 			false,
 		},
+		{
+			`Int between 0 and 1 and 1 + 1 between One and Three`,
+			true,
+		},
+		{
+			`"b" between "a" and "c" || Float64 between 0.5 and 1`,
+			true,
+		},
+		{
+			`Two between 3 and 5`,
+			false,
+		},
+		{
+			`let Int = Int + 1; let y = Int * 10; let Int = y + Int; Int`,
+			11,
+		},
+		{
+			`let x = Two * 2; (x + One) * (x + One) - x`,
+			21,
+		},
+		{
+			`map(1..3, {let d = # * 2; d + Two})`,
+			[]interface{}{4, 6, 8},
+		},
+		{
+			`(let x = One; x) + (let x = Two; x)`,
+			3,
+		},
+		{
+			`at(Array, 1, 0) == 2 && at(Array, -1, 0) == 5 && at(Array, 5, 42) == 42 && at(Array, -6, 42) == 42`,
+			true,
+		},
+		{
+			`at({a: 1}, "a", 0) + at({a: 1}, "b", 7) + at(Nil, 0, 10)`,
+			18,
+		},
+		{
+			`[coalesce(Nil, Nil, Two), coalesce(One, Two), coalesce(Nil), coalesce(Nil, "x") + String]`,
+			[]interface{}{2, 1, nil, "xstring"},
+		},
+		{
+			`[ifNull(Nil, Two), ifNull(One, Two)]`,
+			[]interface{}{2, 1},
+		},
+		{
+			`union([1, 2, 2], [3, 1]) == [1, 2, 3] && union(["a"], ["b", "a"]) == ["a", "b"] && union(Nil, []) == []`,
+			true,
+		},
+		{
+			`intersect(Array, [5, 3, 3, 9]) == [3, 5] && intersect([1, 2.5], [1.0, 2.5]) == [1, 2.5]`,
+			true,
+		},
+		{
+			`difference(Array, [2, 4]) == [1, 3, 5] && difference(["a", "a", "b"], ["b"]) == ["a"]`,
+			true,
+		},
+		{
+			`zip(Array, ["a", "b"])`,
+			[]interface{}{[]interface{}{1, "a"}, []interface{}{2, "b"}},
+		},
+		{
+			`map(enumerate(["a", "b"]), {#[1] + String[#[0]:#[0]+1]})`,
+			[]interface{}{"as", "bt"},
+		},
+		{
+			`len(zip(Array, [])) + len(enumerate(Nil))`,
+			0,
+		},
+		{
+			`[reverse(Array), reverse([]), reverse(String), reverse("héllo, 世界"), reverse("")]`,
+			[]interface{}{[]interface{}{5, 4, 3, 2, 1}, []interface{}{}, "gnirts", "界世 ,olléh", ""},
+		},
+		{
+			`let a = [1, 2]; reverse(a)[0] == a[1] && a[0] == 1`,
+			true,
+		},
+		{
+			`[take(Array, 2), take(Array, 0), take(Array, 10), skip(Array, 3), skip(Array, 10), skip(Nil, 1)]`,
+			[]interface{}{[]interface{}{1, 2}, []interface{}{}, []interface{}{1, 2, 3, 4, 5}, []interface{}{4, 5}, []interface{}{}, []interface{}{}},
+		},
+		{
+			`isNaN(0.0 / Int) && !isNaN(One / 2.0) && isInf(1.0 / Int) && isInf(-1.0 / Int) && !isInf(Two)`,
+			true,
+		},
+		{
+			`[finite(1.0 / Int, -1), finite(0.0 / Int, 0), finite(Two), finite(0.5)]`,
+			[]interface{}{-1, 0, 2, 0.5},
+		},
+		{
+			`[min(Three, 1, Two), max(One, 2.5), max(Array), min([4]), min("b", "a", "c"), max(Int)]`,
+			[]interface{}{1, 2.5, 5, 4, "a", 0},
+		},
+		{
+			`[humanizeBytes(0), humanizeBytes(512), humanizeBytes(1536), humanizeBytes(1610612736), humanizeBytes(1500, 1000), humanizeBytes(1048575), humanizeBytes(-2048), humanizeBytes(1e24)]`,
+			[]interface{}{"0 B", "512 B", "1.5 KB", "1.5 GB", "1.5 KB", "1 MB", "-2 KB", "867361.7 EB"},
+		},
+		{
+			`[humanizeNumber(0), humanizeNumber(999), humanizeNumber(12.34), humanizeNumber(1234567), humanizeNumber(-2500), humanizeNumber(999999), humanizeNumber(5e15)]`,
+			[]interface{}{"0", "999", "12.3", "1.2M", "-2.5K", "1M", "5000T"},
+		},
+		{
+			`merge({a: 1, b: 2}, {b: 3}, Nil, {c: String})`,
+			map[string]interface{}{"a": 1, "b": 3, "c": "string"},
+		},
+		{
+			`[pick({a: 1, b: 2, c: 3}, "a", "c", "d"), omit({a: 1, b: 2, c: 3}, "b", "d"), pick(Nil, "a"), omit({a: 1})]`,
+			[]interface{}{
+				map[string]interface{}{"a": 1, "c": 3},
+				map[string]interface{}{"a": 1, "c": 3},
+				map[string]interface{}{},
+				map[string]interface{}{"a": 1},
+			},
+		},
+		{
+			`var("O" + "ne") + var("Two")`,
+			3,
+		},
+		{
+			`[var("Unknown"), var("String")]`,
+			[]interface{}{nil, "string"},
+		},
+		{
+			`[isString(String), isString(One), isNumber(One), isNumber(1.5), isNumber("1")]`,
+			[]interface{}{true, false, true, true, false},
+		},
+		{
+			`[isBool(One > 0), isArray(Array), isArray(nil), isMap({a: 1}), isMap(Array)]`,
+			[]interface{}{true, true, false, true, false},
+		},
+		{
+			`[entries({b: 2, a: 1, c: 3}), entries({}), entries(nil)]`,
+			[]interface{}{
+				[]interface{}{[]interface{}{"a", 1}, []interface{}{"b", 2}, []interface{}{"c", 3}},
+				[]interface{}{},
+				[]interface{}{},
+			},
+		},
+		{
+			`filter(entries({a: 1, b: 2, c: 3}), {#[1] > 1})[0][0]`,
+			"b",
+		},
+		{
+			`require(One > 0, "no one") && try(require(One < 0), false) == false`,
+			true,
+		},
+		{
+			`[onError(Array[10], -1), coalesce(onError(Nil, -1), 0), onError(Array[1], -1)]`,
+			[]interface{}{-1, 0, 2},
+		},
+		{
+			`[try(Array[10], -1), try(Array[0]), try(Array[9]), try(One / Int, 0) + 1]`,
+			[]interface{}{-1, 1, nil, 1},
+		},
+		{
+			`try(map(Array, {Array[# + 1]}), []) == [] && try(map(Array, {# + 1}), []) == [2, 3, 4, 5, 6]`,
+			true,
+		},
+		{
+			`[repeat("-", 3), repeat(One, 0), fill(3, {# * 10}), fill(0, {#}), fill(Two, {Array[#]})]`,
+			[]interface{}{
+				[]interface{}{"-", "-", "-"},
+				[]interface{}{},
+				[]interface{}{0, 10, 20},
+				[]interface{}{},
+				[]interface{}{1, 2},
+			},
+		},
+		{
+			`[median(Array), median([3, 1.5, 2, 10]), percentile(Array, 0), percentile(Array, 95), percentile([Two], 50), percentile([10, 20], 25)]`,
+			[]interface{}{3.0, 2.5, 1.0, 4.8, 2.0, 12.5},
+		},
+		{
+			`[padLeft("42", 5, "0"), padRight("ab", 5, "-="), padLeft("héllo", 6), padRight("long", 2), padLeft("", 0)]`,
+			[]interface{}{"00042", "ab-=-", " héllo", "long", ""},
+		},
+		{
+			`[truncate("Hello, world", 8), truncate("héllo wörld", 7, "…"), truncate("short", 5), truncate("abc", 2, "..."), truncate("abc", 0)]`,
+			[]interface{}{"Hello...", "héllo …", "short", "..", ""},
+		},
+		{
+			`[hash(1) == hash(1.0), hash("a") == hash("a"), hash("a") != hash(["a"]), hash({a: 1, b: 2}) == hash({b: 2, a: 1}), hash([1, 2]) != hash([2, 1]), hash(nil) != hash(0), hash(String) % 1 == 0]`,
+			[]interface{}{true, true, true, true, true, true, true},
+		},
+		{
+			`[base64("user:pass"), base64decode("dXNlcjpwYXNz"), base64(""), hex("héllo"), hexdecode("68c3a96c6c6f"), hexdecode(hex(String)) == String]`,
+			[]interface{}{"dXNlcjpwYXNz", []byte("user:pass"), "", "68c3a96c6c6f", []byte("héllo"), true},
+		},
+		{
+			`[fromJSON('{"user": {"roles": ["admin"]}}').user.roles[0], fromJSON("[1, 2.5]"), fromJSON("null"), toJSON({b: [1, "x"], a: nil}), toJSON(fromJSON('{"a":true}'))]`,
+			[]interface{}{"admin", []interface{}{1.0, 2.5}, nil, `{"a":null,"b":[1,"x"]}`, `{"a":true}`},
+		},
+		{
+			`[formatNumber(1234.5, "#,##0.00"), formatNumber(1234567), formatNumber(-0.001, "0.00"), formatNumber(7, "000"), formatNumber(2, "0.0#"), formatNumber(2.345, "0.0#"), formatNumber(-1234567.891, "#,##,###.#"), formatNumber(0.5, "#")]`,
+			[]interface{}{"1,234.50", "1,234,567", "0.00", "007", "2.0", "2.35", "-1,234,567.9", "0"},
+		},
+		{
+			`[isEmpty(nil), isEmpty(""), isEmpty([]), isEmpty({}), isEmpty(" "), isEmpty(Array), isEmpty(0), isEmpty(false), isEmpty(Nil)]`,
+			[]interface{}{true, true, true, true, false, false, false, false, true},
+		},
+		{
+			`[isBlank(" \t\n"), isBlank(""), isBlank(nil), isBlank(" a "), isBlank([]), isBlank(0)]`,
+			[]interface{}{true, true, true, false, true, false},
+		},
+		{
+			`[versionCompare("1.2.0", "1.10.0"), versionCompare("v1.2", "1.2.0"), versionCompare("1.0.0", "1.0.0-rc.1"), versionCompare("1.0.0-rc.2", "1.0.0-rc.10"), versionCompare("1.0.0-alpha", "1.0.0-1"), versionCompare("1.0.0+build.5", "1.0.0")]`,
+			[]interface{}{-1, 0, 1, -1, 1, 0},
+		},
+		{
+			`[v"1.10" > v"1.9", v"1.2" == v"1.2.0", v"2.0.0-beta" < "2.0.0", "1.0" <= v"1.0.1", v"1.0" in [v"1.0.0"], max(v"1.2", v"1.10").String()]`,
+			[]interface{}{true, true, true, true, true, "1.10"},
+		},
+		{
+			`[v"1.2" == "1.2.0", "1.3" != v"1.2", v"1.2" == 1]`,
+			[]interface{}{true, true, false},
+		},
+		{
+			`[seq(0, 1, 0.25), seq(0, 0.3, 0.1), seq(1, -1, -0.5), seq(0, 1, 0.4), seq(1, 0, 0.5), seq(2, 2, 1), seq(One, Three, 1)]`,
+			[]interface{}{
+				[]interface{}{0.0, 0.25, 0.5, 0.75, 1.0},
+				[]interface{}{0.0, 0.1, 0.2, 0.3},
+				[]interface{}{1.0, 0.5, 0.0, -0.5, -1.0},
+				[]interface{}{0.0, 0.4, 0.8},
+				[]interface{}{},
+				[]interface{}{2.0},
+				[]interface{}{1.0, 2.0, 3.0},
+			},
+		},
+		{
+			`[map({b: 2, c: 3, a: 1}, {# * 10}), filter({y: "yes", x: "", z: "zed"}, {# != ""})]`,
+			[]interface{}{[]interface{}{10, 20, 30}, []interface{}{"yes", "zed"}},
+		},
+		{
+			`[One != Two, One != 1, String != "string", !(String == "x"), Array != nil, !(Nil != nil), !(2 in Array), 9 not in Array, not ("s" not in {s: 1}), 1 != 1.0]`,
+			[]interface{}{true, false, false, true, true, true, false, true, true, false},
+		},
+		{
+			`[bool(nil), bool(Nil), bool(false), bool(0), bool(0.0), bool(0 / 0.0), bool(""), bool([]), bool({}), bool(true), bool(-1), bool(0.5), bool(" "), bool("0"), bool("false"), bool(Array), bool({a: nil}), bool(now())]`,
+			[]interface{}{false, false, false, false, false, false, false, false, false, true, true, true, true, true, true, true, true, true},
+		},
+		{
+			`[intOr("42", 0), intOr(" 7 ", 0), intOr(3.9, 0), intOr("2.5", 0), intOr("abc", -1), intOr(nil, -1), intOr(true, -1), intOr(Two, nil), intOr(1 / 0.0, "inf")]`,
+			[]interface{}{42, 7, 3, 2, -1, -1, -1, 2, "inf"},
+		},
+		{
+			`[floatOr("2.5", 0), floatOr(Two, 0), floatOr("1e3", 0), floatOr("", 0.5), floatOr([1], nil)]`,
+			[]interface{}{2.5, 2.0, 1000.0, 0.5, nil},
+		},
+		{
+			`[chunk(Array, 2), chunk(Array, 5), chunk([], 3)]`,
+			[]interface{}{
+				[]interface{}{[]interface{}{1, 2}, []interface{}{3, 4}, []interface{}{5}},
+				[]interface{}{[]interface{}{1, 2, 3, 4, 5}},
+				[]interface{}{},
+			},
+		},
+		{
+			`contains(String, "tri") && startsWith(String, "str") && endsWith(String, "ing") && !contains(String, "x")`,
+			true,
+		},
+		{
+			`contains(Array, 3) && !contains(Array, 6) && contains(["a", "b"], "b")`,
+			true,
+		},
+		{
+			`[indexOf(String, "r"), lastIndexOf("abcabc", "b"), indexOf(String, "x"), indexOf(Array, 3), lastIndexOf([1, 2, 1], 1), indexOf(Array, 9)]`,
+			[]interface{}{2, 4, -1, 2, 2, -1},
+		},
+		{
+			`String[:indexOf(String, "i")]`,
+			"str",
+		},
+		{
+			`[toArray(Array), toArray(String), toArray(Nil), toArray(One)]`,
+			[]interface{}{[]interface{}{1, 2, 3, 4, 5}, []interface{}{"string"}, []interface{}{}, []interface{}{1}},
+		},
+		{
+			`map(toArray(Two), {# * 2})`,
+			[]interface{}{4},
+		},
+		{
+			`[parseInt("42"), parseInt("-ff", 16), parseInt("0x1f", 0), parseInt(" 7 "), parseFloat("1.5e3")]`,
+			[]interface{}{42, -255, 31, 7, 1500.0},
+		},
+		{
+			`[inRange(Two, 1, 3), inRange(Two, 2, 2), inRange(Two, 2, 3, true), inRange(2.5, One, Three), inRange(Int, 1, 2)]`,
+			[]interface{}{true, true, false, true, false},
+		},
+		{
+			`[fixed(3.14159, 2), fixed(Two, 1), fixed(2.5, 0), fixed(-0.125, 2)]`,
+			[]interface{}{"3.14", "2.0", "2", "-0.12"},
+		},
+		{
+			`[clamp(5, 1, 3), clamp(-1, 0, 3), clamp(Two, 1, 3), clamp(One, 1.5, 3), diff(One, Three), diff(2.5, 1)]`,
+			[]interface{}{3, 0, 2, 1.5, 2, 1.5},
+		},
+		{
+			`sprintf("%d items for %s", Two, String)`,
+			"2 items for string",
+		},
+		{
+			`sprintf("%*d|%[1]v", 3, One)`,
+			"  1|3",
+		},
+		{
+			`[1, 2, 3] == [1, 2, 3] && Array == [1, 2, 3, 4, 5.0] && MultiDimArray == [[1, 2, 3], [1, 2, 3]]`,
+			true,
+		},
+		{
+			`[1, 2] == [1, 2, 3] || [1, 2] == [2, 1] || Array != 1..5`,
+			false,
+		},
+		{
+			`{foo: 1, bar: [1]} == {bar: [1.0], foo: 1} && {foo: 1} != {bar: 1}`,
+			true,
+		},
 		{
 			`String matches "s.+"`,
 			true,
@@ -649,6 +1021,10 @@ func TestExpr(t *testing.T) {
 			`String matches ("^" + String + "$")`,
 			true,
 		},
+		{
+			`matches(String, "^STRING$", "i") && !matches(String, "^STRING$") && matches(String, "^S", String[0:0] + "i")`,
+			true,
+		},
 		{
 			`"foobar" contains "bar"`,
 			true,
@@ -913,6 +1289,10 @@ func TestExpr(t *testing.T) {
 
 		assert.Equal(t, tt.want, got, "eval: "+tt.code)
 	}
+
+	for _, tt := range tests {
+		difftest.Check(t, tt.code, env)
+	}
 }
 
 func TestExpr_eval_with_env(t *testing.T) {
@@ -1288,6 +1668,55 @@ func TestEval_exposed_error(t *testing.T) {
 	require.Equal(t, 1, fileError.Line)
 }
 
+func TestRunAs(t *testing.T) {
+	program, err := expr.Compile(`"hello"`)
+	require.NoError(t, err)
+
+	var s string
+	err = expr.RunAs(program, nil, &s)
+	require.NoError(t, err)
+	require.Equal(t, "hello", s)
+
+	var i int
+	err = expr.RunAs(program, nil, &i)
+	require.EqualError(t, err, "cannot use string as int")
+
+	err = expr.RunAs(program, nil, s)
+	require.EqualError(t, err, "misused expr.RunAs: out should be a non-nil pointer (got string)")
+
+	program, err = expr.Compile(`nil`)
+	require.NoError(t, err)
+
+	var v interface{} = 1
+	err = expr.RunAs(program, nil, &v)
+	require.NoError(t, err)
+	require.Nil(t, v)
+
+	err = expr.RunAs(program, nil, &i)
+	require.EqualError(t, err, "cannot use nil as int")
+
+	run := func(input string, out interface{}) error {
+		program, err := expr.Compile(input)
+		require.NoError(t, err)
+		return expr.RunAs(program, nil, out)
+	}
+	var i8 int8
+	var u uint
+	var f32 float32
+	var f float64
+	require.NoError(t, run(`2.0`, &i))
+	require.Equal(t, 2, i)
+	require.NoError(t, run(`3`, &f))
+	require.Equal(t, 3.0, f)
+	require.NoError(t, run(`-128`, &i8))
+	require.Equal(t, int8(-128), i8)
+	require.EqualError(t, run(`2.5`, &i), "cannot convert 2.5 (float64) to int without loss")
+	require.EqualError(t, run(`300`, &i8), "cannot convert 300 (int) to int8 without loss")
+	require.EqualError(t, run(`-1`, &u), "cannot convert -1 (int) to uint without loss")
+	require.EqualError(t, run(`1e300`, &f32), "cannot convert 1e+300 (float64) to float32 without loss")
+	require.EqualError(t, run(`1e300`, &i), "cannot convert 1e+300 (float64) to int without loss")
+}
+
 func TestIssue105(t *testing.T) {
 	type A struct {
 		Field string
@@ -1383,6 +1812,1625 @@ func TestIssue138(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestExpr_bytes(t *testing.T) {
+	type env struct {
+		Data, Same []byte
+	}
+	e := env{Data: []byte("hello world"), Same: []byte("hello world")}
+
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{`Data == Same`, true},
+		{`Data == "hello world"`, true},
+		{`"hello" != Data`, true},
+		{`"world" in Data`, true},
+		{`Same[0:5] in Data`, true},
+		{`"bye" in Data`, false},
+	}
+
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.code, expr.Env(env{}))
+		require.NoError(t, err, tt.code)
+
+		output, err := expr.Run(program, e)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, output, tt.code)
+	}
+}
+
+type caseInsensitive string
+
+func (c caseInsensitive) Equal(other interface{}) bool {
+	s, ok := other.(string)
+	if o, isID := other.(caseInsensitive); isID {
+		s, ok = string(o), true
+	}
+	return ok && strings.EqualFold(string(c), s)
+}
+
+func TestExpr_equaler(t *testing.T) {
+	env := map[string]interface{}{
+		"ID":  caseInsensitive("ABC"),
+		"IDs": []caseInsensitive{"foo", "BAR"},
+	}
+
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{`ID == "abc"`, true},
+		{`"abc" == ID`, true},
+		{`ID != "abd"`, true},
+		{`"bar" in IDs`, true},
+		{`"baz" in IDs`, false},
+	}
+
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.code, expr.Env(env))
+		require.NoError(t, err, tt.code)
+
+		output, err := expr.Run(program, env)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, output, tt.code)
+	}
+}
+
+type version struct {
+	Major, Minor int
+}
+
+func (v version) Compare(other interface{}) int {
+	o := other.(version)
+	if v.Major != o.Major {
+		return v.Major - o.Major
+	}
+	return v.Minor - o.Minor
+}
+
+func TestExpr_comparer(t *testing.T) {
+	env := map[string]interface{}{
+		"Current": version{1, 2},
+		"Minimum": version{1, 0},
+		"Next":    version{2, 0},
+	}
+
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{`Current > Minimum`, true},
+		{`Current < Minimum`, false},
+		{`Minimum <= Current && Current >= Minimum`, true},
+		{`Current between Minimum and Next`, true},
+		{`Next between Minimum and Current`, false},
+	}
+
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.code, expr.Env(env))
+		require.NoError(t, err, tt.code)
+
+		output, err := expr.Run(program, env)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, output, tt.code)
+	}
+}
+
+func TestExpr_time_builtins(t *testing.T) {
+	tests := []struct {
+		code string
+		want interface{}
+	}{
+		{`format(date("2024-01-02"), "Jan 2, 2006")`, "Jan 2, 2024"},
+		{`format(date("2024-01-02 15:04:05"), time.RFC3339)`, "2024-01-02T15:04:05Z"},
+		{`format(date("02.01.2024", "02.01.2006"), "2006-01-02")`, "2024-01-02"},
+		{`date("2024-01-02T15:04:05+02:00").Hour()`, 15},
+		{`date("2024-01-02").Before(now())`, true},
+		{`duration("1h30m").Minutes()`, 90.0},
+	}
+
+	env := map[string]interface{}{
+		"time": map[string]string{"RFC3339": time.RFC3339},
+	}
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.code, expr.Env(env))
+		require.NoError(t, err, tt.code)
+
+		output, err := expr.Run(program, env)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, output, tt.code)
+	}
+
+	_, err := expr.Eval(`date("01/02/2024")`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `cannot parse "01/02/2024" as date`)
+
+	_, err = expr.Eval(`duration("1 hour")`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `cannot parse "1 hour" as duration`)
+
+	// Functions in env take precedence over builtins.
+	env = map[string]interface{}{"now": func() string { return "soon" }}
+	program, err := expr.Compile(`now()`, expr.Env(env))
+	require.NoError(t, err)
+
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, "soon", output)
+}
+
+func TestExpr_duration(t *testing.T) {
+	created := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	env := map[string]interface{}{
+		"Created": created,
+		"Checked": created.Add(45 * time.Minute),
+		"Age":     20 * time.Minute,
+	}
+
+	tests := []struct {
+		code string
+		want interface{}
+	}{
+		{`Age < duration("30m")`, true},
+		{`Age + duration("10m") >= duration("30m")`, true},
+		{`Age * 3`, time.Hour},
+		{`1.5 * Age`, 30 * time.Minute},
+		{`Age / 2`, 10 * time.Minute},
+		{`duration("1h") / Age`, 3.0},
+		{`Checked - Created`, 45 * time.Minute},
+		{`Checked - Created > Age`, true},
+		{`Created + Age < Checked && Checked - Age > Created`, true},
+		{`Created + duration("45m") == Checked`, true},
+		{`Checked between Created and Created + duration("1h")`, true},
+		{`format(Checked - duration("24h"), "2006-01-02 15:04")`, "2024-01-01 10:45"},
+	}
+
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.code, expr.Env(env))
+		require.NoError(t, err, tt.code)
+
+		output, err := expr.Run(program, env)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, output, tt.code)
+	}
+
+	_, err := expr.Compile(`Age + 1`, expr.Env(env))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid operation: + (mismatched types time.Duration and int)")
+}
+
+func TestMaxPatternLength(t *testing.T) {
+	_, err := expr.Compile(`"abc" matches "^abcd"`, expr.MaxPatternLength(3))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "regexp of 5 bytes exceeds the limit of 3")
+
+	program, err := expr.Compile(`s matches "^a"`, expr.MaxMatchLength(3))
+	require.NoError(t, err)
+	_, err = expr.Run(program, map[string]interface{}{"s": "abcd"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "string of 4 bytes exceeds the limit of 3 for matches")
+}
+
+func TestCompileMap_let(t *testing.T) {
+	program, err := expr.CompileMap(map[string]string{
+		"A": "let x = 1; x * 2 + x * 2",
+		"B": "let x = 10; x * 2 + x * 2",
+		"C": "let y = 3; let x = y + 1; x * y",
+	})
+	require.NoError(t, err)
+
+	output, err := expr.Run(program, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"A": 4, "B": 40, "C": 12}, output)
+}
+
+func TestCompileMap_errors(t *testing.T) {
+	_, err := expr.CompileMap(map[string]string{"ok": "1", "bad": "1 +"})
+	require.Error(t, err)
+	require.Equal(t, "bad: unexpected token EOF (1:3)\n | 1 +\n | ..^", err.Error())
+	fileErr, ok := err.(*file.Error)
+	require.True(t, ok, "%T", err)
+	require.Equal(t, file.Location{Line: 1, Column: 2}, fileErr.Location)
+
+	_, err = expr.CompileMap(map[string]string{"bad": `"a" + 1`})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bad: invalid operation: + (mismatched types string and int)")
+	fileErr, ok = err.(*file.Error)
+	require.True(t, ok, "%T", err)
+	require.Equal(t, "bad: invalid operation: + (mismatched types string and int)", fileErr.Message)
+	require.Equal(t, " | \"a\" + 1\n | ....^", strings.TrimPrefix(fileErr.Snippet, "\n"))
+
+	_, err = expr.CompileMap(map[string]string{"a": "true"}, expr.AsBool())
+	require.Error(t, err)
+
+	program, err := expr.CompileMap(map[string]string{
+		"a": "1",
+		"b": "foo\n.bar",
+	})
+	require.NoError(t, err)
+
+	_, err = expr.Run(program, map[string]interface{}{"foo": 1})
+	require.Error(t, err)
+	require.Equal(t, "cannot fetch bar from int at foo.bar (3:2)\n | .bar\n | .^", err.Error())
+}
+
+func TestPure(t *testing.T) {
+	calls := 0
+	env := map[string]interface{}{
+		"x": 5,
+		"expensive": func(x int) int {
+			calls++
+			return x * 2
+		},
+	}
+
+	code := `expensive(x) > 0 && expensive(x) < 20 && (expensive(x) == 10 ? expensive(x) : 0) == 10`
+
+	program, err := expr.Compile(code, expr.Env(env), expr.Pure("expensive"))
+	require.NoError(t, err)
+
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	program, err = expr.Compile(code, expr.Env(env))
+	require.NoError(t, err)
+
+	output, err = expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+	require.Equal(t, 4, calls)
+}
+
+type rootEnv struct {
+	Name  string
+	Items []int
+	Inner struct{ Value int }
+}
+
+func (r *rootEnv) Double(x int) int { return x * 2 }
+func (r rootEnv) Greeting() string  { return "hi " + r.Name }
+
+func TestEval_struct_root(t *testing.T) {
+	env := &rootEnv{Name: "root", Items: []int{1, 2}}
+	env.Inner.Value = 3
+
+	code := `Name == "root" && len(Items) == 2 && Double(Inner.Value) == 6 && Greeting() == "hi root"`
+
+	output, err := expr.Eval(code, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+
+	program, err := expr.Compile(code, expr.Env(env))
+	require.NoError(t, err)
+
+	output, err = expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+
+	output, err = expr.Eval(`Greeting() + "!"`, *env)
+	require.NoError(t, err)
+	require.Equal(t, "hi root!", output)
+}
+
+func TestBuiltinsFirst(t *testing.T) {
+	env := map[string]interface{}{
+		"now": func() string { return "soon" },
+	}
+
+	program, err := expr.Compile(`now()`, expr.Env(env), expr.BuiltinsFirst())
+	require.NoError(t, err)
+
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	require.IsType(t, time.Time{}, output)
+}
+
+func TestDisallowShadowing(t *testing.T) {
+	env := map[string]interface{}{
+		"now": func() string { return "soon" },
+		"x":   1,
+	}
+
+	tests := []struct{ code, err string }{
+		{`now()`, "func now of env shadows builtin (1:1)"},
+		{`let x = 2; x`, "let x shadows variable of env (1:1)"},
+		{`let y = 2; let y = 3; y`, "let y shadows outer let (1:12)"},
+	}
+	for _, tt := range tests {
+		_, err := expr.Compile(tt.code, expr.Env(env), expr.DisallowShadowing())
+		require.Error(t, err, tt.code)
+		require.Contains(t, err.Error(), tt.err, tt.code)
+	}
+
+	_, err := expr.Compile(`(let y = 2; y) + (let y = 3; y) + x`, expr.Env(env), expr.DisallowShadowing())
+	require.NoError(t, err)
+}
+
+func TestExpr_parse_number_error(t *testing.T) {
+	_, err := expr.Eval(`parseInt("1,000")`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `cannot parse "1,000" as int`)
+
+	_, err = expr.Eval(`parseInt("12", 2)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `cannot parse "12" as int`)
+
+	_, err = expr.Eval(`parseInt("ff", 99)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid base 99 in parseInt (1:16)")
+
+	_, err = expr.Eval(`parseInt("ff", Base)`, map[string]interface{}{"Base": 1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid base 1 in parseInt")
+
+	_, err = expr.Eval(`parseFloat("1.5k")`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `cannot parse "1.5k" as float`)
+}
+
+func TestExpr_fixed_error(t *testing.T) {
+	_, err := expr.Eval(`fixed(1.5, -1)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "negative precision -1 in fixed")
+
+	_, err = expr.Eval(`fixed("1.5", 1)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot use string as number in fixed")
+}
+
+func TestExpr_clamp_error(t *testing.T) {
+	_, err := expr.Eval(`clamp(1, 3, 2)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "clamp with lower bound 3 greater than upper bound 2")
+}
+
+func TestExpr_union_error(t *testing.T) {
+	_, err := expr.Eval(`union("a", [1])`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot use string as array in union")
+}
+
+func TestExpr_take_error(t *testing.T) {
+	_, err := expr.Eval(`take([1, 2], -1)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "negative count -1 in take")
+
+	_, err = expr.Eval(`chunk([1, 2], 0)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "chunk size must be positive")
+}
+
+func TestExpr_finite_error(t *testing.T) {
+	_, err := expr.Eval(`finite(1.0 / 0)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "+Inf is not finite")
+}
+
+func TestExpr_min_max(t *testing.T) {
+	env := map[string]interface{}{
+		"a": version{1, 2},
+		"b": version{1, 10},
+		"c": version{0, 5},
+	}
+	output, err := expr.Eval(`[min(a, b, c), max(a, b, c)]`, env)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{version{0, 5}, version{1, 10}}, output)
+
+	_, err = expr.Compile(`min()`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid number of arguments for min (expected at least 1, got 0)")
+
+	_, err = expr.Eval(`max([])`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max of empty array")
+}
+
+func TestExpr_humanizeBytes_error(t *testing.T) {
+	_, err := expr.Eval(`humanizeBytes(1, 10)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid base 10 in humanizeBytes")
+}
+
+func TestExpr_merge(t *testing.T) {
+	defaults := map[string]int{"retries": 3, "timeout": 10}
+	env := map[string]interface{}{
+		"defaults":  defaults,
+		"overrides": map[string]int{"timeout": 30},
+		"names":     map[int]string{1: "one"},
+	}
+
+	output, err := expr.Eval(`merge(defaults, overrides)`, env)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"retries": 3, "timeout": 30}, output)
+	require.Equal(t, map[string]int{"retries": 3, "timeout": 10}, defaults)
+
+	output, err = expr.Eval(`merge(defaults, {debug: true})`, env)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"retries": 3, "timeout": 10, "debug": true}, output)
+
+	output, err = expr.Eval(`merge(names, defaults)`, env)
+	require.NoError(t, err)
+	require.Equal(t, map[interface{}]interface{}{1: "one", "retries": 3, "timeout": 10}, output)
+
+	_, err = expr.Eval(`merge(defaults, [1])`, env)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot use []interface {} as map in merge")
+}
+
+func TestExpr_pick_omit(t *testing.T) {
+	user := map[string]string{"name": "ford", "password": "secret"}
+	env := map[string]interface{}{"user": user}
+
+	output, err := expr.Eval(`omit(user, "password")`, env)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"name": "ford"}, output)
+
+	output, err = expr.Eval(`pick(user, "name", 42)`, env)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"name": "ford"}, output)
+	require.Len(t, user, 2)
+
+	_, err = expr.Eval(`pick("user", "name")`, env)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot use string as map in pick")
+}
+
+func TestExpr_infix(t *testing.T) {
+	env := map[string]interface{}{"a": 2, "b": 3}
+	options := []expr.Option{
+		expr.Env(env),
+		expr.Infix("~>", 30, func(a, b int) int { return a*10 + b }),
+		expr.InfixRight("^", 70, func(a, b int) int { return int(math.Pow(float64(a), float64(b))) }),
+		expr.Infix("near", 20, func(a, b int) bool { return a-b <= 1 && b-a <= 1 }),
+	}
+
+	program, err := expr.Compile(`[a ~> b * 2, a ~> b ~> 1, 2 ^ b ^ 2, a near b, a near b + 5]`, options...)
+	require.NoError(t, err)
+
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{26, 231, 512, true, false}, output)
+
+	_, err = expr.Compile(`"a" ~> b`, options...)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid operation: ~> (mismatched types string and int)")
+
+	_, err = expr.Compile(`a ~> b`, expr.Infix("~>", 30, func(a int) int { return a }))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "for ~> operator does not have a correct signature")
+}
+
+func TestExpr_undefinedVariables(t *testing.T) {
+	type Env struct{ A int }
+	for _, env := range []interface{}{nil, map[string]interface{}{"A": 1}, Env{1}, &Env{1}} {
+		output, err := expr.Eval(`B`, env)
+		require.NoError(t, err, "%T", env)
+		assert.Nil(t, output, "%T", env)
+
+		program, err := expr.Compile(`B`, expr.DisallowUndefinedVariables())
+		require.NoError(t, err)
+
+		_, err = expr.Run(program, env)
+		require.Error(t, err, "%T", env)
+		assert.Contains(t, err.Error(), "unknown variable B", "%T", env)
+
+		program, err = expr.Compile(`[A, orDefault(B, 2), B?.C, var("A")]`, expr.DisallowUndefinedVariables())
+		require.NoError(t, err)
+
+		if env != nil {
+			output, err = expr.Run(program, env)
+			require.NoError(t, err, "%T", env)
+			assert.Equal(t, []interface{}{1, 2, nil, 1}, output, "%T", env)
+		}
+	}
+
+	env := map[string]interface{}{"A": 1}
+	program, err := expr.Compile(`A + B`, expr.Env(env), expr.AllowUndefinedVariables(), expr.DisallowUndefinedVariables())
+	require.NoError(t, err)
+
+	_, err = expr.Run(program, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown variable B")
+
+	program, err = expr.Compile(`var("B")`, expr.DisallowUndefinedVariables())
+	require.NoError(t, err)
+
+	_, err = expr.Run(program, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown variable B")
+
+	program, err = expr.Compile(`A == nil`, expr.DisallowUndefinedVariables())
+	require.NoError(t, err)
+
+	output, err := expr.Run(program, lookupEnv{"A": nil})
+	require.NoError(t, err)
+	assert.Equal(t, true, output)
+
+	_, err = expr.Run(program, lookupEnv{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown variable A")
+}
+
+type lookupEnv map[string]interface{}
+
+func (e lookupEnv) Fetch(name interface{}) interface{} {
+	return e[name.(string)]
+}
+
+func (e lookupEnv) Lookup(name interface{}) (interface{}, bool) {
+	value, ok := e[name.(string)]
+	return value, ok
+}
+
+func TestExpr_var(t *testing.T) {
+	env := map[string]interface{}{"name": "rate", "rate": 0.25}
+
+	output, err := expr.Eval(`var(name) * 4`, env)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, output)
+
+	output, err = expr.Eval(`var("missing")`, env)
+	require.NoError(t, err)
+	assert.Nil(t, output)
+
+	_, err = expr.Eval(`var(1)`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use int as string in var")
+
+	_, err = expr.Compile(`var("a", "b")`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid number of arguments for var (expected 1, got 2)")
+}
+
+func TestExpr_apply(t *testing.T) {
+	discount, err := expr.Compile(`price * (1 - rate)`)
+	require.NoError(t, err)
+
+	env := map[string]interface{}{"discount": discount, "price": 200}
+
+	program, err := expr.Compile(`apply(discount, {price: price, rate: 0.25})`, expr.Env(env))
+	require.NoError(t, err)
+
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	assert.Equal(t, 150.0, output)
+
+	loop, err := expr.Compile(`apply(loop, {loop: loop})`)
+	require.NoError(t, err)
+
+	_, err = expr.Run(loop, map[string]interface{}{"loop": loop})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "apply nested deeper than 100 programs")
+
+	shallow, err := expr.Compile(`apply(loop, {loop: loop})`, expr.MaxApplyDepth(3))
+	require.NoError(t, err)
+
+	_, err = expr.Run(shallow, map[string]interface{}{"loop": loop})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "apply nested deeper than 3 programs")
+
+	nested, err := expr.Compile(`map(1..2, {map(1..2, {#})})`)
+	require.NoError(t, err)
+	limited, err := expr.Compile(`apply(nested)`, expr.MaxRecursion(2))
+	require.NoError(t, err)
+
+	_, err = expr.Run(limited, map[string]interface{}{"nested": nested})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "maximum recursion depth exceeded")
+
+	_, err = expr.Eval(`apply(price)`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use int as program in apply")
+
+	_, err = expr.Compile(`apply(price)`, expr.Env(env))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use int as program in apply")
+
+	_, err = expr.Compile(`apply()`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid number of arguments for apply (expected 1 or 2, got 0)")
+}
+
+func TestExpr_divideByZeroInf(t *testing.T) {
+	env := map[string]interface{}{"Zero": 0, "One": 1}
+
+	program, err := expr.Compile(`[1 / Zero, -1 / Zero, Zero / Zero, 1 / 0, 7 / 2, 1.5 / Zero]`, expr.Env(env), expr.DivideByZeroInf())
+	require.NoError(t, err)
+
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	values := output.([]interface{})
+	assert.Equal(t, math.Inf(1), values[0])
+	assert.Equal(t, math.Inf(-1), values[1])
+	assert.True(t, math.IsNaN(values[2].(float64)))
+	assert.Equal(t, math.Inf(1), values[3])
+	assert.Equal(t, 3, values[4])
+	assert.Equal(t, math.Inf(1), values[5])
+
+	program, err = expr.Compile(`[One / Zero == 0, One / Zero != 0, One / One == 1]`, expr.Env(env), expr.DivideByZeroInf())
+	require.NoError(t, err)
+	output, err = expr.Run(program, env)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{false, true, true}, output)
+
+	program, err = expr.Compile(`[1, 2][One / Zero]`, expr.Env(env), expr.DivideByZeroInf())
+	require.NoError(t, err)
+	_, err = expr.Run(program, env)
+	require.Error(t, err)
+
+	_, err = expr.Eval(`1 / Zero`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "integer divide by zero")
+
+	_, err = expr.Compile(`1 / 0`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "integer divide by zero")
+}
+
+func TestExpr_require(t *testing.T) {
+	env := map[string]interface{}{"Age": 21, "Country": "FR"}
+
+	output, err := expr.Eval(`require(Age >= 18, "too young") && require(Country != "")`, env)
+	require.NoError(t, err)
+	assert.Equal(t, true, output)
+
+	_, err = expr.Eval(`require(Age >= 18) && require(Country == "US", "not available in " + Country)`, env)
+	require.Error(t, err)
+	assert.Equal(t, "not available in FR (1:23)\n | require(Age >= 18) && require(Country == \"US\", \"not available in \" + Country)\n | ......................^", err.Error())
+
+	_, err = expr.Eval(`require(Age < 18)`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "requirement failed")
+
+	output, err = expr.Eval(`require(Country, "no country") && require([Age], "no age")`, env)
+	require.NoError(t, err)
+	assert.Equal(t, true, output)
+
+	for _, input := range []string{`require("", "empty")`, `require(Age - 21, "empty")`, `require(nil, "empty")`} {
+		_, err = expr.Eval(input, env)
+		require.Error(t, err, input)
+		assert.Contains(t, err.Error(), "empty", input)
+	}
+}
+
+func TestExpr_try_error(t *testing.T) {
+	env := map[string]interface{}{"Array": []int{1, 2, 3}}
+
+	_, err := expr.Eval(`try(Array[10], Array[11])`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "index out of range")
+
+	_, err = expr.Compile(`onError(Array[10])`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid number of arguments for onError (expected 2, got 1)")
+
+	_, err = expr.Compile(`try()`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid number of arguments for try (expected 1 or 2, got 0)")
+
+	env["Bug"] = func() int {
+		var p *int
+		return *p
+	}
+	for _, input := range []string{`try(len(1..2000000), 0)`, `try(Bug(), 0)`} {
+		program, err := expr.Compile(input, expr.Env(env))
+		require.NoError(t, err, input)
+
+		_, err = expr.Run(program, env)
+		require.Error(t, err, input)
+	}
+
+	output, err := expr.Eval(`try(1 % (len(Array) - 3), -1)`, env)
+	require.NoError(t, err)
+	assert.Equal(t, -1, output)
+}
+
+func TestExpr_fill_error(t *testing.T) {
+	_, err := expr.Eval(`fill(N, {#})`, map[string]interface{}{"N": -1})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "negative count -1 in fill")
+
+	_, err = expr.Eval(`repeat(0, -2)`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "negative count -2 in repeat")
+
+	_, err = expr.Compile(`fill("3", {#})`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "builtin fill takes an integer count (got string)")
+}
+
+func TestExpr_constants(t *testing.T) {
+	env := map[string]interface{}{"X": 1, "S": "a"}
+
+	program, err := expr.Compile(`X in [1, 2] && S in ["a"] && (X in [1, 2] || S in ["a"]) && X != 1.0 && S + "b" != "a"`, expr.Env(env))
+	require.NoError(t, err)
+
+	assert.Equal(t, []interface{}{
+		"X",
+		map[int]struct{}{1: {}, 2: {}},
+		"S",
+		map[string]struct{}{"a": {}},
+		1.0,
+		"b",
+		"a",
+	}, program.Constants)
+}
+
+func TestExpr_percentile_error(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`median([])`, "median of empty array"},
+		{`percentile([1, "2"], 50)`, "cannot use string as number in percentile"},
+		{`percentile([1, 2], 101)`, "percentile 101 out of range [0, 100]"},
+		{`median("1")`, "cannot use string as array in median"},
+	}
+	for _, tt := range tests {
+		_, err := expr.Eval(tt.input, nil)
+		require.Error(t, err, tt.input)
+		assert.Contains(t, err.Error(), tt.err, tt.input)
+	}
+}
+
+func TestExpr_pad_error(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`padLeft("a", 3, "")`, "empty padding in padLeft"},
+		{`padRight(1, 3)`, "cannot use int as string in padRight"},
+		{`truncate("abc", -1)`, "negative count -1 in truncate"},
+	}
+	for _, tt := range tests {
+		_, err := expr.Eval(tt.input, nil)
+		require.Error(t, err, tt.input)
+		assert.Contains(t, err.Error(), tt.err, tt.input)
+	}
+}
+
+type chainEnv struct {
+	M map[string]func() string
+}
+
+func (chainEnv) B() map[string][]int {
+	return map[string][]int{"c": {1, 2, 3}}
+}
+
+func TestExpr_chaining(t *testing.T) {
+	env := map[string]interface{}{
+		"a": chainEnv{},
+		"f": func() []int { return []int{42} },
+		"m": map[string]interface{}{
+			"k": func() string { return "called" },
+		},
+		"mk": func() func(int) int {
+			return func(x int) int { return x * 2 }
+		},
+		"env": chainEnv{M: map[string]func() string{"k": func() string { return "typed" }}},
+		"getItems": func() []struct{ Name string } {
+			return []struct{ Name string }{{"first"}}
+		},
+	}
+
+	tests := []struct {
+		code string
+		want interface{}
+	}{
+		{`f()[0]`, 42},
+		{`a.B().c[1]`, 2},
+		{`m["k"]()`, "called"},
+		{`m.k()`, "called"},
+		{`env.M["k"]()`, "typed"},
+		{`mk()(21)`, 42},
+		{`getItems()[0].Name`, "first"},
+	}
+
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.code, expr.Env(env))
+		require.NoError(t, err, tt.code)
+
+		got, err := expr.Run(program, env)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, got, tt.code)
+	}
+
+	_, err := expr.Compile(`f()[0]()`, expr.Env(env))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot call non-function (type int)")
+
+	_, err = expr.Compile(`mk()("x")`, expr.Env(env))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use string as argument (type int) to call func")
+
+	_, err = expr.Eval(`m["v"]()`, map[string]interface{}{"m": map[string]interface{}{"v": 1}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot call int")
+}
+
+func TestExpr_fusedComparison(t *testing.T) {
+	program, err := expr.Compile(`!(One == Two) && String != "x" && !(One in Array) && Nil != nil`, expr.Env(&mockEnv{}))
+	require.NoError(t, err)
+
+	code := program.Disassemble()
+	assert.Contains(t, code, "OpNotEqualInt")
+	assert.Contains(t, code, "OpNotEqualString")
+	assert.Contains(t, code, "OpNotIn")
+	assert.Contains(t, code, "OpNotEqual\n")
+	assert.NotContains(t, code, "OpNot\n")
+}
+
+func TestExpr_mapIteration(t *testing.T) {
+	env := map[string]interface{}{
+		"prices": map[string]int{"c": 3, "a": 1, "b": 2, "d": 4},
+		"ids":    map[int]string{10: "ten", 2: "two", -1: "minus one"},
+		"mixed":  map[interface{}]interface{}{"b": "b", 1: 1, true: true, "1": "1"},
+		"empty":  map[string]int{},
+	}
+
+	tests := []struct {
+		code string
+		want interface{}
+	}{
+		{`map(prices, {# * 10})`, []interface{}{10, 20, 30, 40}},
+		{`filter(prices, {# % 2 == 0})`, []interface{}{2, 4}},
+		{`count(prices, {# > 1})`, 3},
+		{`[all(prices, {# > 0}), any(prices, {# > 3}), none(prices, {# > 4}), one(prices, {# == 2})]`, []interface{}{true, true, true, true}},
+		{`map(ids, {#})`, []interface{}{"minus one", "two", "ten"}},
+		{`map(mixed, {#})`, []interface{}{1, "1", "b", true}},
+		{`map(empty, {#})`, []interface{}{}},
+		{`map(entries(mixed), {#[0]})`, []interface{}{1, "1", "b", true}},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ {
+			got, err := expr.Eval(tt.code, env)
+			require.NoError(t, err, tt.code)
+			assert.Equal(t, tt.want, got, tt.code)
+		}
+	}
+}
+
+func TestExpr_multipleResults(t *testing.T) {
+	env := map[string]interface{}{"Price": 10, "Quantity": 3}
+
+	program, err := expr.Compile(`Price * Quantity, Price > 5, "total"`, expr.Env(env), expr.MultipleResults())
+	require.NoError(t, err)
+
+	out, err := expr.Run(program, env)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{30, true, "total"}, out)
+
+	_, err = expr.Eval(`[1, 2], {a: 1}`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "multiple results are not allowed")
+
+	_, err = expr.Compile(`Price, Quantity`, expr.Env(env), expr.MultipleResults(), expr.AsInt64())
+	require.Error(t, err)
+}
+
+func TestExpr_hash(t *testing.T) {
+	env := map[string]interface{}{
+		"Ints":   []int{1, 2},
+		"Floats": []float64{1, 2},
+		"Map":    map[string]int{"a": 1},
+		"Fn":     func() {},
+	}
+
+	out, err := expr.Eval(`hash(Ints) == hash(Floats) && hash(Map) == hash({a: 1})`, env)
+	require.NoError(t, err)
+	assert.Equal(t, true, out)
+
+	// The hash of a value does not change between versions.
+	out, err = expr.Eval(`hash("a")`, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x21721e784351041c), out)
+
+	_, err = expr.Eval(`hash(Fn)`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot hash func()")
+}
+
+func TestExpr_base64(t *testing.T) {
+	env := map[string]interface{}{"Bytes": []byte{0, 255}}
+
+	out, err := expr.Eval(`[base64(Bytes), hex(Bytes)]`, env)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"AP8=", "00ff"}, out)
+
+	out, err = expr.Eval(`[base64decode("AP8="), hexdecode("00ff"), base64decode("dXNlcjpwYXNz") == "user:pass"]`, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{[]byte{0, 255}, []byte{0, 255}, true}, out)
+
+	_, err = expr.Eval(`base64decode("c2VjcmV0!")`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot decode input of length 9 in base64decode: invalid data at offset 8")
+
+	_, err = expr.Eval(`hexdecode("7365zz")`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot decode input of length 6 in hexdecode: invalid data at offset 4")
+
+	_, err = expr.Eval(`hexdecode("736")`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot decode input of length 3 in hexdecode: unexpected end of input")
+
+	_, err = expr.Eval(`base64(42)`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use int as bytes in base64")
+}
+
+func TestExpr_fromJSONNumber(t *testing.T) {
+	env := map[string]interface{}{
+		"Payload": `{"id": 9007199254740993, "price": 2.5, "tags": [1, 2]}`,
+		"Number":  json.Number("3"),
+	}
+
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{`fromJSONNumber(Payload).id`, json.Number("9007199254740993")},
+		{`fromJSONNumber(Payload).id == 9007199254740993`, true},
+		{`fromJSONNumber(Payload).id + 1`, int64(9007199254740994)},
+		{`fromJSONNumber(Payload).price * 2`, 5.0},
+		{`fromJSONNumber(Payload).price > 2`, true},
+		{`fromJSON(Payload).id`, 9007199254740992.0},
+		{`Number % 2`, int64(1)},
+		{`min(fromJSONNumber(Payload).tags)`, json.Number("1")},
+		{`percentile(fromJSONNumber(Payload).tags, 50)`, 1.5},
+		{`hash(Number) == hash(3)`, true},
+		{`toJSON(fromJSONNumber(Payload).id)`, "9007199254740993"},
+	}
+	for _, tt := range tests {
+		out, err := expr.Eval(tt.input, env)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.want, out, tt.input)
+	}
+
+	_, err := expr.Eval(`fromJSONNumber("1 2")`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot parse JSON in fromJSONNumber")
+}
+
+func TestExpr_numericStrings(t *testing.T) {
+	env := map[string]interface{}{"Count": "3", "Price": "2.5", "Number": json.Number("-4")}
+
+	out, err := expr.Eval(`-Number`, env)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), out)
+
+	_, err = expr.Eval(`Count * 2`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid operation: string * int")
+
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{`Count * 2`, int64(6)},
+		{`Price * 2`, 5.0},
+		{`-Count`, int64(-3)},
+		{`Count > 2 && Count == 3`, true},
+		{`Count + "1"`, "31"},
+		{`clamp(Count, 0, 2)`, 2},
+		{`Number + Count`, int64(-1)},
+	}
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.input, expr.NumericStrings())
+		require.NoError(t, err, tt.input)
+
+		out, err := expr.Run(program, env)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.want, out, tt.input)
+	}
+
+	_, err = expr.Compile(`clamp("3", 0, 2)`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use string as number in clamp")
+
+	program, err := expr.Compile(`clamp("3", 0, 2)`, expr.NumericStrings())
+	require.NoError(t, err)
+
+	out, err = expr.Run(program, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, out)
+
+	program, err = expr.Compile(`Name * 2`, expr.NumericStrings())
+	require.NoError(t, err)
+
+	_, err = expr.Run(program, map[string]interface{}{"Name": "abc"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid operation: string * int")
+}
+
+func TestExpr_tag(t *testing.T) {
+	type User struct {
+		Name  string `json:"name" db:"user_name"`
+		Email string `json:"email,omitempty"`
+		Age   int
+	}
+	env := map[string]interface{}{"User": &User{}, "Value": User{}}
+
+	out, err := expr.Eval(`[tag(User, "Name", "db"), tag(Value, "Email", "json"), tag(User, "Email", "db"), tag(User, "Age", "json")]`, env)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"user_name", "email,omitempty", "", ""}, out)
+
+	_, err = expr.Eval(`tag(User, "Phone", "json")`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expr_test.User has no field Phone")
+
+	_, err = expr.Eval(`tag("User", "Name", "json")`, env)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use string as struct in tag")
+}
+
+func TestExpr_size(t *testing.T) {
+	ch := make(chan int, 3)
+	ch <- 1
+	ch <- 2
+	env := map[string]interface{}{
+		"Nil":   nil,
+		"Slice": []int(nil),
+		"Map":   map[string]int{"a": 1},
+		"Ptr":   (*int)(nil),
+		"Chan":  ch,
+	}
+
+	out, err := expr.Eval(`[size(Nil), size(Slice), size(Map), size(Ptr), size(Chan), size("héllo"), size([1, 2, 3])]`, env)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{0, 0, 1, 0, 2, 6, 3}, out)
+
+	_, err = expr.Eval(`size(42)`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid argument for size (type int)")
+}
+
+func TestExpr_toMap(t *testing.T) {
+	env := map[string]interface{}{
+		"Scores": map[string]int{"a": 1, "b": 2},
+		"Names":  []string{"x", "y", "x"},
+	}
+
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{`toMap(entries(Scores))`, map[string]interface{}{"a": 1, "b": 2}},
+		{`fromPairs(zip(Names, [1, 2, 3]))`, map[string]interface{}{"x": 3, "y": 2}},
+		{`toMap([[1, "one"], ["2", "two"]])`, map[interface{}]interface{}{1: "one", "2": "two"}},
+		{`toMap([]).a`, nil},
+		{`toMap([["a", [1]]]).a[0]`, 1},
+	}
+	for _, tt := range tests {
+		out, err := expr.Eval(tt.input, env)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.want, out, tt.input)
+	}
+
+	_, err := expr.Eval(`toMap([["a", 1, 2]])`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use [a 1 2] as [key, value] pair in toMap")
+
+	_, err = expr.Eval(`fromPairs([[[1], 2]])`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use []interface {} as key in fromPairs")
+}
+
+func TestExpr_formatNumber_error(t *testing.T) {
+	tests := []struct {
+		pattern string
+		err     string
+	}{
+		{`"#,##0.00 $"`, `invalid pattern "#,##0.00 $" in formatNumber: unknown character ' ' at 8`},
+		{`"0#"`, `invalid pattern "0#" in formatNumber: # after 0`},
+		{`".00"`, `invalid pattern ".00" in formatNumber: no integer digits`},
+		{`"#,"`, `invalid pattern "#," in formatNumber: , at the end of the integer part`},
+		{`"0.#0"`, `invalid pattern "0.#0" in formatNumber: 0 after # in the fraction`},
+	}
+	for _, tt := range tests {
+		_, err := expr.Compile(`formatNumber(1, ` + tt.pattern + `)`)
+		require.Error(t, err, tt.pattern)
+		assert.Contains(t, err.Error(), tt.err)
+	}
+
+	_, err := expr.Eval(`formatNumber(1, Pattern)`, map[string]interface{}{"Pattern": "x"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid pattern "x" in formatNumber: unknown character 'x' at 0`)
+}
+
+func TestExpr_version_error(t *testing.T) {
+	_, err := expr.Compile(`App.Version > v"1.x"`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid version "1.x" (1:15)`)
+
+	_, err = expr.Eval(`Version > v"1.0"`, map[string]interface{}{"Version": "latest"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid version "latest"`)
+
+	_, err = expr.Eval(`versionCompare("1.0", 2)`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use int as version in versionCompare")
+}
+
+func TestExpr_seq_error(t *testing.T) {
+	_, err := expr.Eval(`seq(0, 1, Step)`, map[string]interface{}{"Step": 0})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid step 0 in seq")
+
+	_, err = expr.Eval(`seq(0, 1e9, 1)`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "memory budget exceeded")
+
+	_, err = expr.Compile(`seq(0, "1", 0.5)`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot use string as number in seq")
+}
+
+func TestExpr_fromJSON_error(t *testing.T) {
+	_, err := expr.Eval(`fromJSON("{")`, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot parse JSON in fromJSON: unexpected end of JSON input")
+
+	_, err = expr.Eval(`toJSON(Fn)`, map[string]interface{}{"Fn": func() {}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot serialize func() in toJSON")
+}
+
+func TestExpr_inRange_error(t *testing.T) {
+	_, err := expr.Eval(`inRange("2", 1, 3)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot use string as number in inRange")
+}
+
+func TestExpr_coalesce_lazy(t *testing.T) {
+	calls := 0
+	env := map[string]interface{}{
+		"user":  map[string]interface{}{"nick": nil, "name": "alice"},
+		"fetch": func() string { calls++; return "fetched" },
+	}
+
+	output, err := expr.Eval(`coalesce(user.nick, user.name, fetch())`, env)
+	require.NoError(t, err)
+	require.Equal(t, "alice", output)
+	require.Equal(t, 0, calls)
+
+	output, err = expr.Eval(`coalesce(user.nick, user.email, fetch())`, env)
+	require.NoError(t, err)
+	require.Equal(t, "fetched", output)
+	require.Equal(t, 1, calls)
+
+	output, err = expr.Eval(`ifNull(user.name, fetch())`, env)
+	require.NoError(t, err)
+	require.Equal(t, "alice", output)
+	require.Equal(t, 1, calls)
+}
+
+func TestExpr_string_builtins_error(t *testing.T) {
+	_, err := expr.Eval(`startsWith(1, "a")`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot use int as string in startsWith")
+
+	_, err = expr.Eval(`contains("abc", 1)`, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot use int as string in contains")
+}
+
+func TestExpr_orDefault(t *testing.T) {
+	type user struct {
+		Name    string
+		Manager *user
+		Tags    []string
+		Reports []*user
+	}
+	env := map[string]interface{}{
+		"user": &user{Name: "alice"},
+		"data": map[string]interface{}{"a": map[string]interface{}{"b": 1}, "list": []interface{}{1}},
+	}
+	tests := []struct {
+		code string
+		want interface{}
+	}{
+		{`orDefault(user.Manager.Name, "none")`, "none"},
+		{`orDefault(user.Name, "none")`, "alice"},
+		{`orDefault(data.a.b, 0) + orDefault(data.x.y.z, 10)`, 11},
+		{`orDefault(missing.b, "none")`, "none"},
+		{`orDefault(user.Tags, ["none"])`, []string{"none"}},
+		{`orDefault(user.Manager, user).Name`, "alice"},
+		{`orDefault(user.Tags[0], "none")`, "none"},
+		{`orDefault(user.Reports[1].Name, "none")`, "none"},
+		{`orDefault(user.Manager.Reports[0].Manager, user).Name`, "alice"},
+		{`orDefault(data.list[3], 0) + orDefault(data.list[0], 0) + orDefault(data.x["y"][0], 10)`, 11},
+	}
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.code, expr.Env(env))
+		require.NoError(t, err, tt.code)
+
+		output, err := expr.Run(program, env)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, output, tt.code)
+	}
+}
+
+type money struct {
+	Cents int
+}
+
+func TestOperatorFunc(t *testing.T) {
+	env := map[string]interface{}{
+		"price": money{Cents: 150},
+		"tax":   money{Cents: 30},
+		"count": 2,
+	}
+	add := func(a, b money) money {
+		return money{Cents: a.Cents + b.Cents}
+	}
+	less := func(a, b money) bool {
+		return a.Cents < b.Cents
+	}
+
+	program, err := expr.Compile(
+		`(price + tax).Cents + count + 1`,
+		expr.Env(env),
+		expr.OperatorFunc("+", add),
+		expr.OperatorFunc("<", less),
+	)
+	require.NoError(t, err)
+	require.Contains(t, program.Disassemble(), "OpCallFunc")
+
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, 183, output)
+
+	program, err = expr.Compile(`tax < price`, expr.Env(env), expr.OperatorFunc("<", less))
+	require.NoError(t, err)
+
+	output, err = expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+
+	_, err = expr.Compile(`price - tax`, expr.Env(env), expr.OperatorFunc("+", add))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid operation: - (mismatched types expr_test.money and expr_test.money)")
+
+	_, err = expr.Compile(`price + tax`, expr.OperatorFunc("+", func(a money) money { return a }))
+	require.EqualError(t, err, "function func(expr_test.money) expr_test.money for + operator does not have a correct signature")
+}
+
+func TestDisallowMethodCalls(t *testing.T) {
+	env := &mockEnv{Ticket: &ticket{Price: 100}}
+
+	program, err := expr.Compile(`Ticket.Price > 10 && Ticket.String() != ""`, expr.Env(env))
+	require.NoError(t, err)
+	_, err = expr.Run(program, env)
+	require.NoError(t, err)
+
+	_, err = expr.Compile(`Ticket.Price > 10 && Ticket.String() != ""`, expr.Env(env), expr.DisallowMethodCalls())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "method calls are not allowed (String)")
+
+	program, err = expr.Compile(`Ticket.Price > 10`, expr.Env(env), expr.DisallowMethodCalls())
+	require.NoError(t, err)
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+
+	funcs := map[string]interface{}{
+		"del":   func() bool { return true },
+		"funcs": map[string]interface{}{"del": func() bool { return true }},
+	}
+	for _, code := range []string{`funcs["del"]()`, `funcs.del()`} {
+		_, err = expr.Compile(code, expr.Env(funcs), expr.DisallowMethodCalls())
+		require.Error(t, err, code)
+		require.Contains(t, err.Error(), "method calls are not allowed (del)", code)
+	}
+
+	for _, code := range []string{`(del)()`, `[del][0]()`} {
+		program, err = expr.Compile(code, expr.Env(funcs), expr.DisallowMethodCalls())
+		require.NoError(t, err, code)
+		output, err = expr.Run(program, funcs)
+		require.NoError(t, err, code)
+		require.Equal(t, true, output, code)
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	env := map[string]interface{}{"scores": map[string]int{"a": 1}}
+
+	zero, err := expr.Compile(`scores.b`, expr.Env(env))
+	require.NoError(t, err)
+	null, err := expr.Compile(`scores.b`, expr.Env(env), expr.MissingKey(vm.MissingKeyNil))
+	require.NoError(t, err)
+	strict, err := expr.Compile(`scores.b`, expr.Env(env), expr.MissingKey(vm.MissingKeyError))
+	require.NoError(t, err)
+
+	output, err := expr.Run(zero, env)
+	require.NoError(t, err)
+	require.Equal(t, 0, output)
+
+	output, err = expr.Run(null, env)
+	require.NoError(t, err)
+	require.Nil(t, output)
+
+	_, err = expr.Run(strict, env)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot fetch b from map[string]int")
+}
+
+func TestDisallowNaNComparison(t *testing.T) {
+	env := map[string]interface{}{"x": math.NaN(), "y": 1.5, "n": 2}
+
+	program, err := expr.Compile(`x < y || x == x`, expr.Env(env))
+	require.NoError(t, err)
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, false, output)
+
+	for _, code := range []string{
+		`x < y`, `y >= x`, `x == x`, `y != x`, `x / n > 0`, `x between 0 and 2`,
+		`min(y, x)`, `max([y, x])`, `clamp(x, 0, 1)`, `inRange(x, 0, 1)`, `median([x, y])`,
+	} {
+		program, err = expr.Compile(code, expr.Env(env), expr.DisallowNaNComparison())
+		require.NoError(t, err)
+		_, err = expr.Run(program, env)
+		require.Error(t, err, code)
+		require.Contains(t, err.Error(), "comparison of", code)
+	}
+
+	program, err = expr.Compile(`y > 1 && n == 2`, expr.Env(env), expr.DisallowNaNComparison())
+	require.NoError(t, err)
+	output, err = expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+}
+
+func TestAllowFunctions(t *testing.T) {
+	env := map[string]interface{}{
+		"name":  "expr",
+		"tags":  []string{"a", "b"},
+		"upper": strings.ToUpper,
+		"save":  func() bool { return true },
+		"funcs": map[string]interface{}{"del": func() bool { return true }},
+		"maker": func() func() bool { return func() bool { return true } },
+	}
+	options := []expr.Option{expr.Env(env), expr.AllowFunctions("upper", "len", "contains")}
+
+	program, err := expr.Compile(`(upper)(name) == "EXPR" && len(tags) == 2 && contains(name, "x") && 1 between 0 and 2`, options...)
+	require.NoError(t, err)
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+
+	for code, message := range map[string]string{
+		`save()`:                         "func save is not allowed",
+		`all(tags, {# != ""})`:           "func all is not allowed",
+		`name matches "^e"`:              "func matches is not allowed",
+		`startsWith(name, "e")`:          "func startsWith is not allowed",
+		`upper(name) + sprintf("%v", 1)`: "func sprintf is not allowed",
+		`(save)()`:                       "func save is not allowed",
+		`funcs["del"]()`:                 "func del is not allowed",
+		`maker()()`:                      "calls of function values are not allowed",
+	} {
+		_, err := expr.Compile(code, options...)
+		require.Error(t, err, code)
+		require.Contains(t, err.Error(), message, code)
+	}
+}
+
+func TestCompileWithWarnings(t *testing.T) {
+	env := map[string]interface{}{
+		"count": 1,
+		"limit": uint(2),
+	}
+	program, warnings, err := expr.CompileWithWarnings("let x = 1;\nlet y = 2;\ny + count < limit", expr.Env(env))
+	require.NoError(t, err)
+	require.NotNil(t, program)
+	require.Len(t, warnings, 2)
+	require.Equal(t, "comparison of signed int and unsigned uint (3:11)", warnings[0].String())
+	require.Equal(t, "let x is unused (1:1)", warnings[1].String())
+
+	_, warnings, err = expr.CompileWithWarnings(`let x = count; x < 2 && limit > 1`, expr.Env(env))
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+
+	_, _, err = expr.CompileWithWarnings(`let x = 1; y`, expr.Env(env))
+	require.Error(t, err)
+}
+
+func TestInt64Literals(t *testing.T) {
+	env := map[string]interface{}{
+		"count": 3,
+		"items": []string{"a", "b", "c"},
+	}
+	tests := []struct {
+		code string
+		want interface{}
+	}{
+		{`1 + 2 * 3`, int64(7)},
+		{`9_000_000_000 / 3`, int64(3_000_000_000)},
+		{`count + 1`, int64(4)},
+		{`count == 3 && count > 2 && count in 1..3`, true},
+		{`items[1] + items[2]`, "bc"},
+		{`len(items) == 3`, true},
+	}
+	for _, tt := range tests {
+		program, err := expr.Compile(tt.code, expr.Env(env), expr.Int64Literals())
+		require.NoError(t, err, tt.code)
+
+		output, err := expr.Run(program, env)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, output, tt.code)
+	}
+}
+
+func TestConstant(t *testing.T) {
+	env := map[string]interface{}{"retries": 3}
+	program, err := expr.Compile(
+		`retries < MaxRetries && Name + "!" == "expr!"`,
+		expr.Env(env),
+		expr.Constant("MaxRetries", 5),
+		expr.Constant("Name", "expr"),
+	)
+	require.NoError(t, err)
+	require.NotContains(t, program.Disassemble(), `"MaxRetries"`)
+
+	output, err := expr.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, output)
+
+	_, err = expr.Compile(`MaxRetries + "a"`, expr.Constant("MaxRetries", 5))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid operation: + (mismatched types int and string)")
+
+	_, err = expr.Compile(`A`, expr.Constant("A", 1), expr.Constant("A", 2))
+	require.EqualError(t, err, "constant A is already defined")
+
+	_, err = expr.Compile(`retries`, expr.Env(env), expr.Constant("retries", 1))
+	require.EqualError(t, err, "constant retries is also defined in environment")
+
+	_, err = expr.Compile(`let A = 2; A`, expr.Constant("A", 1))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "let A redefines constant")
+}
+
+func TestExpr_path(t *testing.T) {
+	type item struct {
+		Name string
+		tags []string
+	}
+	env := map[string]interface{}{
+		"doc": map[string]interface{}{
+			"a": map[string]interface{}{
+				"b": []interface{}{map[string]interface{}{"c": 42}},
+			},
+			"items": []item{{Name: "first"}},
+			"ids":   map[int]string{7: "seven"},
+		},
+		"key": "b",
+	}
+	tests := []struct {
+		code string
+		want interface{}
+	}{
+		{`path(doc, "a.b.0.c")`, 42},
+		{`path(doc, "a." + key + ".0.c")`, 42},
+		{`path(doc, "items.0.Name")`, "first"},
+		{`path(doc, "ids.7")`, "seven"},
+		{`path(doc, "")`, env["doc"]},
+		{`path(doc, "a.b.1.c")`, nil},
+		{`path(doc, "a.x.0")`, nil},
+		{`path(doc, "a.b.c")`, nil},
+		{`path(doc, "items.0.tags")`, nil},
+		{`path(doc, "items.0.Name.x")`, nil},
+		{`"a.b.0.c" in doc && "items.0.Name" in doc && "a" in doc`, true},
+		{`"a.b.1" in doc || "a.x" in doc || "items.0.tags" in doc || "x" in doc`, false},
+		{`"a.b.0.c" in doc ? doc.a.b[0].c : 0`, 42},
+	}
+	for _, tt := range tests {
+		output, err := expr.Eval(tt.code, env)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, tt.want, output, tt.code)
+	}
+}
+
+func TestRun_fetch_path(t *testing.T) {
+	env := map[string]interface{}{
+		"a": map[string]interface{}{"b": 1, "list": []interface{}{nil}},
+	}
+	for code, path := range map[string]string{
+		`a.b.c`:             `a.b.c`,
+		`a["b"].c`:          `a["b"].c`,
+		`a.list[0].c`:       `a.list[0].c`,
+		`a.list[One - 1].c`: ``,
+	} {
+		_, err := expr.Eval(code, env)
+		require.Error(t, err, code)
+
+		var runtimeErr *vm.RuntimeError
+		require.True(t, errors.As(err, &runtimeErr), code)
+		require.Equal(t, path, runtimeErr.Path, code)
+	}
+
+	_, err := expr.Eval(`a.b.c`, env)
+	require.Contains(t, err.Error(), "cannot fetch c from int at a.b.c")
+}
+
+func TestRuleSet(t *testing.T) {
+	type Env struct {
+		Amount  int
+		Country string
+		Tags    []string
+	}
+	rules := expr.NewRuleSet(expr.Env(Env{}))
+	require.NoError(t, rules.AddRule("blocked", `Country in ["XX", "YY"]`))
+	require.NoError(t, rules.AddRule("large", `Amount > 1000`))
+	require.NoError(t, rules.AddRule("tagged", `Tags[0] == "review"`))
+
+	require.NoError(t, rules.AddRule("score", `Amount > 100 ? Amount / 100 : nil`))
+
+	err := rules.AddRule("large", `Amount > 2000`)
+	require.EqualError(t, err, "rule large is already defined")
+	err = rules.AddRule("amount", `Amount +`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "amount: ")
+
+	match, ok, err := rules.Match(Env{Amount: 5000, Country: "XX"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, expr.RuleMatch{Name: "blocked", Value: true}, match)
+
+	// Tags of the env is empty, but the tagged rule is not run.
+	match, ok, err = rules.Match(Env{Amount: 5000, Country: "FR"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, expr.RuleMatch{Name: "large", Value: true}, match)
+
+	match, ok, err = rules.Match(Env{Amount: 500, Country: "FR", Tags: []string{"other"}})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, expr.RuleMatch{Name: "score", Value: 5}, match)
+
+	_, _, err = rules.Match(Env{Amount: 10, Country: "FR"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "tagged: ")
+
+	_, ok, err = rules.Match(Env{Amount: 10, Country: "FR", Tags: []string{"other"}})
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestComplete(t *testing.T) {
+	env := &mockEnv{}
+	names := func(candidates []expr.Candidate) []string {
+		var out []string
+		for _, c := range candidates {
+			out = append(out, c.Name)
+		}
+		return out
+	}
+
+	require.Equal(t, []string{"Price", "PriceDiv", "String"}, names(expr.Complete(`Ticket.`, 7, env)))
+	require.Equal(t, []string{"Price", "PriceDiv"}, names(expr.Complete(`1 + Ticket?.Pr`, 14, env)))
+	require.Equal(t, []string{"Date", "Destination"}, names(expr.Complete(`Segments[0].D > 0`, 13, env)))
+	require.Equal(t, []string{"Adults"}, names(expr.Complete(`filter(Tweets, {# > Passengers.A`, 32, env)))
+	require.Equal(t, []string{"Tweets", "Two"}, names(expr.Complete(`Int + Tw`, 8, env)))
+	require.Empty(t, expr.Complete(`Unknown.`, 8, env))
+	require.Empty(t, expr.Complete(`Any.`, 4, env))
+
+	candidates := expr.Complete(`Ticket.PriceD`, 13, env)
+	require.Len(t, candidates, 1)
+	require.True(t, candidates[0].Method)
+
+	require.Equal(t, []string{"bar", "foo"}, names(expr.Complete(`f + `, 4, map[string]interface{}{"foo": 1, "bar": 2})))
+
+	near := expr.Infix("~>", 30, func(a, b int) bool { return a < b })
+	require.Empty(t, expr.Complete(`Int ~> Ticket.`, 14, env))
+	require.Equal(t, []string{"Price", "PriceDiv", "String"}, names(expr.Complete(`Int ~> Ticket.`, 14, env, near)))
+}
+
 //
 // Mock types
 //
@@ -10,12 +10,17 @@ type Error struct {
 	Location
 	Message string
 	Snippet string
+	Err     error `json:"-"` // underlying cause, if any
 }
 
 func (e *Error) Error() string {
 	return e.format()
 }
 
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 func (e *Error) Bind(source *Source) *Error {
 	if snippet, found := source.Snippet(e.Location.Line); found {
 		snippet := strings.Replace(snippet, "\t", " ", -1)
@@ -56,3 +61,16 @@ func (e *Error) format() string {
 		e.Snippet,
 	)
 }
+
+// Warning describes a problem which does not prevent compilation.
+type Warning struct {
+	Location
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Location.Empty() {
+		return w.Message
+	}
+	return fmt.Sprintf("%s (%d:%d)", w.Message, w.Line, w.Column+1)
+}
@@ -0,0 +1,45 @@
+// Package difftest checks that the compiled program and the tree-walking
+// vm.Eval agree on the result of an expression.
+package difftest
+
+import (
+	"testing"
+
+	"github.com/ebusto/expr/checker"
+	"github.com/ebusto/expr/compiler"
+	"github.com/ebusto/expr/conf"
+	"github.com/ebusto/expr/file"
+	"github.com/ebusto/expr/parser"
+	"github.com/ebusto/expr/vm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Check compiles input for env and runs it with vm.Run, then evaluates the
+// same tree with vm.Eval. It fails t unless both return the same value, or
+// both fail with the same error.
+func Check(t *testing.T, input string, env interface{}) {
+	tree, err := parser.Parse(input)
+	require.NoError(t, err, input)
+
+	config := conf.New(env)
+	_, err = checker.Check(tree, config)
+	require.NoError(t, err, input)
+
+	program, err := compiler.Compile(tree, config)
+	require.NoError(t, err, input)
+
+	want, runErr := vm.Run(program, env)
+	got, evalErr := vm.EvalWith(tree.Node, env, program.Options)
+	if fileError, ok := evalErr.(*file.Error); ok {
+		evalErr = fileError.Bind(tree.Source)
+	}
+
+	if runErr != nil || evalErr != nil {
+		if assert.Error(t, runErr, "run: %v", input) && assert.Error(t, evalErr, "eval: %v", input) {
+			assert.Equal(t, runErr.Error(), evalErr.Error(), input)
+		}
+		return
+	}
+	assert.Equal(t, want, got, input)
+}
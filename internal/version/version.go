@@ -0,0 +1,143 @@
+// Package version implements the versions of the version literals and of
+// versionCompare, shared by the parser and the vm.
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a version number, such as "1.2.0", ordered as in semantic
+// versioning: by its numeric segments, with missing ones being 0, and then
+// by its pre-release identifiers, such as "rc.1" in "1.2.0-rc.1", which
+// order it before the release. Build metadata after "+" is ignored.
+type Version struct {
+	text     string
+	segments []int
+	pre      []string
+}
+
+// Parse parses a version, which may start with "v".
+func Parse(s string) (Version, error) {
+	version := Version{text: s}
+	invalid := fmt.Errorf("invalid version %q", s)
+
+	core := strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if i := strings.IndexByte(core, '+'); i >= 0 {
+		core = core[:i]
+	}
+	if i := strings.IndexByte(core, '-'); i >= 0 {
+		version.pre = strings.Split(core[i+1:], ".")
+		core = core[:i]
+		for _, id := range version.pre {
+			if id == "" || strings.Trim(id, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-") != "" {
+				return Version{}, invalid
+			}
+		}
+	}
+	for _, segment := range strings.Split(core, ".") {
+		if segment == "" || strings.Trim(segment, "0123456789") != "" {
+			return Version{}, invalid
+		}
+		n, err := strconv.Atoi(segment)
+		if err != nil {
+			return Version{}, invalid
+		}
+		version.segments = append(version.segments, n)
+	}
+	return version, nil
+}
+
+func (v Version) String() string {
+	return v.text
+}
+
+// Compare compares the version with another one, or with a string holding
+// one, and panics with anything else.
+func (v Version) Compare(other interface{}) int {
+	return Compare(v, From("compare", other))
+}
+
+// Equal reports whether the versions are equal, so 1.2 equals 1.2.0.
+func (v Version) Equal(other interface{}) bool {
+	switch other.(type) {
+	case Version, string:
+		return v.Compare(other) == 0
+	}
+	return false
+}
+
+// From returns the argument of the builtin, which must be a Version or a
+// string holding one, and panics otherwise.
+func From(builtin string, arg interface{}) Version {
+	switch x := arg.(type) {
+	case Version:
+		return x
+	case string:
+		version, err := Parse(x)
+		if err != nil {
+			panic(err.Error())
+		}
+		return version
+	}
+	panic(fmt.Sprintf("cannot use %T as version in %v", arg, builtin))
+}
+
+// Compare returns -1, 0 or 1 if a is before, equal to or after b.
+func Compare(a, b Version) int {
+	for i := 0; i < len(a.segments) || i < len(b.segments); i++ {
+		var x, y int
+		if i < len(a.segments) {
+			x = a.segments[i]
+		}
+		if i < len(b.segments) {
+			y = b.segments[i]
+		}
+		if x != y {
+			return sign(x - y)
+		}
+	}
+
+	// A pre-release comes before the release.
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		if c := compareIdentifiers(a.pre[i], b.pre[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(a.pre) - len(b.pre))
+}
+
+// compareIdentifiers compares pre-release identifiers, numerically if both
+// are numbers, and otherwise as strings, with numbers before other ones.
+func compareIdentifiers(a, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return sign(x - y)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(x int) int {
+	switch {
+	case x < 0:
+		return -1
+	case x > 0:
+		return 1
+	}
+	return 0
+}
@@ -9,8 +9,9 @@ import (
 )
 
 type fold struct {
-	applied bool
-	err     *file.Error
+	applied   bool
+	err       *file.Error
+	divideInf bool // integer division by zero is left to OpDivideInf
 }
 
 func (*fold) Enter(*Node) {}
@@ -68,6 +69,9 @@ func (fold *fold) Exit(node *Node) {
 			if a, ok := n.Left.(*IntegerNode); ok {
 				if b, ok := n.Right.(*IntegerNode); ok {
 					if b.Value == 0 {
+						if fold.divideInf {
+							return
+						}
 						fold.err = &file.Error{
 							Location: (*node).Location(),
 							Message:  "integer divide by zero",
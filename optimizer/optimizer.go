@@ -8,7 +8,7 @@ import (
 func Optimize(node *Node, config *conf.Config) error {
 	Walk(node, &inArray{})
 	for limit := 1000; limit >= 0; limit-- {
-		fold := &fold{}
+		fold := &fold{divideInf: config != nil && config.DivideByZeroInf}
 		Walk(node, fold)
 		if fold.err != nil {
 			return fold.err
@@ -9,9 +9,32 @@ import (
 )
 
 func Lex(source *file.Source) ([]Token, error) {
+	tokens, err := lex(source, "")
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Tokenize splits input into tokens without parsing it, e.g. for syntax
+// highlighting. Unlike Lex, it also returns the tokens on error, such as an
+// unterminated string, so incomplete input can still be highlighted.
+func Tokenize(input string) ([]Token, error) {
+	return lex(file.NewSource(input), "")
+}
+
+// LexWith is like Tokenize, but also lexes the runes of operators, which
+// are not operators of the language, such as "~" or "@", as operators, for
+// the operators defined by the user.
+func LexWith(source *file.Source, operators string) ([]Token, error) {
+	return lex(source, operators)
+}
+
+func lex(source *file.Source, operators string) ([]Token, error) {
 	l := &lexer{
-		input:  source.Content(),
-		tokens: make([]Token, 0),
+		input:     source.Content(),
+		tokens:    make([]Token, 0),
+		operators: operators,
 	}
 
 	l.loc = file.Location{Line: 1, Column: 0}
@@ -23,7 +46,7 @@ func Lex(source *file.Source) ([]Token, error) {
 	}
 
 	if l.err != nil {
-		return nil, l.err.Bind(source)
+		return l.tokens, l.err.Bind(source)
 	}
 
 	return l.tokens, nil
@@ -37,6 +60,7 @@ type lexer struct {
 	startLoc   file.Location // start location
 	prev, loc  file.Location // prev location of end location, end location
 	err        *file.Error
+	operators  string // runes lexed as operators, besides those of the language
 }
 
 const eof rune = -1
@@ -81,6 +105,8 @@ func (l *lexer) emitValue(t Kind, value string) {
 		Location: l.startLoc,
 		Kind:     t,
 		Value:    value,
+		Text:     l.word(),
+		Offset:   l.start,
 	})
 	l.start = l.end
 	l.startLoc = l.loc
@@ -90,6 +116,7 @@ func (l *lexer) emitEOF() {
 	l.tokens = append(l.tokens, Token{
 		Location: l.prev, // Point to previous position for better error messages.
 		Kind:     EOF,
+		Offset:   l.start,
 	})
 	l.start = l.end
 	l.startLoc = l.loc
@@ -165,16 +165,35 @@ func TestLex_location(t *testing.T) {
 	tokens, err := Lex(source)
 	require.NoError(t, err)
 	require.Equal(t, []Token{
-		{Location: file.Location{Line: 1, Column: 0}, Kind: Number, Value: "1"},
-		{Location: file.Location{Line: 1, Column: 1}, Kind: Operator, Value: ".."},
-		{Location: file.Location{Line: 1, Column: 3}, Kind: Number, Value: "2"},
-		{Location: file.Location{Line: 1, Column: 5}, Kind: Number, Value: "3"},
-		{Location: file.Location{Line: 1, Column: 6}, Kind: Operator, Value: ".."},
-		{Location: file.Location{Line: 1, Column: 8}, Kind: Number, Value: "4"},
-		{Location: file.Location{Line: 1, Column: 8}, Kind: EOF, Value: ""},
+		{Location: file.Location{Line: 1, Column: 0}, Kind: Number, Value: "1", Text: "1", Offset: 0},
+		{Location: file.Location{Line: 1, Column: 1}, Kind: Operator, Value: "..", Text: "..", Offset: 1},
+		{Location: file.Location{Line: 1, Column: 3}, Kind: Number, Value: "2", Text: "2", Offset: 3},
+		{Location: file.Location{Line: 1, Column: 5}, Kind: Number, Value: "3", Text: "3", Offset: 5},
+		{Location: file.Location{Line: 1, Column: 6}, Kind: Operator, Value: "..", Text: "..", Offset: 6},
+		{Location: file.Location{Line: 1, Column: 8}, Kind: Number, Value: "4", Text: "4", Offset: 8},
+		{Location: file.Location{Line: 1, Column: 8}, Kind: EOF, Value: "", Offset: 9},
 	}, tokens)
 }
 
+func TestTokenize(t *testing.T) {
+	tokens, err := Tokenize(`a not in ["\x41"]`)
+	require.NoError(t, err)
+	require.Equal(t, []Token{
+		{Location: file.Location{Line: 1, Column: 0}, Kind: Identifier, Value: "a", Text: "a", Offset: 0},
+		{Location: file.Location{Line: 1, Column: 2}, Kind: Operator, Value: "not in", Text: "not in", Offset: 2},
+		{Location: file.Location{Line: 1, Column: 9}, Kind: Bracket, Value: "[", Text: "[", Offset: 9},
+		{Location: file.Location{Line: 1, Column: 10}, Kind: String, Value: "A", Text: `"\x41"`, Offset: 10},
+		{Location: file.Location{Line: 1, Column: 16}, Kind: Bracket, Value: "]", Text: "]", Offset: 16},
+		{Location: file.Location{Line: 1, Column: 16}, Kind: EOF, Value: "", Offset: 17},
+	}, tokens)
+
+	tokens, err = Tokenize(`foo + "bar`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "literal not terminated")
+	require.Equal(t, String, tokens[2].Kind)
+	require.Equal(t, `"bar`, tokens[2].Text)
+}
+
 const errorTests = `
 "\xQA"
 invalid char escape (1:5)
@@ -33,7 +33,7 @@ func root(l *lexer) stateFn {
 		l.emit(Bracket)
 	case strings.ContainsRune(")]}", r):
 		l.emit(Bracket)
-	case strings.ContainsRune("#,?:%+-/", r): // single rune operator
+	case strings.ContainsRune("#,?:;%+-/", r) || strings.ContainsRune(l.operators, r): // single rune operator
 		l.emit(Operator)
 	case strings.ContainsRune("&|!=*<>", r): // possible double rune operator
 		l.accept("&|=*")
@@ -125,7 +125,7 @@ loop:
 			switch l.word() {
 			case "not":
 				return not
-			case "in", "or", "and", "matches", "contains", "startsWith", "endsWith":
+			case "in", "or", "and", "matches", "contains", "startsWith", "endsWith", "between":
 				l.emit(Operator)
 			default:
 				l.emit(Identifier)
@@ -19,8 +19,10 @@ const (
 
 type Token struct {
 	file.Location
-	Kind  Kind
-	Value string
+	Kind   Kind
+	Value  string
+	Text   string // source text, e.g. with the quotes and escapes of strings
+	Offset int    // byte offset of Text in the source
 }
 
 func (t Token) String() string {
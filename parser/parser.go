@@ -9,7 +9,9 @@ import (
 
 	. "github.com/ebusto/expr/ast"
 	"github.com/ebusto/expr/file"
+	"github.com/ebusto/expr/internal/version"
 	. "github.com/ebusto/expr/parser/lexer"
+	"github.com/ebusto/expr/vm"
 )
 
 type associativity int
@@ -52,6 +54,7 @@ var binaryOperators = map[string]operator{
 	"contains":   {20, left},
 	"startsWith": {20, left},
 	"endsWith":   {20, left},
+	"between":    {20, left},
 	"..":         {25, left},
 	"+":          {30, left},
 	"-":          {30, left},
@@ -70,6 +73,7 @@ var builtins = map[string]builtin{
 	"filter": {2},
 	"map":    {2},
 	"count":  {2},
+	"fill":   {2},
 }
 
 type parser struct {
@@ -77,7 +81,19 @@ type parser struct {
 	current Token
 	pos     int
 	err     *file.Error
-	depth   int // closure call depth
+	depth   int        // closure call depth
+	lets    []*LetNode // let bindings in scope, innermost last
+	count   int        // number of let bindings so far
+	infix   map[string]Infix
+}
+
+// Infix is a binary operator defined by the user, such as "~>" or a word
+// like "near", which is parsed into a BinaryNode. Operators of greater
+// precedence bind tighter: "or" is 10, "and" 15, comparisons 20, ".." 25,
+// "+" and "-" 30, "*", "/" and "%" 60 and "**" 70.
+type Infix struct {
+	Precedence int
+	Right      bool // right associative, so a ~> b ~> c is a ~> (b ~> c)
 }
 
 type Tree struct {
@@ -86,19 +102,34 @@ type Tree struct {
 }
 
 func Parse(input string) (*Tree, error) {
+	return ParseWith(input, nil)
+}
+
+// ParseWith is like Parse, but also parses the given infix operators, by
+// their symbols.
+func ParseWith(input string, infix map[string]Infix) (*Tree, error) {
+	for symbol, op := range infix {
+		if err := checkInfix(symbol, op); err != nil {
+			return nil, err
+		}
+	}
+
 	source := file.NewSource(input)
 
-	tokens, err := Lex(source)
+	tokens, err := LexWith(source, infixRunes(infix))
 	if err != nil {
 		return nil, err
 	}
 
+	tokens = joinInfix(tokens, infix)
+
 	p := &parser{
 		tokens:  tokens,
 		current: tokens[0],
+		infix:   infix,
 	}
 
-	node := p.parseExpression(0)
+	node := p.parseSequence()
 
 	if !p.current.Is(EOF) {
 		p.error("unexpected token %v", p.current)
@@ -114,10 +145,127 @@ func Parse(input string) (*Tree, error) {
 	}, nil
 }
 
+// ParseTolerant is like Parse, but recovers from syntax errors to report all
+// of them, e.g. for an editor. After an error, the parser skips past the
+// next operator or comma, or past the brackets around the error, and parses
+// the rest of the input as another expression. The tree is the best-effort
+// parse of the input up to the first error, and errors are empty if there
+// are none.
+func ParseTolerant(input string) (*Tree, []*file.Error) {
+	return ParseTolerantWith(input, nil)
+}
+
+// ParseTolerantWith is like ParseTolerant, but also parses the given infix
+// operators, as ParseWith does.
+func ParseTolerantWith(input string, infix map[string]Infix) (*Tree, []*file.Error) {
+	source := file.NewSource(input)
+
+	var errors []*file.Error
+	valid := make(map[string]Infix, len(infix))
+	for symbol, op := range infix {
+		if err := checkInfix(symbol, op); err != nil {
+			errors = append(errors, &file.Error{Message: err.Error()})
+			continue
+		}
+		valid[symbol] = op
+	}
+	infix = valid
+
+	tokens, err := LexWith(source, infixRunes(infix))
+	if err != nil {
+		errors = append(errors, err.(*file.Error))
+	}
+	if len(tokens) == 0 || !tokens[len(tokens)-1].Is(EOF) {
+		eof := Token{Kind: EOF, Offset: len(input)}
+		if len(tokens) > 0 {
+			eof.Location = tokens[len(tokens)-1].Location
+		}
+		tokens = append(tokens, eof)
+	}
+
+	tokens = joinInfix(tokens, infix)
+
+	p := &parser{
+		tokens:  tokens,
+		current: tokens[0],
+		infix:   infix,
+	}
+
+	node := p.parseSequence()
+	if node == nil {
+		node = &NilNode{}
+	}
+	for {
+		if p.err == nil && !p.current.Is(EOF) {
+			p.error("unexpected token %v", p.current)
+		}
+		if p.err == nil {
+			break
+		}
+		errors = append(errors, p.err.Bind(source))
+		p.err = nil
+		if !p.recover() {
+			break
+		}
+		p.parseExpression(0)
+	}
+
+	return &Tree{
+		Node:   node,
+		Source: source,
+	}, errors
+}
+
+// recover skips tokens after an error. Within brackets, it skips past the
+// bracket closing the outermost group, along with a binary operator after
+// it, and otherwise past the next operator or comma. It reports false if no
+// tokens are left.
+func (p *parser) recover() bool {
+	level := 0 // brackets open at the error
+	for _, token := range p.tokens[:p.pos] {
+		if token.Is(Bracket, "(", "[", "{") {
+			level++
+		} else if token.Is(Bracket, ")", "]", "}") && level > 0 {
+			level--
+		}
+	}
+
+	nested := 0 // brackets opened since the error
+	for !p.current.Is(EOF) {
+		token := p.current
+		p.pos++
+		p.current = p.tokens[p.pos]
+		switch {
+		case token.Is(Bracket, "(", "[", "{"):
+			nested++
+		case token.Is(Bracket, ")", "]", "}") && nested > 0:
+			nested--
+		case token.Is(Bracket, ")", "]", "}") && level > 0:
+			level--
+			if level == 0 {
+				if _, ok := binaryOperators[p.current.Value]; ok && p.current.Is(Operator) {
+					if _, unary := unaryOperators[p.current.Value]; !unary {
+						p.pos++
+						p.current = p.tokens[p.pos]
+					}
+				}
+				return !p.current.Is(EOF)
+			}
+		case nested == 0 && level == 0 && (token.Is(Operator) || token.Value == ","):
+			return !p.current.Is(EOF)
+		}
+	}
+	return false
+}
+
 func (p *parser) error(format string, args ...interface{}) {
+	p.errorAt(p.current.Location, format, args...)
+}
+
+func (p *parser) errorAt(location file.Location, format string, args ...interface{}) {
 	if p.err == nil { // show first error
 		p.err = &file.Error{
-			Location: p.current.Location,
+			Location: location,
 			Message:  fmt.Sprintf(format, args...),
 		}
 	}
@@ -147,10 +295,16 @@ func (p *parser) parseExpression(precedence int) Node {
 
 	token := p.current
 	for token.Is(Operator) && p.err == nil {
-		if op, ok := binaryOperators[token.Value]; ok {
+		if op, ok := p.binaryOperator(token.Value); ok {
 			if op.precedence >= precedence {
 				p.next()
 
+				if token.Is(Operator, "between") {
+					nodeLeft = p.parseBetweenExpression(token, nodeLeft, op)
+					token = p.current
+					continue
+				}
+
 				var nodeRight Node
 				if op.associativity == left {
 					nodeRight = p.parseExpression(op.precedence + 1)
@@ -159,21 +313,7 @@ func (p *parser) parseExpression(precedence int) Node {
 				}
 
 				if token.Is(Operator, "matches") {
-					var r *regexp.Regexp
-					var err error
-
-					if s, ok := nodeRight.(*StringNode); ok {
-						r, err = regexp.Compile(s.Value)
-						if err != nil {
-							p.error("%v", err)
-						}
-					}
-					nodeLeft = &MatchesNode{
-						Regexp: r,
-						Left:   nodeLeft,
-						Right:  nodeRight,
-					}
-					nodeLeft.SetLocation(token.Location)
+					nodeLeft = p.parseMatches(token, nodeLeft, nodeRight, nil)
 				} else {
 					nodeLeft = &BinaryNode{
 						Operator: token.Value,
@@ -196,9 +336,205 @@ func (p *parser) parseExpression(precedence int) Node {
 	return nodeLeft
 }
 
+// binaryOperator returns the binary operator with the given symbol, which
+// may be defined by the user.
+func (p *parser) binaryOperator(symbol string) (operator, bool) {
+	if op, ok := binaryOperators[symbol]; ok {
+		return op, true
+	}
+	if op, ok := p.infix[symbol]; ok {
+		if op.Right {
+			return operator{op.Precedence, right}, true
+		}
+		return operator{op.Precedence, left}, true
+	}
+	return operator{}, false
+}
+
+// checkInfix reports whether op may be defined as an infix operator: its
+// symbol must be a word or made of operator characters, and must not be an
+// operator already.
+func checkInfix(symbol string, op Infix) error {
+	if _, ok := binaryOperators[symbol]; ok {
+		return fmt.Errorf("cannot define operator %v: it is already an operator", symbol)
+	}
+	if _, ok := unaryOperators[symbol]; ok {
+		return fmt.Errorf("cannot define operator %v: it is already an operator", symbol)
+	}
+	if op.Precedence <= 0 {
+		return fmt.Errorf("precedence of operator %v must be positive", symbol)
+	}
+	word, r := true, []rune(symbol)
+	for i := range r {
+		if !IsAlphaNumeric(r[i]) || (i == 0 && !IsAlphabetic(r[i])) {
+			word = false
+		}
+	}
+	if symbol == "" || !word && strings.Trim(symbol, "~^@&|!=*<>%+-/") != "" {
+		return fmt.Errorf("invalid operator %q: it must be a word or made of ~^@&|!=*<>%%+-/", symbol)
+	}
+	return nil
+}
+
+// infixRunes returns the runes of the symbols of infix operators which are
+// not operators of the language on their own, for the lexer.
+func infixRunes(infix map[string]Infix) string {
+	var runes []rune
+	for symbol := range infix {
+		for _, r := range symbol {
+			if strings.ContainsRune("~^@", r) && !strings.ContainsRune(string(runes), r) {
+				runes = append(runes, r)
+			}
+		}
+	}
+	return string(runes)
+}
+
+// joinInfix joins adjacent operator tokens spelling an infix operator, such
+// as "~" and ">" for "~>", preferring the longest, and makes the identifiers
+// naming one operators.
+func joinInfix(tokens []Token, infix map[string]Infix) []Token {
+	if len(infix) == 0 {
+		return tokens
+	}
+	out := make([]Token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch {
+		case token.Is(Identifier):
+			if _, ok := infix[token.Value]; ok && !afterDot(out) {
+				token.Kind = Operator
+			}
+		case token.Is(Operator):
+			text, last := "", -1
+			for j := i; j < len(tokens) && tokens[j].Is(Operator); j++ {
+				if j > i && tokens[j].Offset != tokens[j-1].Offset+len(tokens[j-1].Text) {
+					break
+				}
+				text += tokens[j].Text
+				if _, ok := infix[text]; ok {
+					last = j
+					token.Value, token.Text = text, text
+				}
+			}
+			if last >= 0 {
+				i = last
+			}
+		}
+		out = append(out, token)
+	}
+	return out
+}
+
+// afterDot reports whether the next token is a property, after "." or "?.".
+func afterDot(tokens []Token) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	return last.Is(Operator, ".") || last.Is(Operator, "?.")
+}
+
+// parseBetweenExpression parses the bounds of "x between a and b". Bounds
+// bind tighter than "and", so "x between 1 and 2 and y" is the conjunction
+// of the between expression and y.
+func (p *parser) parseBetweenExpression(token Token, node Node, op operator) Node {
+	from := p.parseExpression(op.precedence + 1)
+	p.expect(Operator, "and")
+	to := p.parseExpression(op.precedence + 1)
+
+	between := &BuiltinNode{
+		Name:      "between",
+		Arguments: []Node{node, from, to},
+	}
+	between.SetLocation(token.Location)
+	return between
+}
+
+// parseMatches builds a matches node, compiling the regexp right away if
+// the pattern and flags are literals.
+func (p *parser) parseMatches(token Token, left, right, flags Node) Node {
+	var r *regexp.Regexp
+	var err error
+
+	pattern, isLiteral := right.(*StringNode)
+	var f string
+	if flags != nil {
+		s, ok := flags.(*StringNode)
+		if ok {
+			f = s.Value
+			if err = vm.ValidateFlags(f); err != nil {
+				p.error("%v", err)
+			}
+		}
+		isLiteral = isLiteral && ok
+	}
+
+	if isLiteral && p.err == nil {
+		var source string
+		source, err = vm.WithFlags(pattern.Value, f)
+		if err == nil {
+			r, err = vm.CompileRegexp(source)
+		}
+		if err != nil {
+			p.error("%v", err)
+		}
+	}
+	node := &MatchesNode{
+		Regexp: r,
+		Left:   left,
+		Right:  right,
+		Flags:  flags,
+	}
+	node.SetLocation(token.Location)
+	return node
+}
+
+// integer returns a node of an integer literal. Literals out of the range
+// of int, which is 32 bits wide on 32-bit platforms, are int64 constants.
+func (p *parser) integer(token Token, number int64) Node {
+	var node Node
+	if int64(int(number)) == number {
+		node = &IntegerNode{Value: int(number)}
+	} else {
+		node = &ConstantNode{Value: number}
+	}
+	node.SetLocation(token.Location)
+	return node
+}
+
 func (p *parser) parsePrimary() Node {
 	token := p.current
 
+	// Function form of the operator: matches(s, pattern, flags).
+	if token.Is(Operator, "matches") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].Is(Bracket, "(") {
+		p.next()
+		arguments := p.parseArguments()
+		if len(arguments) != 2 && len(arguments) != 3 {
+			p.error("invalid number of arguments for matches (expected 2 or 3, got %d)", len(arguments))
+			return &NilNode{}
+		}
+		var flags Node
+		if len(arguments) == 3 {
+			flags = arguments[2]
+		}
+		return p.parsePostfixExpression(p.parseMatches(token, arguments[0], arguments[1], flags))
+	}
+
+	// Function forms of the string operators resolve to builtins.
+	if token.Is(Operator) && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].Is(Bracket, "(") {
+		switch token.Value {
+		case "contains", "startsWith", "endsWith":
+			p.next()
+			node := &FunctionNode{
+				Name:      token.Value,
+				Arguments: p.parseArguments(),
+			}
+			node.SetLocation(token.Location)
+			return p.parsePostfixExpression(node)
+		}
+	}
+
 	if token.Is(Operator) {
 		if op, ok := unaryOperators[token.Value]; ok {
 			p.next()
@@ -212,6 +548,10 @@ func (p *parser) parsePrimary() Node {
 		}
 	}
 
+	if token.Is(Identifier, "let") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].Is(Identifier) {
+		return p.parseLetExpression()
+	}
+
 	if token.Is(Bracket, "(") {
 		p.next()
 		expr := p.parseExpression(0)
@@ -237,6 +577,50 @@ func (p *parser) parsePrimary() Node {
 	return p.parsePrimaryExpression()
 }
 
+// parseSequence parses the top-level expressions separated by commas, of a
+// program with multiple results.
+func (p *parser) parseSequence() Node {
+	token := p.current
+	node := p.parseExpression(0)
+	if !p.current.Is(Operator, ",") {
+		return node
+	}
+
+	sequence := &SequenceNode{Nodes: []Node{node}}
+	sequence.SetLocation(token.Location)
+	for p.err == nil && p.current.Is(Operator, ",") {
+		p.next()
+		sequence.Nodes = append(sequence.Nodes, p.parseExpression(0))
+	}
+	return sequence
+}
+
+// parseLetExpression parses "let name = value; body". The name is visible
+// in the body only, where it shadows env variables and outer bindings.
+func (p *parser) parseLetExpression() Node {
+	token := p.current
+	p.next()
+	name := p.current
+	p.expect(Identifier)
+	p.expect(Operator, "=")
+	value := p.parseExpression(0)
+	p.expect(Operator, ";")
+
+	let := &LetNode{
+		Name:  name.Value,
+		Index: p.count,
+		Value: value,
+	}
+	let.SetLocation(token.Location)
+	p.count++
+
+	p.lets = append(p.lets, let)
+	let.Body = p.parseExpression(0)
+	p.lets = p.lets[:len(p.lets)-1]
+
+	return let
+}
+
 func (p *parser) parseConditionalExpression(node Node) Node {
 	var expr1, expr2 Node
 	for p.current.Is(Operator, "?") && p.err == nil {
@@ -282,6 +666,19 @@ func (p *parser) parsePrimaryExpression() Node {
 			node := &NilNode{}
 			node.SetLocation(token.Location)
 			return node
+		case "v":
+			// A version literal, such as v"1.2.0", is a string right after v.
+			if p.current.Is(String) && p.current.Offset == token.Offset+1 {
+				version, err := version.Parse(p.current.Value)
+				if err != nil {
+					p.errorAt(token.Location, "%v", err)
+				}
+				p.next()
+				node := &ConstantNode{Value: version}
+				node.SetLocation(token.Location)
+				return p.parsePostfixExpression(node)
+			}
+			node = p.parseIdentifierExpression(token, p.current)
 		default:
 			node = p.parseIdentifierExpression(token, p.current)
 		}
@@ -302,17 +699,13 @@ func (p *parser) parsePrimaryExpression() Node {
 			if err != nil {
 				p.error("invalid hex literal: %v", err)
 			}
-			node := &IntegerNode{Value: int(number)}
-			node.SetLocation(token.Location)
-			return node
+			return p.integer(token, number)
 		} else {
 			number, err := strconv.ParseInt(value, 10, 64)
 			if err != nil {
 				p.error("invalid integer literal: %v", err)
 			}
-			node := &IntegerNode{Value: int(number)}
-			node.SetLocation(token.Location)
-			return node
+			return p.integer(token, number)
 		}
 
 	case String:
@@ -367,6 +760,14 @@ func (p *parser) parseIdentifierExpression(token, next Token) Node {
 			node.SetLocation(token.Location)
 		}
 	} else {
+		for i := len(p.lets) - 1; i >= 0; i-- {
+			if p.lets[i].Name == token.Value {
+				node = &VariableNode{Name: token.Value, Index: p.lets[i].Index}
+				node.SetLocation(token.Location)
+				return node
+			}
+		}
+
 		var nilsafe bool
 		if next.Value == "?." {
 			nilsafe = true
@@ -547,6 +948,13 @@ func (p *parser) parsePostfixExpression(node Node) Node {
 					p.expect(Bracket, "]")
 				}
 			}
+		} else if token.Value == "(" {
+			arguments := p.parseArguments()
+			node = &CallNode{
+				Callee:    node,
+				Arguments: arguments,
+			}
+			node.SetLocation(token.Location)
 		} else {
 			break
 		}
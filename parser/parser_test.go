@@ -8,6 +8,7 @@ import (
 	"github.com/ebusto/expr/ast"
 	"github.com/ebusto/expr/parser"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParse(t *testing.T) {
@@ -134,6 +135,16 @@ func TestParse(t *testing.T) {
 				Index: &ast.IntegerNode{Value: 33},
 			},
 		},
+		{
+			`m["k"](1)()`,
+			&ast.CallNode{
+				Callee: &ast.CallNode{
+					Callee:    &ast.IndexNode{Node: &ast.IdentifierNode{Value: "m"}, Index: &ast.StringNode{Value: "k"}},
+					Arguments: []ast.Node{&ast.IntegerNode{Value: 1}},
+				},
+				Arguments: []ast.Node{},
+			},
+		},
 		{
 			"'a' == 'b'",
 			&ast.BinaryNode{Operator: "==", Left: &ast.StringNode{Value: "a"}, Right: &ast.StringNode{Value: "b"}},
@@ -178,6 +189,18 @@ func TestParse(t *testing.T) {
 			`foo matches regex`,
 			&ast.MatchesNode{Left: &ast.IdentifierNode{Value: "foo"}, Right: &ast.IdentifierNode{Value: "regex"}},
 		},
+		{
+			`matches(foo, "^foo", "i")`,
+			&ast.MatchesNode{Left: &ast.IdentifierNode{Value: "foo"}, Right: &ast.StringNode{Value: "^foo"}, Flags: &ast.StringNode{Value: "i"}},
+		},
+		{
+			`startsWith(foo, "a")`,
+			&ast.FunctionNode{Name: "startsWith", Arguments: []ast.Node{&ast.IdentifierNode{Value: "foo"}, &ast.StringNode{Value: "a"}}},
+		},
+		{
+			`matches(foo, regex)`,
+			&ast.MatchesNode{Left: &ast.IdentifierNode{Value: "foo"}, Right: &ast.IdentifierNode{Value: "regex"}},
+		},
 		{
 			`foo contains "foo"`,
 			&ast.BinaryNode{Operator: "contains", Left: &ast.IdentifierNode{Value: "foo"}, Right: &ast.StringNode{Value: "foo"}},
@@ -202,6 +225,46 @@ func TestParse(t *testing.T) {
 			"not in_var",
 			&ast.UnaryNode{Operator: "not", Node: &ast.IdentifierNode{Value: "in_var"}},
 		},
+		{
+			"a not in b",
+			&ast.BinaryNode{Operator: "not in", Left: &ast.IdentifierNode{Value: "a"}, Right: &ast.IdentifierNode{Value: "b"}},
+		},
+		{
+			"a + 1 not in b and c",
+			&ast.BinaryNode{Operator: "and",
+				Left: &ast.BinaryNode{Operator: "not in",
+					Left:  &ast.BinaryNode{Operator: "+", Left: &ast.IdentifierNode{Value: "a"}, Right: &ast.IntegerNode{Value: 1}},
+					Right: &ast.IdentifierNode{Value: "b"}},
+				Right: &ast.IdentifierNode{Value: "c"}},
+		},
+		{
+			"a between 1 and b + 1 and c",
+			&ast.BinaryNode{Operator: "and",
+				Left: &ast.BuiltinNode{Name: "between", Arguments: []ast.Node{
+					&ast.IdentifierNode{Value: "a"},
+					&ast.IntegerNode{Value: 1},
+					&ast.BinaryNode{Operator: "+", Left: &ast.IdentifierNode{Value: "b"}, Right: &ast.IntegerNode{Value: 1}}}},
+				Right: &ast.IdentifierNode{Value: "c"}},
+		},
+		{
+			"let x = a; let y = x + 1; let x = y; x + y",
+			&ast.LetNode{Name: "x", Index: 0, Value: &ast.IdentifierNode{Value: "a"},
+				Body: &ast.LetNode{Name: "y", Index: 1,
+					Value: &ast.BinaryNode{Operator: "+", Left: &ast.VariableNode{Name: "x", Index: 0}, Right: &ast.IntegerNode{Value: 1}},
+					Body: &ast.LetNode{Name: "x", Index: 2, Value: &ast.VariableNode{Name: "y", Index: 1},
+						Body: &ast.BinaryNode{Operator: "+", Left: &ast.VariableNode{Name: "x", Index: 2}, Right: &ast.VariableNode{Name: "y", Index: 1}}}}},
+		},
+		{
+			"let x = x; (let y = 1; y) + y",
+			&ast.LetNode{Name: "x", Index: 0, Value: &ast.IdentifierNode{Value: "x"},
+				Body: &ast.BinaryNode{Operator: "+",
+					Left:  &ast.LetNode{Name: "y", Index: 1, Value: &ast.IntegerNode{Value: 1}, Body: &ast.VariableNode{Name: "y", Index: 1}},
+					Right: &ast.IdentifierNode{Value: "y"}}},
+		},
+		{
+			"let + 1",
+			&ast.BinaryNode{Operator: "+", Left: &ast.IdentifierNode{Value: "let"}, Right: &ast.IntegerNode{Value: 1}},
+		},
 		{
 			"all(Tickets, {.Price > 0})",
 			&ast.BuiltinNode{Name: "all", Arguments: []ast.Node{&ast.IdentifierNode{Value: "Tickets"}, &ast.ClosureNode{Node: &ast.BinaryNode{Operator: ">", Left: &ast.PropertyNode{Node: &ast.PointerNode{}, Property: "Price"}, Right: &ast.IntegerNode{Value: 0}}}}},
@@ -318,6 +381,31 @@ a map key must be a quoted string, a number, a identifier, or an expression encl
 unexpected token Operator(",") (1:16)
  | {foo:1, bar:2, ,}
  | ...............^
+
+a between 1 or 2
+unexpected token Operator("or") (1:13)
+ | a between 1 or 2
+ | ............^
+
+matches(a, "b", "x")
+invalid regexp flag 'x' in "x" (1:20)
+ | matches(a, "b", "x")
+ | ...................^
+
+let x = 1 x
+unexpected token Identifier("x") (1:11)
+ | let x = 1 x
+ | ..........^
+
+let x 1; x
+unexpected token Number("1") (1:7)
+ | let x 1; x
+ | ......^
+
+matches(a)
+invalid number of arguments for matches (expected 2 or 3, got 1) (1:10)
+ | matches(a)
+ | .........^
 `
 
 func TestParse_error(t *testing.T) {
@@ -335,3 +423,137 @@ func TestParse_error(t *testing.T) {
 		assert.Equal(t, input[1], err.Error(), input[0])
 	}
 }
+
+func TestParseTolerant(t *testing.T) {
+	tests := []struct {
+		input  string
+		errors []string
+	}{
+		{`1 + 2`, nil},
+		{`foo + * bar + (baz - )`, []string{`unexpected token Operator("*") (1:7)`, `unexpected token Bracket(")") (1:22)`}},
+		{`a b c`, []string{`unexpected token Identifier("b") (1:3)`}},
+		{`foo(1,, 2) * 3 + ) 4`, []string{`unexpected token Operator(",") (1:7)`, `unexpected token Bracket(")") (1:18)`}},
+		{`[1, (2 3), 4] + )`, []string{`unexpected token Number("3") (1:8)`, `unexpected token Bracket(")") (1:17)`}},
+		{`a ♥ b`, []string{`unrecognized character: U+2665 '♥' (1:4)`}},
+		{``, []string{`unexpected token EOF (1:1)`}},
+	}
+	for _, test := range tests {
+		tree, errors := parser.ParseTolerant(test.input)
+		assert.NotNil(t, tree.Node, test.input)
+
+		var messages []string
+		for _, err := range errors {
+			messages = append(messages, strings.SplitN(err.Error(), "\n", 2)[0])
+		}
+		assert.Equal(t, test.errors, messages, test.input)
+	}
+
+	tree, _ := parser.ParseTolerant(`foo.bar + * 2`)
+	expected := &ast.BinaryNode{
+		Operator: "+",
+		Left:     &ast.PropertyNode{Node: &ast.IdentifierNode{Value: "foo"}, Property: "bar"},
+	}
+	assert.Equal(t, ast.Dump(expected), ast.Dump(tree.Node))
+}
+
+func TestParse_sequence(t *testing.T) {
+	tree, err := parser.Parse(`a, b + 1, [c, d]`)
+	require.NoError(t, err)
+
+	expected := &ast.SequenceNode{Nodes: []ast.Node{
+		&ast.IdentifierNode{Value: "a"},
+		&ast.BinaryNode{Operator: "+", Left: &ast.IdentifierNode{Value: "b"}, Right: &ast.IntegerNode{Value: 1}},
+		&ast.ArrayNode{Nodes: []ast.Node{&ast.IdentifierNode{Value: "c"}, &ast.IdentifierNode{Value: "d"}}},
+	}}
+	assert.Equal(t, ast.Dump(expected), ast.Dump(tree.Node))
+
+	_, err = parser.Parse(`a,`)
+	require.Error(t, err)
+}
+
+func TestParseWith(t *testing.T) {
+	infix := map[string]parser.Infix{
+		"~>":   {Precedence: 30},
+		"**>":  {Precedence: 70, Right: true},
+		"near": {Precedence: 20},
+	}
+	tests := []struct {
+		input    string
+		expected ast.Node
+	}{
+		{
+			`a ~> b * c ~> d`,
+			&ast.BinaryNode{
+				Operator: "~>",
+				Left: &ast.BinaryNode{
+					Operator: "~>",
+					Left:     &ast.IdentifierNode{Value: "a"},
+					Right: &ast.BinaryNode{
+						Operator: "*",
+						Left:     &ast.IdentifierNode{Value: "b"},
+						Right:    &ast.IdentifierNode{Value: "c"},
+					},
+				},
+				Right: &ast.IdentifierNode{Value: "d"},
+			},
+		},
+		{
+			`a **> b **> c`,
+			&ast.BinaryNode{
+				Operator: "**>",
+				Left:     &ast.IdentifierNode{Value: "a"},
+				Right: &ast.BinaryNode{
+					Operator: "**>",
+					Left:     &ast.IdentifierNode{Value: "b"},
+					Right:    &ast.IdentifierNode{Value: "c"},
+				},
+			},
+		},
+		{
+			`a.near near b ** c`,
+			&ast.BinaryNode{
+				Operator: "near",
+				Left:     &ast.PropertyNode{Node: &ast.IdentifierNode{Value: "a"}, Property: "near"},
+				Right: &ast.BinaryNode{
+					Operator: "**",
+					Left:     &ast.IdentifierNode{Value: "b"},
+					Right:    &ast.IdentifierNode{Value: "c"},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		tree, err := parser.ParseWith(test.input, infix)
+		require.NoError(t, err, test.input)
+		assert.Equal(t, ast.Dump(test.expected), ast.Dump(tree.Node), test.input)
+	}
+
+	_, err := parser.ParseWith(`a ~ > b`, infix)
+	require.Error(t, err)
+
+	for symbol, message := range map[string]string{
+		"==": "cannot define operator ==: it is already an operator",
+		"1x": `invalid operator "1x"`,
+		"~,": `invalid operator "~,"`,
+	} {
+		_, err := parser.ParseWith(`a`, map[string]parser.Infix{symbol: {Precedence: 1}})
+		require.Error(t, err, symbol)
+		assert.Contains(t, err.Error(), message)
+	}
+	_, err = parser.ParseWith(`a`, map[string]parser.Infix{"~>": {}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "precedence of operator ~> must be positive")
+
+	_, err = parser.Parse(`a ~> b`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unrecognized character: U+007E '~'`)
+
+	tree, errors := parser.ParseTolerantWith(`a ~> b.c + `, infix)
+	require.Len(t, errors, 1)
+	expected := &ast.BinaryNode{
+		Operator: "~>",
+		Left:     &ast.IdentifierNode{Value: "a"},
+		Right:    &ast.PropertyNode{Node: &ast.IdentifierNode{Value: "b"}, Property: "c"},
+	}
+	assert.Equal(t, ast.Dump(expected), ast.Dump(tree.Node.(*ast.BinaryNode).Left))
+}
@@ -0,0 +1,69 @@
+package expr
+
+import (
+	"fmt"
+
+	"github.com/ebusto/expr/vm"
+)
+
+// RuleSet is an ordered list of named rules, expressions of which the first
+// one matching an env is wanted. A rule matches if its output is true, or
+// any value other than nil and false, such as a score or a label computed
+// by the rule. Programs of the rules share a vm.BatchRunner, so a RuleSet
+// must not be used concurrently.
+type RuleSet struct {
+	options []Option
+	names   []string
+	index   map[string]bool
+	runner  *vm.BatchRunner
+}
+
+// RuleMatch is the rule matched by RuleSet.Match, and its output.
+type RuleMatch struct {
+	Name  string
+	Value interface{}
+}
+
+// NewRuleSet returns an empty RuleSet, of which rules are compiled with the
+// given options, such as Env.
+func NewRuleSet(ops ...Option) *RuleSet {
+	return &RuleSet{
+		options: ops,
+		index:   make(map[string]bool),
+		runner:  vm.NewBatchRunner(),
+	}
+}
+
+// AddRule compiles source as the last rule, named name.
+func (s *RuleSet) AddRule(name, source string) error {
+	if s.index[name] {
+		return fmt.Errorf("rule %v is already defined", name)
+	}
+	program, err := Compile(source, s.options...)
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	s.names = append(s.names, name)
+	s.index[name] = true
+	s.runner.Add(program)
+	return nil
+}
+
+// Match runs the rules with env, in order, and returns the name and the
+// output of the first one which matches. The rules after it are not run.
+// It reports false if no rule matches, and stops at the first rule which
+// fails.
+func (s *RuleSet) Match(env interface{}) (match RuleMatch, ok bool, err error) {
+	s.runner.Each(env, func(i int, result vm.Result) bool {
+		switch {
+		case result.Err != nil:
+			err = fmt.Errorf("%v: %v", s.names[i], result.Err)
+		case result.Output != nil && result.Output != false:
+			match, ok = RuleMatch{Name: s.names[i], Value: result.Output}, true
+		default:
+			return true
+		}
+		return false
+	})
+	return match, ok, err
+}
@@ -0,0 +1,52 @@
+package vm
+
+import "fmt"
+
+// Result is the outcome of running a single program of a batch.
+type Result struct {
+	Output interface{}
+	Err    error
+}
+
+// BatchRunner runs several programs against the same env. A single VM,
+// and thus a single stack, is reused for all of them.
+type BatchRunner struct {
+	programs []*Program
+	vm       VM
+}
+
+func NewBatchRunner(programs ...*Program) *BatchRunner {
+	return &BatchRunner{programs: programs}
+}
+
+// Add appends programs to the batch.
+func (b *BatchRunner) Add(programs ...*Program) {
+	b.programs = append(b.programs, programs...)
+}
+
+// Run runs every program with given env, in order. A failing program does
+// not prevent the following ones from running.
+func (b *BatchRunner) Run(env interface{}) []Result {
+	results := make([]Result, len(b.programs))
+	b.Each(env, func(i int, result Result) bool {
+		results[i] = result
+		return true
+	})
+	return results
+}
+
+// Each runs the programs with given env, in order, and calls fn with the
+// index and the result of every program, until fn returns false.
+func (b *BatchRunner) Each(env interface{}, fn func(i int, result Result) bool) {
+	for i, program := range b.programs {
+		var result Result
+		if program == nil {
+			result.Err = fmt.Errorf("program is nil")
+		} else {
+			result.Output, result.Err = b.vm.Run(program, env)
+		}
+		if !fn(i, result) {
+			return
+		}
+	}
+}
@@ -0,0 +1,1894 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ebusto/expr/internal/version"
+)
+
+// Builtin is a function available in every expression, unless the env
+// defines a function with the same name.
+type Builtin struct {
+	Func   func(args ...interface{}) interface{}
+	Type   reflect.Type // type of the returned value
+	Impure bool         // may return different results for the same arguments
+	// Compares is set if the builtin compares its arguments, or the elements
+	// of its array arguments, so they must not be NaN with NoNaNComparison.
+	Compares bool
+
+	// Args are the kinds of the arguments, which the checker checks when
+	// their types are known. The last Optional ones may be omitted, and if
+	// Variadic, the last one may be repeated or omitted. Builtins with nil
+	// Args are not checked.
+	Args     []ArgKind
+	Optional int
+	Variadic bool
+
+	// Literal, if set, checks the argument of index i if it is a literal,
+	// so that an invalid one is a compile error.
+	Literal func(i int, value interface{}) error
+}
+
+// ArgKind is the kind of values an argument of a builtin accepts.
+type ArgKind int
+
+const (
+	ArgAny ArgKind = iota
+	ArgString
+	ArgNumber
+	ArgBool
+	ArgArray
+	ArgMap
+	ArgTime
+)
+
+func (k ArgKind) String() string {
+	switch k {
+	case ArgString:
+		return "string"
+	case ArgNumber:
+		return "number"
+	case ArgBool:
+		return "bool"
+	case ArgArray:
+		return "array"
+	case ArgMap:
+		return "map"
+	case ArgTime:
+		return "time"
+	}
+	return "any"
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	boolType       = reflect.TypeOf(true)
+	intType        = reflect.TypeOf(0)
+	floatType      = reflect.TypeOf(float64(0))
+	stringType     = reflect.TypeOf("")
+	bytesType      = reflect.TypeOf([]byte{})
+	interfaceType  = reflect.TypeOf((*interface{})(nil)).Elem()
+	arrayType      = reflect.TypeOf([]interface{}{})
+	uint64Type     = reflect.TypeOf(uint64(0))
+	jsonNumberType = reflect.TypeOf(json.Number(""))
+)
+
+var Builtins = map[string]*Builtin{
+	"now": {
+		Func: func(args ...interface{}) interface{} {
+			return time.Now()
+		},
+		Type:   timeType,
+		Args:   []ArgKind{},
+		Impure: true,
+	},
+	"date": {
+		Func: func(args ...interface{}) interface{} {
+			s := args[0].(string)
+			if len(args) > 1 {
+				t, err := time.Parse(args[1].(string), s)
+				if err != nil {
+					panic(fmt.Sprintf("cannot parse %q as date: %v", s, err))
+				}
+				return t
+			}
+			return parseDate(s)
+		},
+		Type:     timeType,
+		Args:     []ArgKind{ArgString, ArgString},
+		Optional: 1,
+	},
+	"format": {
+		Func: func(args ...interface{}) interface{} {
+			return args[0].(time.Time).Format(args[1].(string))
+		},
+		Type: stringType,
+		Args: []ArgKind{ArgTime, ArgString},
+	},
+	"duration": {
+		Func: func(args ...interface{}) interface{} {
+			s := args[0].(string)
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				panic(fmt.Sprintf("cannot parse %q as duration", s))
+			}
+			return d
+		},
+		Type: durationType,
+		Args: []ArgKind{ArgString},
+	},
+	"indexOf": {
+		Func: func(args ...interface{}) interface{} {
+			return indexOf("indexOf", args[0], args[1], false)
+		},
+		Type: intType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"lastIndexOf": {
+		Func: func(args ...interface{}) interface{} {
+			return indexOf("lastIndexOf", args[0], args[1], true)
+		},
+		Type: intType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"toArray": {
+		Func: func(args ...interface{}) interface{} {
+			return toArray(args[0])
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgAny},
+	},
+	"orDefault": {
+		Func: func(args ...interface{}) interface{} {
+			if isNil(args[0]) {
+				return args[1]
+			}
+			return args[0]
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"clamp": {
+		Func: func(args ...interface{}) interface{} {
+			x := numberArg("clamp", args[0])
+			lo := numberArg("clamp", args[1])
+			hi := numberArg("clamp", args[2])
+			if more(lo, hi).(bool) {
+				panic(fmt.Sprintf("clamp with lower bound %v greater than upper bound %v", lo, hi))
+			}
+			result := x
+			if less(x, lo).(bool) {
+				result = lo
+			} else if more(x, hi).(bool) {
+				result = hi
+			}
+			if isFloat(x) || isFloat(lo) || isFloat(hi) {
+				return toFloat64(result)
+			}
+			return result
+		},
+		Type:     interfaceType,
+		Compares: true,
+		Args:     []ArgKind{ArgNumber, ArgNumber, ArgNumber},
+	},
+	"diff": {
+		Func: func(args ...interface{}) interface{} {
+			d := subtract(numberArg("diff", args[0]), numberArg("diff", args[1]))
+			if less(d, 0).(bool) {
+				return negate(d)
+			}
+			return d
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgNumber, ArgNumber},
+	},
+	"fixed": {
+		Func: func(args ...interface{}) interface{} {
+			x := toFloat64(numberArg("fixed", args[0]))
+			precision := toInt(numberArg("fixed", args[1]))
+			if precision < 0 {
+				panic(fmt.Sprintf("negative precision %v in fixed", precision))
+			}
+			return strconv.FormatFloat(x, 'f', precision, 64)
+		},
+		Type: stringType,
+		Args: []ArgKind{ArgNumber, ArgNumber},
+	},
+	"inRange": {
+		Func: func(args ...interface{}) interface{} {
+			x := numberArg("inRange", args[0])
+			lo := numberArg("inRange", args[1])
+			hi := numberArg("inRange", args[2])
+			if len(args) > 3 && args[3].(bool) {
+				return less(lo, x).(bool) && less(x, hi).(bool)
+			}
+			return lessOrEqual(lo, x).(bool) && lessOrEqual(x, hi).(bool)
+		},
+		Type:     boolType,
+		Compares: true,
+		Args:     []ArgKind{ArgNumber, ArgNumber, ArgNumber, ArgBool},
+		Optional: 1,
+	},
+	"parseInt": {
+		Func: func(args ...interface{}) interface{} {
+			s := stringArg("parseInt", args[0])
+			base := 10
+			if len(args) > 1 {
+				base = toInt(args[1])
+				if err := validateBase(base); err != nil {
+					panic(err.Error())
+				}
+			}
+			i, err := strconv.ParseInt(strings.TrimSpace(s), base, 0)
+			if err != nil {
+				panic(fmt.Sprintf("cannot parse %q as int", s))
+			}
+			return int(i)
+		},
+		Type:     intType,
+		Args:     []ArgKind{ArgString, ArgNumber},
+		Optional: 1,
+		Literal: func(i int, value interface{}) error {
+			if i == 1 {
+				return validateBase(toInt(value))
+			}
+			return nil
+		},
+	},
+	"parseFloat": {
+		Func: func(args ...interface{}) interface{} {
+			s := stringArg("parseFloat", args[0])
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				panic(fmt.Sprintf("cannot parse %q as float", s))
+			}
+			return f
+		},
+		Type: floatType,
+		Args: []ArgKind{ArgString},
+	},
+	"intOr": {
+		Func: func(args ...interface{}) interface{} {
+			if x, ok := lenientNumber(args[0]); ok {
+				if f := toFloat64(x); !math.IsNaN(f) && !math.IsInf(f, 0) {
+					return toInt(x)
+				}
+			}
+			return args[1]
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"floatOr": {
+		Func: func(args ...interface{}) interface{} {
+			if x, ok := lenientNumber(args[0]); ok {
+				return toFloat64(x)
+			}
+			return args[1]
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"path": {
+		Func: func(args ...interface{}) interface{} {
+			value, _ := lookupPath(args[0], stringArg("path", args[1]))
+			return value
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny, ArgString},
+	},
+	"sprintf": {
+		Func: func(args ...interface{}) interface{} {
+			return fmt.Sprintf(args[0].(string), args[1:]...)
+		},
+		Type:     stringType,
+		Args:     []ArgKind{ArgString, ArgAny},
+		Variadic: true,
+	},
+	"require": {
+		// The compiler uses OpRequire, with the default message if there is
+		// none.
+		Func: func(args ...interface{}) interface{} {
+			message := interface{}("requirement failed")
+			if len(args) > 1 {
+				message = args[1]
+			}
+			return require(args[0], message)
+		},
+		Type:     boolType,
+		Args:     []ArgKind{ArgAny, ArgAny},
+		Optional: 1,
+	},
+	"try": {
+		// The compiler runs the first argument protected instead of calling
+		// Func, and the second one only if the first one fails.
+		Func: func(args ...interface{}) interface{} {
+			return args[0]
+		},
+		Type:     interfaceType,
+		Args:     []ArgKind{ArgAny, ArgAny},
+		Optional: 1,
+	},
+	"onError": {
+		// Same as try with a fallback.
+		Func: func(args ...interface{}) interface{} {
+			return args[0]
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"coalesce": {
+		// The compiler evaluates arguments lazily instead of calling Func.
+		Func:     coalesce,
+		Type:     interfaceType,
+		Args:     []ArgKind{ArgAny, ArgAny},
+		Variadic: true,
+	},
+	"ifNull": {
+		// Same as coalesce with two arguments.
+		Func: coalesce,
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"repeat": {
+		Func: func(args ...interface{}) interface{} {
+			n := countArg("repeat", args[1])
+			if n > MemoryBudget {
+				panic(ErrMemoryBudget)
+			}
+			out := make([]interface{}, n)
+			for i := range out {
+				out[i] = args[0]
+			}
+			return out
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgAny, ArgNumber},
+	},
+	"seq": {
+		Func: func(args ...interface{}) interface{} {
+			return seq(
+				toFloat64(numberArg("seq", args[0])),
+				toFloat64(numberArg("seq", args[1])),
+				toFloat64(numberArg("seq", args[2])),
+			)
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgNumber, ArgNumber, ArgNumber},
+	},
+	"fill": {
+		// fill(n, {closure}) is parsed as a builtin with a closure, which the
+		// compiler maps over the indexes returned by Func for n.
+		Func: func(args ...interface{}) interface{} {
+			n := countArg("fill", args[0])
+			if n > MemoryBudget {
+				panic(ErrMemoryBudget)
+			}
+			return makeRange(0, n-1)
+		},
+		Type: arrayType,
+	},
+	"var": {
+		// The compiler fetches the variable from env with OpFetchVar.
+		Func: func(args ...interface{}) interface{} {
+			panic("var cannot be called without env")
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgString},
+	},
+	"size": {
+		Func: func(args ...interface{}) interface{} {
+			if isNil(args[0]) {
+				return 0
+			}
+			v := reflect.ValueOf(args[0])
+			switch v.Kind() {
+			case reflect.Array, reflect.Slice, reflect.Map, reflect.String, reflect.Chan:
+				return v.Len()
+			}
+			panic(fmt.Sprintf("invalid argument for size (type %T)", args[0]))
+		},
+		Type: intType,
+		Args: []ArgKind{ArgAny},
+	},
+	"contains": {
+		Func: func(args ...interface{}) interface{} {
+			if s, ok := args[0].(string); ok {
+				return strings.Contains(s, stringArg("contains", args[1]))
+			}
+			return in(args[1], args[0])
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"startsWith": {
+		Func: func(args ...interface{}) interface{} {
+			return strings.HasPrefix(stringArg("startsWith", args[0]), stringArg("startsWith", args[1]))
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgString, ArgString},
+	},
+	"endsWith": {
+		Func: func(args ...interface{}) interface{} {
+			return strings.HasSuffix(stringArg("endsWith", args[0]), stringArg("endsWith", args[1]))
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgString, ArgString},
+	},
+	"padLeft": {
+		Func: func(args ...interface{}) interface{} {
+			s, padding := pad("padLeft", args)
+			return padding + s
+		},
+		Type:     stringType,
+		Args:     []ArgKind{ArgString, ArgNumber, ArgString},
+		Optional: 1,
+	},
+	"padRight": {
+		Func: func(args ...interface{}) interface{} {
+			s, padding := pad("padRight", args)
+			return s + padding
+		},
+		Type:     stringType,
+		Args:     []ArgKind{ArgString, ArgNumber, ArgString},
+		Optional: 1,
+	},
+	"truncate": {
+		Func: func(args ...interface{}) interface{} {
+			s := []rune(stringArg("truncate", args[0]))
+			n := countArg("truncate", args[1])
+			ellipsis := []rune("...")
+			if len(args) > 2 {
+				ellipsis = []rune(stringArg("truncate", args[2]))
+			}
+			if len(s) <= n {
+				return string(s)
+			}
+			if len(ellipsis) > n {
+				ellipsis = ellipsis[:n]
+			}
+			return string(s[:n-len(ellipsis)]) + string(ellipsis)
+		},
+		Type:     stringType,
+		Args:     []ArgKind{ArgString, ArgNumber, ArgString},
+		Optional: 1,
+	},
+	"at": {
+		Func: func(args ...interface{}) interface{} {
+			return at(args[0], args[1], args[2])
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny, ArgAny, ArgAny},
+	},
+	"union": {
+		Func: func(args ...interface{}) interface{} {
+			a, b := arrayArg("union", args[0]), arrayArg("union", args[1])
+			out := newSet(a, b)
+			for _, v := range a {
+				out.add(v)
+			}
+			for _, v := range b {
+				out.add(v)
+			}
+			return out.values
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgArray, ArgArray},
+	},
+	"intersect": {
+		Func: func(args ...interface{}) interface{} {
+			a, b := arrayArg("intersect", args[0]), arrayArg("intersect", args[1])
+			other := newSet(a, b)
+			for _, v := range b {
+				other.add(v)
+			}
+			out := newSet(a, b)
+			for _, v := range a {
+				if other.has(v) {
+					out.add(v)
+				}
+			}
+			return out.values
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgArray, ArgArray},
+	},
+	"difference": {
+		Func: func(args ...interface{}) interface{} {
+			a, b := arrayArg("difference", args[0]), arrayArg("difference", args[1])
+			other := newSet(a, b)
+			for _, v := range b {
+				other.add(v)
+			}
+			out := newSet(a, b)
+			for _, v := range a {
+				if !other.has(v) {
+					out.add(v)
+				}
+			}
+			return out.values
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgArray, ArgArray},
+	},
+	"zip": {
+		Func: func(args ...interface{}) interface{} {
+			a, b := arrayArg("zip", args[0]), arrayArg("zip", args[1])
+			size := len(a)
+			if len(b) < size {
+				size = len(b)
+			}
+			out := make([]interface{}, size)
+			for i := range out {
+				out[i] = []interface{}{a[i], b[i]}
+			}
+			return out
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgArray, ArgArray},
+	},
+	"enumerate": {
+		Func: func(args ...interface{}) interface{} {
+			array := arrayArg("enumerate", args[0])
+			out := make([]interface{}, len(array))
+			for i, v := range array {
+				out[i] = []interface{}{i, v}
+			}
+			return out
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgArray},
+	},
+	"reverse": {
+		Func: func(args ...interface{}) interface{} {
+			if s, ok := args[0].(string); ok {
+				runes := []rune(s)
+				for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+					runes[i], runes[j] = runes[j], runes[i]
+				}
+				return string(runes)
+			}
+			array := arrayArg("reverse", args[0])
+			out := make([]interface{}, len(array))
+			for i, v := range array {
+				out[len(out)-1-i] = v
+			}
+			return out
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny},
+	},
+	"take": {
+		Func: func(args ...interface{}) interface{} {
+			array := arrayArg("take", args[0])
+			n := countArg("take", args[1])
+			if n > len(array) {
+				n = len(array)
+			}
+			return append([]interface{}{}, array[:n]...)
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgArray, ArgNumber},
+	},
+	"skip": {
+		Func: func(args ...interface{}) interface{} {
+			array := arrayArg("skip", args[0])
+			n := countArg("skip", args[1])
+			if n > len(array) {
+				n = len(array)
+			}
+			return append([]interface{}{}, array[n:]...)
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgArray, ArgNumber},
+	},
+	"chunk": {
+		Func: func(args ...interface{}) interface{} {
+			array := arrayArg("chunk", args[0])
+			size := countArg("chunk", args[1])
+			if size == 0 {
+				panic("chunk size must be positive")
+			}
+			out := []interface{}{}
+			for i := 0; i < len(array); i += size {
+				end := i + size
+				if end > len(array) {
+					end = len(array)
+				}
+				out = append(out, append([]interface{}{}, array[i:end]...))
+			}
+			return out
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgArray, ArgNumber},
+	},
+	"isNaN": {
+		Func: func(args ...interface{}) interface{} {
+			return math.IsNaN(toFloat64(numberArg("isNaN", args[0])))
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgNumber},
+	},
+	"isInf": {
+		Func: func(args ...interface{}) interface{} {
+			return math.IsInf(toFloat64(numberArg("isInf", args[0])), 0)
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgNumber},
+	},
+	"finite": {
+		Func: func(args ...interface{}) interface{} {
+			x := numberArg("finite", args[0])
+			f := toFloat64(x)
+			if !math.IsNaN(f) && !math.IsInf(f, 0) {
+				return x
+			}
+			if len(args) > 1 {
+				return args[1]
+			}
+			panic(fmt.Sprintf("%v is not finite", x))
+		},
+		Type:     interfaceType,
+		Args:     []ArgKind{ArgNumber, ArgAny},
+		Optional: 1,
+	},
+	"versionCompare": {
+		Func: func(args ...interface{}) interface{} {
+			return version.Compare(version.From("versionCompare", args[0]), version.From("versionCompare", args[1]))
+		},
+		Type: intType,
+		Args: []ArgKind{ArgAny, ArgAny},
+	},
+	"isEmpty": {
+		Func: func(args ...interface{}) interface{} {
+			return isEmpty(args[0])
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny},
+	},
+	"isBlank": {
+		Func: func(args ...interface{}) interface{} {
+			if s, ok := args[0].(string); ok {
+				return strings.TrimSpace(s) == ""
+			}
+			return isEmpty(args[0])
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny},
+	},
+	"bool": {
+		Func: func(args ...interface{}) interface{} {
+			return truthy(args[0])
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny},
+	},
+	"isString": {
+		Func: func(args ...interface{}) interface{} {
+			return kindOf(args[0]) == reflect.String
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny},
+	},
+	"isNumber": {
+		Func: func(args ...interface{}) interface{} {
+			switch kindOf(args[0]) {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+				reflect.Float32, reflect.Float64:
+				return true
+			}
+			return false
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny},
+	},
+	"isBool": {
+		Func: func(args ...interface{}) interface{} {
+			return kindOf(args[0]) == reflect.Bool
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny},
+	},
+	"isArray": {
+		Func: func(args ...interface{}) interface{} {
+			k := kindOf(args[0])
+			return k == reflect.Slice || k == reflect.Array
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny},
+	},
+	"isMap": {
+		Func: func(args ...interface{}) interface{} {
+			return kindOf(args[0]) == reflect.Map
+		},
+		Type: boolType,
+		Args: []ArgKind{ArgAny},
+	},
+	"base64": {
+		Func: func(args ...interface{}) interface{} {
+			return base64.StdEncoding.EncodeToString(bytesArg("base64", args[0]))
+		},
+		Type: stringType,
+		Args: []ArgKind{ArgAny},
+	},
+	"base64decode": {
+		Func: func(args ...interface{}) interface{} {
+			s := stringArg("base64decode", args[0])
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				offset := len(s)
+				if e, ok := err.(base64.CorruptInputError); ok {
+					offset = int(e)
+				}
+				panic(decodeError("base64decode", s, offset))
+			}
+			return b
+		},
+		Type: bytesType,
+		Args: []ArgKind{ArgString},
+	},
+	"hex": {
+		Func: func(args ...interface{}) interface{} {
+			return hex.EncodeToString(bytesArg("hex", args[0]))
+		},
+		Type: stringType,
+		Args: []ArgKind{ArgAny},
+	},
+	"hexdecode": {
+		Func: func(args ...interface{}) interface{} {
+			s := stringArg("hexdecode", args[0])
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				offset := strings.IndexFunc(s, func(r rune) bool {
+					return !strings.ContainsRune("0123456789abcdefABCDEF", r)
+				})
+				if offset < 0 {
+					offset = len(s)
+				}
+				panic(decodeError("hexdecode", s, offset))
+			}
+			return b
+		},
+		Type: bytesType,
+		Args: []ArgKind{ArgString},
+	},
+	"fromJSON": {
+		Func: func(args ...interface{}) interface{} {
+			var v interface{}
+			if err := json.Unmarshal(bytesArg("fromJSON", args[0]), &v); err != nil {
+				panic(fmt.Sprintf("cannot parse JSON in fromJSON: %v", err))
+			}
+			return v
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny},
+	},
+	"fromJSONNumber": {
+		Func: func(args ...interface{}) interface{} {
+			decoder := json.NewDecoder(bytes.NewReader(bytesArg("fromJSONNumber", args[0])))
+			decoder.UseNumber()
+			var v interface{}
+			err := decoder.Decode(&v)
+			if err == nil && decoder.More() {
+				err = fmt.Errorf("invalid character after top-level value")
+			}
+			if err != nil {
+				panic(fmt.Sprintf("cannot parse JSON in fromJSONNumber: %v", err))
+			}
+			return v
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgAny},
+	},
+	"toJSON": {
+		Func: func(args ...interface{}) interface{} {
+			b, err := json.Marshal(args[0])
+			if err != nil {
+				panic(fmt.Sprintf("cannot serialize %T in toJSON: %v", args[0], err))
+			}
+			return string(b)
+		},
+		Type: stringType,
+		Args: []ArgKind{ArgAny},
+	},
+	"tag": {
+		Func: func(args ...interface{}) interface{} {
+			t := reflect.TypeOf(args[0])
+			for t != nil && t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t == nil || t.Kind() != reflect.Struct {
+				panic(fmt.Sprintf("cannot use %T as struct in tag", args[0]))
+			}
+			name := stringArg("tag", args[1])
+			field, ok := t.FieldByName(name)
+			if !ok {
+				panic(fmt.Sprintf("%v has no field %v", t, name))
+			}
+			return field.Tag.Get(stringArg("tag", args[2]))
+		},
+		Type: stringType,
+		Args: []ArgKind{ArgAny, ArgString, ArgString},
+	},
+	"hash": {
+		Func: func(args ...interface{}) interface{} {
+			h := fnv.New64a()
+			h.Write(hashEncode(nil, reflect.ValueOf(args[0])))
+			return h.Sum64()
+		},
+		Type: uint64Type,
+		Args: []ArgKind{ArgAny},
+	},
+	"min": {
+		Func: func(args ...interface{}) interface{} {
+			return extremum("min", less, args)
+		},
+		Type:     interfaceType,
+		Args:     []ArgKind{ArgAny, ArgAny},
+		Variadic: true,
+		Compares: true,
+	},
+	"max": {
+		Func: func(args ...interface{}) interface{} {
+			return extremum("max", more, args)
+		},
+		Type:     interfaceType,
+		Args:     []ArgKind{ArgAny, ArgAny},
+		Variadic: true,
+		Compares: true,
+	},
+	"median": {
+		Func: func(args ...interface{}) interface{} {
+			return percentile("median", args[0], 50)
+		},
+		Type:     floatType,
+		Compares: true,
+		Args:     []ArgKind{ArgArray},
+	},
+	"percentile": {
+		Func: func(args ...interface{}) interface{} {
+			p := toFloat64(numberArg("percentile", args[1]))
+			if p < 0 || p > 100 || math.IsNaN(p) {
+				panic(fmt.Sprintf("percentile %v out of range [0, 100]", p))
+			}
+			return percentile("percentile", args[0], p)
+		},
+		Type:     floatType,
+		Compares: true,
+		Args:     []ArgKind{ArgArray, ArgNumber},
+	},
+	"humanizeBytes": {
+		Func: func(args ...interface{}) interface{} {
+			base := 1024
+			if len(args) > 1 {
+				base = toInt(numberArg("humanizeBytes", args[1]))
+				if base != 1000 && base != 1024 {
+					panic(fmt.Sprintf("invalid base %v in humanizeBytes", base))
+				}
+			}
+			x := toFloat64(numberArg("humanizeBytes", args[0]))
+			s, unit := humanize(x, float64(base), byteUnits)
+			return s + " " + unit
+		},
+		Type:     stringType,
+		Args:     []ArgKind{ArgNumber, ArgNumber},
+		Optional: 1,
+	},
+	"formatNumber": {
+		Func: func(args ...interface{}) interface{} {
+			pattern := "#,##0.###"
+			if len(args) > 1 {
+				pattern = stringArg("formatNumber", args[1])
+			}
+			p, err := parseNumberPattern(pattern)
+			if err != nil {
+				panic(err.Error())
+			}
+			return p.format(toFloat64(numberArg("formatNumber", args[0])))
+		},
+		Type:     stringType,
+		Args:     []ArgKind{ArgNumber, ArgString},
+		Optional: 1,
+		Literal: func(i int, value interface{}) error {
+			if i == 1 {
+				return ValidateNumberPattern(value.(string))
+			}
+			return nil
+		},
+	},
+	"humanizeNumber": {
+		Func: func(args ...interface{}) interface{} {
+			x := toFloat64(numberArg("humanizeNumber", args[0]))
+			s, unit := humanize(x, 1000, numberUnits)
+			return s + unit
+		},
+		Type: stringType,
+		Args: []ArgKind{ArgNumber},
+	},
+	"merge": {
+		Func: func(args ...interface{}) interface{} {
+			return merge(args)
+		},
+		Type:     interfaceType,
+		Args:     []ArgKind{ArgMap},
+		Variadic: true,
+	},
+	"pick": {
+		Func: func(args ...interface{}) interface{} {
+			return pick("pick", args[0], args[1:], true)
+		},
+		Type:     interfaceType,
+		Args:     []ArgKind{ArgMap, ArgAny},
+		Variadic: true,
+	},
+	"omit": {
+		Func: func(args ...interface{}) interface{} {
+			return pick("omit", args[0], args[1:], false)
+		},
+		Type:     interfaceType,
+		Args:     []ArgKind{ArgMap, ArgAny},
+		Variadic: true,
+	},
+	"entries": {
+		Func: func(args ...interface{}) interface{} {
+			if args[0] == nil {
+				return []interface{}{}
+			}
+			v := mapArg("entries", args[0])
+			keys := v.MapKeys()
+			sortKeys(keys)
+			out := make([]interface{}, len(keys))
+			for i, k := range keys {
+				out[i] = []interface{}{k.Interface(), v.MapIndex(k).Interface()}
+			}
+			return out
+		},
+		Type: arrayType,
+		Args: []ArgKind{ArgMap},
+	},
+	"toMap": {
+		Func: func(args ...interface{}) interface{} {
+			return fromPairs("toMap", args[0])
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgArray},
+	},
+	"fromPairs": {
+		Func: func(args ...interface{}) interface{} {
+			return fromPairs("fromPairs", args[0])
+		},
+		Type: interfaceType,
+		Args: []ArgKind{ArgArray},
+	},
+}
+
+// apply runs programs, which call builtins, so it is added on init. Compiled
+// programs call it with OpApply instead, which tracks the depth.
+func init() {
+	Builtins["apply"] = &Builtin{
+		Func: func(args ...interface{}) interface{} {
+			var env interface{}
+			if len(args) > 1 {
+				env = args[1]
+			}
+			out, err := (&VM{}).apply(args[0], env)
+			if err != nil {
+				panic(err)
+			}
+			return out
+		},
+		Type:     interfaceType,
+		Impure:   true,
+		Args:     []ArgKind{ArgAny, ArgAny},
+		Optional: 1,
+	}
+}
+
+// merge returns a new map with the items of all the maps, where later maps
+// override the keys of earlier ones. The map has the type of the maps if
+// they all have the same, and otherwise elements of interface{}, with string
+// keys if all the keys are strings.
+func merge(args []interface{}) interface{} {
+	var maps []reflect.Value
+	same, stringKeys := true, true
+	for _, arg := range args {
+		if arg == nil {
+			continue
+		}
+		v := mapArg("merge", arg)
+		if len(maps) > 0 && v.Type() != maps[0].Type() {
+			same = false
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			stringKeys = false
+		}
+		maps = append(maps, v)
+	}
+
+	var t reflect.Type
+	switch {
+	case len(maps) > 0 && same:
+		t = maps[0].Type()
+	case stringKeys:
+		t = reflect.TypeOf(map[string]interface{}{})
+	default:
+		t = reflect.TypeOf(map[interface{}]interface{}{})
+	}
+	out := reflect.MakeMap(t)
+	for _, m := range maps {
+		iter := m.MapRange()
+		for iter.Next() {
+			key, value := iter.Key(), iter.Value()
+			if t.Key().Kind() == reflect.String {
+				key = key.Convert(t.Key())
+			}
+			out.SetMapIndex(key, value)
+		}
+	}
+	return out.Interface()
+}
+
+// pick returns a new map with the items of the map whose keys are listed,
+// or are not listed.
+func pick(builtin string, from interface{}, keys []interface{}, listed bool) interface{} {
+	if from == nil {
+		return map[string]interface{}{}
+	}
+	v := mapArg(builtin, from)
+	out := reflect.MakeMap(v.Type())
+	if listed {
+		for _, k := range keys {
+			if key, ok := mapKey(k, v.Type().Key()); ok {
+				if value := v.MapIndex(key); value.IsValid() {
+					out.SetMapIndex(key, value)
+				}
+			}
+		}
+		return out.Interface()
+	}
+
+	iter := v.MapRange()
+	for iter.Next() {
+		omitted := false
+		for _, k := range keys {
+			if key, ok := mapKey(k, v.Type().Key()); ok && key.Interface() == iter.Key().Interface() {
+				omitted = true
+				break
+			}
+		}
+		if !omitted {
+			out.SetMapIndex(iter.Key(), iter.Value())
+		}
+	}
+	return out.Interface()
+}
+
+// sortKeys sorts the keys of a map, so that the order does not depend on
+// the map. Strings and numbers are sorted by value if the keys are all
+// strings or all numbers. Otherwise keys are sorted by their formatting with
+// %v, and then by type name.
+func sortKeys(keys []reflect.Value) {
+	strs := make([]string, len(keys))
+	nums := make([]float64, len(keys))
+	isString, isNumber := true, true
+	for i, k := range keys {
+		if k.Kind() == reflect.Interface {
+			k = k.Elem()
+		}
+		switch k.Kind() {
+		case reflect.String:
+			strs[i], isNumber = k.String(), false
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			nums[i], isString = float64(k.Int()), false
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			nums[i], isString = float64(k.Uint()), false
+		case reflect.Float32, reflect.Float64:
+			nums[i], isString = k.Float(), false
+		default:
+			isString, isNumber = false, false
+		}
+	}
+	if !isString && !isNumber {
+		for i, k := range keys {
+			strs[i] = fmt.Sprintf("%v\x00%T", k.Interface(), k.Interface())
+		}
+		isString = true
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if isString {
+			return strs[order[i]] < strs[order[j]]
+		}
+		return nums[order[i]] < nums[order[j]]
+	})
+	sorted := make([]reflect.Value, len(keys))
+	for i, j := range order {
+		sorted[i] = keys[j]
+	}
+	copy(keys, sorted)
+}
+
+// mapKey converts k to a key of type t, if it is of the same kind.
+func mapKey(k interface{}, t reflect.Type) (reflect.Value, bool) {
+	key := reflect.ValueOf(k)
+	if !key.IsValid() {
+		return key, false
+	}
+	if key.Type().AssignableTo(t) {
+		return key, true
+	}
+	if key.Kind() == t.Kind() {
+		return key.Convert(t), true
+	}
+	return key, false
+}
+
+// mapArg returns the argument of the builtin, which must be a map or a
+// pointer to one.
+func mapArg(builtin string, arg interface{}) reflect.Value {
+	v := reflect.ValueOf(arg)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Map {
+		panic(fmt.Sprintf("cannot use %T as map in %v", arg, builtin))
+	}
+	return v
+}
+
+var (
+	byteUnits   = []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
+	numberUnits = []string{"", "K", "M", "B", "T"}
+)
+
+// humanize divides x by base until it is less than base, or there are no
+// more units, and returns it with one decimal, if any, and its unit.
+func humanize(x, base float64, units []string) (string, string) {
+	sign := ""
+	if x < 0 {
+		sign = "-"
+		x = -x
+	}
+	i := 0
+	for x >= base && i < len(units)-1 {
+		x /= base
+		i++
+	}
+	// 1023.96 B is 1 KB, rather than 1024 B.
+	if math.Round(x*10)/10 >= base && i < len(units)-1 {
+		x /= base
+		i++
+	}
+	s := strings.TrimSuffix(strconv.FormatFloat(x, 'f', 1, 64), ".0")
+	return sign + s, units[i]
+}
+
+// numberPattern is a pattern of formatNumber, such as "#,##0.00".
+type numberPattern struct {
+	minInt  int // digits of the integer part, padded with zeros
+	group   int // digits between separators, 0 for none
+	minFrac int // digits of the fraction, padded with zeros
+	maxFrac int // digits of the fraction, after rounding
+}
+
+// ValidateNumberPattern reports an error if pattern is not a valid pattern
+// of formatNumber. The pattern is made of an integer part and an optional
+// fraction after ".". In the integer part, "0" is a digit always shown, "#"
+// one shown if not a leading zero and "," a thousands separator, repeated
+// every as many digits as follow the last ",". In the fraction, "0" is a
+// digit always shown and "#" one shown if not a trailing zero.
+func ValidateNumberPattern(pattern string) error {
+	_, err := parseNumberPattern(pattern)
+	return err
+}
+
+func parseNumberPattern(pattern string) (numberPattern, error) {
+	var p numberPattern
+	invalid := func(reason string) (numberPattern, error) {
+		return p, fmt.Errorf("invalid pattern %q in formatNumber: %v", pattern, reason)
+	}
+
+	integer, fraction := pattern, ""
+	if i := strings.IndexByte(pattern, '.'); i >= 0 {
+		integer, fraction = pattern[:i], pattern[i+1:]
+	}
+	if integer == "" {
+		return invalid("no integer digits")
+	}
+	digits, separator := 0, -1
+	for i, r := range integer {
+		switch r {
+		case '#':
+			if p.minInt > 0 {
+				return invalid("# after 0")
+			}
+			digits++
+		case '0':
+			p.minInt++
+			digits++
+		case ',':
+			separator = digits
+		default:
+			return invalid(fmt.Sprintf("unknown character %q at %v", r, i))
+		}
+	}
+	if separator >= 0 {
+		p.group = digits - separator
+		if p.group == 0 {
+			return invalid(", at the end of the integer part")
+		}
+	}
+	for i, r := range fraction {
+		switch r {
+		case '0':
+			if p.maxFrac > p.minFrac {
+				return invalid("0 after # in the fraction")
+			}
+			p.minFrac++
+		case '#':
+		default:
+			return invalid(fmt.Sprintf("unknown character %q at %v", r, len(integer)+1+i))
+		}
+		p.maxFrac++
+	}
+	return p, nil
+}
+
+func (p numberPattern) format(x float64) string {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	s := strconv.FormatFloat(math.Abs(x), 'f', p.maxFrac, 64)
+	integer, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		integer, fraction = s[:i], s[i+1:]
+	}
+	for len(fraction) > p.minFrac && fraction[len(fraction)-1] == '0' {
+		fraction = fraction[:len(fraction)-1]
+	}
+	negative := x < 0 && strings.Trim(integer+fraction, "0") != ""
+
+	integer = strings.TrimLeft(integer, "0")
+	for len(integer) < p.minInt || integer == "" {
+		integer = "0" + integer
+	}
+	if p.group > 0 {
+		var b strings.Builder
+		for i, r := range integer {
+			if i > 0 && (len(integer)-i)%p.group == 0 {
+				b.WriteByte(',')
+			}
+			b.WriteRune(r)
+		}
+		integer = b.String()
+	}
+
+	if negative {
+		integer = "-" + integer
+	}
+	if fraction == "" {
+		return integer
+	}
+	return integer + "." + fraction
+}
+
+// extremum returns the argument for which before is true against all of the
+// other arguments, or the element of the only argument, if it is an array.
+// Arguments are compared as with < and >, so they may be numbers of any
+// type, strings, times or values implementing Comparer.
+func extremum(builtin string, before func(a, b interface{}) interface{}, args []interface{}) interface{} {
+	if len(args) == 1 {
+		switch reflect.ValueOf(args[0]).Kind() {
+		case reflect.Array, reflect.Slice:
+			args = arrayArg(builtin, args[0])
+			if len(args) == 0 {
+				panic(fmt.Sprintf("%v of empty array", builtin))
+			}
+		}
+	}
+	result := args[0]
+	for _, arg := range args[1:] {
+		if before(arg, result).(bool) {
+			result = arg
+		}
+	}
+	return result
+}
+
+// pad returns the string of padLeft or padRight, and the padding which
+// makes it as wide as the second argument in runes. The padding repeats the
+// third argument, a space by default, and is cut to the exact width.
+func pad(builtin string, args []interface{}) (string, string) {
+	s := stringArg(builtin, args[0])
+	width := countArg(builtin, args[1])
+	fill := []rune(" ")
+	if len(args) > 2 {
+		fill = []rune(stringArg(builtin, args[2]))
+		if len(fill) == 0 {
+			panic(fmt.Sprintf("empty padding in %v", builtin))
+		}
+	}
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return s, ""
+	}
+	if n > MemoryBudget {
+		panic(ErrMemoryBudget)
+	}
+	padding := make([]rune, n)
+	for i := range padding {
+		padding[i] = fill[i%len(fill)]
+	}
+	return s, string(padding)
+}
+
+// hashEncode appends the canonical encoding of v to b, which hash() hashes.
+// Numbers which are equal, such as 1 and 1.0, have the same encoding, and
+// the pairs of maps are sorted by the encoding of their keys.
+func hashEncode(b []byte, v reflect.Value) []byte {
+	for v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.IsValid() {
+		switch v.Type() {
+		case timeType:
+			return appendUint64(append(b, 't'), uint64(v.Interface().(time.Time).UnixNano()))
+		case jsonNumberType:
+			return hashEncode(b, reflect.ValueOf(jsonNumber(json.Number(v.String()))))
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		return append(b, 'n')
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 'T')
+		}
+		return append(b, 'F')
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendUint64(append(b, 'i'), uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if x := v.Uint(); x > math.MaxInt64 {
+			return appendUint64(append(b, 'u'), x)
+		}
+		return appendUint64(append(b, 'i'), v.Uint())
+	case reflect.Float32, reflect.Float64:
+		x := v.Float()
+		if x == math.Trunc(x) && x >= math.MinInt64 && x < math.MaxInt64 {
+			return appendUint64(append(b, 'i'), uint64(int64(x)))
+		}
+		return appendUint64(append(b, 'f'), math.Float64bits(x))
+	case reflect.String:
+		return append(appendUint64(append(b, 's'), uint64(v.Len())), v.String()...)
+	case reflect.Array, reflect.Slice:
+		b = appendUint64(append(b, 'a'), uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			b = hashEncode(b, v.Index(i))
+		}
+		return b
+	case reflect.Map:
+		pairs := make([][]byte, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			pair := hashEncode(nil, key)
+			pairs = append(pairs, hashEncode(pair, v.MapIndex(key)))
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			return string(pairs[i]) < string(pairs[j])
+		})
+		b = appendUint64(append(b, 'm'), uint64(len(pairs)))
+		for _, pair := range pairs {
+			b = append(b, pair...)
+		}
+		return b
+	}
+	panic(fmt.Sprintf("cannot hash %v", v.Type()))
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	return append(b, buf[:]...)
+}
+
+// fromPairs returns the map of the [key, value] pairs of the array, where
+// the last pair of a key wins. The map is a map[string]interface{} if all
+// the keys are strings, and a map[interface{}]interface{} otherwise.
+func fromPairs(builtin string, arg interface{}) interface{} {
+	pairs := arrayArg(builtin, arg)
+	keys := make([]interface{}, len(pairs))
+	values := make([]interface{}, len(pairs))
+	stringKeys := true
+	for i, p := range pairs {
+		pair := reflect.ValueOf(p)
+		if !isSequence(pair) || pair.Len() != 2 {
+			panic(fmt.Sprintf("cannot use %v as [key, value] pair in %v", p, builtin))
+		}
+		keys[i], values[i] = pair.Index(0).Interface(), pair.Index(1).Interface()
+		if _, ok := keys[i].(string); !ok {
+			stringKeys = false
+		}
+	}
+
+	if stringKeys {
+		m := make(map[string]interface{}, len(pairs))
+		for i, key := range keys {
+			m[key.(string)] = values[i]
+		}
+		return m
+	}
+	m := make(map[interface{}]interface{}, len(pairs))
+	for i, key := range keys {
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			panic(fmt.Sprintf("cannot use %T as key in %v", key, builtin))
+		}
+		m[key] = values[i]
+	}
+	return m
+}
+
+// percentile returns the p-th percentile of the numbers of the array,
+// interpolating linearly between the closest ranks.
+func percentile(builtin string, arg interface{}, p float64) float64 {
+	array := arrayArg(builtin, arg)
+	if len(array) == 0 {
+		panic(fmt.Sprintf("%v of empty array", builtin))
+	}
+	xs := make([]float64, len(array))
+	for i, x := range array {
+		xs[i] = toFloat64(numberArg(builtin, x))
+	}
+	sort.Float64s(xs)
+
+	rank := p / 100 * float64(len(xs)-1)
+	i := int(rank)
+	if i == len(xs)-1 {
+		return xs[i]
+	}
+	return xs[i] + (rank-float64(i))*(xs[i+1]-xs[i])
+}
+
+// set holds distinct values by equal(), in the order they were added.
+type set struct {
+	keys   map[interface{}]bool // nil, unless a map agrees with equal()
+	values []interface{}
+}
+
+// newSet returns a set for the values of the arrays. It uses a map if all
+// of them are plain strings or all are plain ints, and otherwise compares
+// every pair with equal(), e.g. as 1 equals 1.0.
+func newSet(arrays ...[]interface{}) *set {
+	s := &set{values: []interface{}{}}
+	var kind reflect.Type
+	for _, array := range arrays {
+		for _, v := range array {
+			t := reflect.TypeOf(v)
+			if kind == nil {
+				kind = t
+			}
+			if t != kind {
+				return s
+			}
+		}
+	}
+	if kind == stringType || kind == intType {
+		s.keys = make(map[interface{}]bool)
+	}
+	return s
+}
+
+func (s *set) has(v interface{}) bool {
+	if s.keys != nil {
+		return s.keys[v]
+	}
+	for _, x := range s.values {
+		if equal(x, v).(bool) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *set) add(v interface{}) {
+	if s.has(v) {
+		return
+	}
+	s.values = append(s.values, v)
+	if s.keys != nil {
+		s.keys[v] = true
+	}
+}
+
+// at returns the element of an array at index i, counting from the end if
+// i is negative, or the value of a map at key i. It returns otherwise if
+// there is no such element.
+func at(from, i, otherwise interface{}) interface{} {
+	v := reflect.ValueOf(from)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		return otherwise
+
+	case reflect.Array, reflect.Slice:
+		index := toInt(i)
+		if index < 0 {
+			index += v.Len()
+		}
+		if index < 0 || index >= v.Len() {
+			return otherwise
+		}
+		return normalize(v.Index(index))
+
+	case reflect.Map:
+		key := reflect.ValueOf(i)
+		if !key.IsValid() || !key.Type().AssignableTo(v.Type().Key()) {
+			return otherwise
+		}
+		value := v.MapIndex(key)
+		if !value.IsValid() {
+			return otherwise
+		}
+		return normalize(value)
+	}
+
+	panic(fmt.Sprintf("cannot use %T with at", from))
+}
+
+// indexOf returns the byte index of the substring in a string, or the index
+// of the element in an array, or -1 if there is none.
+func indexOf(builtin string, from, x interface{}, last bool) int {
+	if s, ok := from.(string); ok {
+		if last {
+			return strings.LastIndex(s, stringArg(builtin, x))
+		}
+		return strings.Index(s, stringArg(builtin, x))
+	}
+
+	v := reflect.ValueOf(from)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return -1
+	case reflect.Array, reflect.Slice:
+	default:
+		panic(fmt.Sprintf("cannot use %T with %v", from, builtin))
+	}
+	for i := 0; i < v.Len(); i++ {
+		j := i
+		if last {
+			j = v.Len() - 1 - i
+		}
+		value := v.Index(j)
+		if value.CanInterface() && equal(value.Interface(), x).(bool) {
+			return j
+		}
+	}
+	return -1
+}
+
+// toArray returns the elements of an array, no elements for nil, or any
+// other value as the only element. Strings and byte slices are not split.
+func toArray(x interface{}) []interface{} {
+	switch x := x.(type) {
+	case nil:
+		return []interface{}{}
+	case []interface{}:
+		return x
+	case []byte:
+		return []interface{}{x}
+	}
+
+	v := reflect.ValueOf(x)
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice:
+		array := make([]interface{}, v.Len())
+		for i := range array {
+			array[i] = v.Index(i).Interface()
+		}
+		return array
+	}
+	return []interface{}{x}
+}
+
+// lookupPath resolves a path such as "a.b.0.c" against maps, structs and
+// arrays, where numeric segments index arrays. It reports false if any of
+// the segments is missing.
+func lookupPath(from interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return from, true
+	}
+	for _, segment := range strings.Split(path, ".") {
+		if from == nil {
+			return nil, false
+		}
+		if fetcher, ok := from.(Fetcher); ok {
+			from = fetcher.Fetch(segment)
+			if from == nil {
+				return nil, false
+			}
+			continue
+		}
+
+		v := reflect.ValueOf(from)
+		if v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		var value reflect.Value
+		switch v.Kind() {
+		case reflect.Map:
+			key := reflect.ValueOf(segment)
+			if v.Type().Key().Kind() != reflect.String {
+				i, err := strconv.Atoi(segment)
+				if err != nil {
+					return nil, false
+				}
+				key = reflect.ValueOf(i)
+			}
+			if !key.Type().ConvertibleTo(v.Type().Key()) {
+				return nil, false
+			}
+			value = v.MapIndex(key.Convert(v.Type().Key()))
+		case reflect.Struct:
+			if field, ok := v.Type().FieldByName(segment); ok && field.PkgPath == "" {
+				value = v.FieldByIndex(field.Index)
+			}
+		case reflect.Array, reflect.Slice:
+			i, err := strconv.Atoi(segment)
+			if err == nil && i >= 0 && i < v.Len() {
+				value = v.Index(i)
+			}
+		}
+		if !value.IsValid() {
+			return nil, false
+		}
+		from = normalize(value)
+	}
+	return from, true
+}
+
+// arrayArg returns the elements of the argument of the builtin, which must
+// be an array or nil.
+func arrayArg(builtin string, arg interface{}) []interface{} {
+	if arg == nil {
+		return nil
+	}
+	if array, ok := arg.([]interface{}); ok {
+		return array
+	}
+	v := reflect.ValueOf(arg)
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice:
+		array := make([]interface{}, v.Len())
+		for i := range array {
+			array[i] = v.Index(i).Interface()
+		}
+		return array
+	}
+	panic(fmt.Sprintf("cannot use %T as array in %v", arg, builtin))
+}
+
+// seq returns the floats from start to stop, included, by step. Elements are
+// computed as start + i*step, so errors do not accumulate, and a last element
+// within rounding of stop is stop.
+func seq(start, stop, step float64) []interface{} {
+	if step == 0 || math.IsNaN(step) || math.IsInf(step, 0) {
+		panic(fmt.Sprintf("invalid step %v in seq", step))
+	}
+	if math.IsNaN(start) || math.IsInf(start, 0) || math.IsNaN(stop) || math.IsInf(stop, 0) {
+		panic(fmt.Sprintf("invalid range %v to %v in seq", start, stop))
+	}
+	// span is the number of steps to stop, which may be off by rounding.
+	span := (stop - start) / step
+	if span < 0 {
+		return []interface{}{}
+	}
+	if span >= float64(MemoryBudget) {
+		panic(ErrMemoryBudget)
+	}
+	n := int(math.Floor(span+1e-9)) + 1
+	out := make([]interface{}, n)
+	for i := range out {
+		x := start + float64(i)*step
+		if (step > 0 && x > stop) || (step < 0 && x < stop) {
+			x = stop
+		}
+		out[i] = x
+	}
+	return out
+}
+
+// countArg returns the argument of the builtin, which must be a number
+// which is not negative.
+func countArg(builtin string, arg interface{}) int {
+	n := toInt(numberArg(builtin, arg))
+	if n < 0 {
+		panic(fmt.Sprintf("negative count %v in %v", n, builtin))
+	}
+	return n
+}
+
+// numberArg returns the argument of the builtin, which must be a number.
+func numberArg(builtin string, arg interface{}) interface{} {
+	if isNumber(arg) {
+		return arg
+	}
+	panic(fmt.Sprintf("cannot use %T as number in %v", arg, builtin))
+}
+
+// lenientNumber returns x if it is a number, or the number held by x if it
+// is a json.Number or a string, as an int64 or a float64.
+func lenientNumber(x interface{}) (interface{}, bool) {
+	switch kindOf(x) {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return x, true
+	}
+	switch n := x.(type) {
+	case json.Number:
+		x = string(n)
+	case string:
+	default:
+		return x, false
+	}
+	s := strings.TrimSpace(x.(string))
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	return x, false
+}
+
+// isEmpty reports whether x is nil, or an empty string, array, map or
+// channel. Numbers, bools and other values are never empty.
+func isEmpty(x interface{}) bool {
+	if isNil(x) {
+		return true
+	}
+	v := reflect.ValueOf(x)
+	switch v.Kind() {
+	case reflect.String, reflect.Array, reflect.Slice, reflect.Map, reflect.Chan:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// truthy reports whether x is true, a number other than zero or NaN, or a
+// value which is not empty. Strings are not parsed, so "false" and "0" are
+// true.
+func truthy(x interface{}) bool {
+	switch x := x.(type) {
+	case bool:
+		return x
+	case json.Number:
+		f, err := x.Float64()
+		return err != nil || f != 0
+	}
+	if isEmpty(x) {
+		return false
+	}
+	v := reflect.ValueOf(x)
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() != 0
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		return f != 0 && !math.IsNaN(f)
+	}
+	return true
+}
+
+// kindOf returns the kind of x, or reflect.Invalid for nil.
+func kindOf(x interface{}) reflect.Kind {
+	if x == nil {
+		return reflect.Invalid
+	}
+	return reflect.TypeOf(x).Kind()
+}
+
+func isFloat(x interface{}) bool {
+	switch x.(type) {
+	case float32, float64:
+		return true
+	}
+	return false
+}
+
+// coalesce returns the first argument which is not nil.
+func coalesce(args ...interface{}) interface{} {
+	for _, arg := range args {
+		if !isNil(arg) {
+			return arg
+		}
+	}
+	return nil
+}
+
+// stringArg returns the argument of the builtin, which must be a string.
+func stringArg(builtin string, arg interface{}) string {
+	s, ok := arg.(string)
+	if !ok {
+		panic(fmt.Sprintf("cannot use %T as string in %v", arg, builtin))
+	}
+	return s
+}
+
+// bytesArg returns the argument of the builtin, which must be a []byte or a
+// string, whose UTF-8 bytes are returned.
+func bytesArg(builtin string, arg interface{}) []byte {
+	switch x := arg.(type) {
+	case []byte:
+		return x
+	case string:
+		return []byte(x)
+	}
+	panic(fmt.Sprintf("cannot use %T as bytes in %v", arg, builtin))
+}
+
+// validateBase reports an error if base is not a base of parseInt: 0, to
+// infer it from the prefix of the string, or 2 to 36.
+func validateBase(base int) error {
+	if base != 0 && (base < 2 || base > 36) {
+		return fmt.Errorf("invalid base %v in parseInt", base)
+	}
+	return nil
+}
+
+// decodeError describes invalid input of a decoding builtin by the offset of
+// the invalid data, leaving out the input, which may be a secret.
+func decodeError(builtin string, s string, offset int) string {
+	if offset >= len(s) {
+		return fmt.Sprintf("cannot decode input of length %v in %v: unexpected end of input", len(s), builtin)
+	}
+	return fmt.Sprintf("cannot decode input of length %v in %v: invalid data at offset %v", len(s), builtin, offset)
+}
+
+// dateLayouts are tried in order by date() when no layout is given.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+}
+
+func parseDate(s string) time.Time {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	panic(fmt.Sprintf("cannot parse %q as date", s))
+}
@@ -0,0 +1,47 @@
+package vm
+
+import "fmt"
+
+// RuntimeError describes a panic recovered while running a program, along
+// with the instruction which caused it. The ip and operand match the ones
+// printed by Program.Disassemble.
+type RuntimeError struct {
+	Message string
+	Opcode  byte
+	Name    string      // opcode name, e.g. OpFetch
+	IP      int         // position of the instruction in Program.Bytecode
+	Operand interface{} // decoded argument; nil for opcodes without one
+	Path    string      // access path, e.g. a.b.c, if a property is missing
+	Err     error       // the cause, if the panic was an error
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Operand != nil {
+		return fmt.Sprintf("%v (%v %#v at %v)", e.Message, e.Name, e.Operand, e.IP)
+	}
+	return fmt.Sprintf("%v (%v at %v)", e.Message, e.Name, e.IP)
+}
+
+func newRuntimeError(program *Program, ip int, r interface{}) *RuntimeError {
+	e := &RuntimeError{
+		Message: fmt.Sprintf("%v", r),
+		IP:      ip,
+	}
+	if err, ok := r.(error); ok {
+		e.Err = err
+	}
+	if ip < len(program.Bytecode) {
+		e.Opcode = program.Bytecode[ip]
+		e.Name = opcodes[e.Opcode].name
+		e.Operand = program.operand(ip)
+	}
+	if _, ok := r.(fetchError); ok && program.Paths[ip] != "" {
+		e.Path = program.Paths[ip]
+		e.Message += " at " + e.Path
+	}
+	return e
+}
@@ -0,0 +1,504 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ebusto/expr/ast"
+	"github.com/ebusto/expr/file"
+)
+
+// Eval evaluates the tree of node directly, without compiling it to
+// bytecode. It is slower than Run, but uses the same runtime helpers, so
+// results match the ones of the compiled program. The tree should be
+// checked first, so builtins and literal types are resolved.
+func Eval(node ast.Node, env interface{}) (interface{}, error) {
+	return EvalWith(node, env, Options{})
+}
+
+// EvalWith is Eval with the options a program compiled from the tree would
+// run with.
+func EvalWith(node ast.Node, env interface{}, options Options) (out interface{}, err error) {
+	e := &evaluator{
+		env:     env,
+		lets:    make(map[int]interface{}),
+		options: options,
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if c, ok := r.(callError); ok {
+				err = c.err
+				return
+			}
+			var loc file.Location
+			message := fmt.Sprintf("%v", r)
+			if len(e.nodes) > 0 {
+				node := e.nodes[len(e.nodes)-1]
+				loc = node.Location()
+				if p, ok := pathOf(node); ok {
+					if _, ok := r.(fetchError); ok {
+						message += " at " + p
+					}
+				}
+			}
+			err = &file.Error{
+				Location: loc,
+				Message:  message,
+			}
+		}
+	}()
+	return e.eval(node), nil
+}
+
+// callError is raised for an error returned by a function or method of
+// env, which Eval returns as is, like Run does.
+type callError struct {
+	err error
+}
+
+type evaluator struct {
+	env      interface{}
+	options  Options
+	lets     map[int]interface{}
+	elements []element  // current elements of builtins like all, innermost last
+	nodes    []ast.Node // nodes being evaluated, to locate errors
+}
+
+// pathOf returns the access path of node, if the compiler records one for
+// runtime errors.
+func pathOf(node ast.Node) (string, bool) {
+	switch node.(type) {
+	case *ast.PropertyNode, *ast.IndexNode:
+		return ast.Path(node)
+	}
+	return "", false
+}
+
+type element struct {
+	array interface{}
+	i     int
+}
+
+func (e *evaluator) eval(node ast.Node) interface{} {
+	e.nodes = append(e.nodes, node)
+	out := e.node(node)
+	e.nodes = e.nodes[:len(e.nodes)-1]
+	return out
+}
+
+func (e *evaluator) node(node ast.Node) interface{} {
+	switch n := node.(type) {
+	case *ast.NilNode:
+		return nil
+	case *ast.IdentifierNode:
+		return fetchEnv(e.env, n.Value, n.NilSafe, e.options.MissingKey)
+	case *ast.IntegerNode:
+		return Integer(n.Value, n.Type())
+	case *ast.FloatNode:
+		return n.Value
+	case *ast.BoolNode:
+		return n.Value
+	case *ast.StringNode:
+		return n.Value
+	case *ast.ConstantNode:
+		return n.Value
+	case *ast.UnaryNode:
+		return e.unary(n)
+	case *ast.BinaryNode:
+		return e.binary(n)
+	case *ast.MatchesNode:
+		return e.matches(n)
+	case *ast.PropertyNode:
+		return fetch(e.eval(n.Node), n.Property, n.NilSafe, e.options.MissingKey)
+	case *ast.IndexNode:
+		a := e.eval(n.Node)
+		return fetch(a, e.eval(n.Index), n.NilSafe, e.options.MissingKey)
+	case *ast.SliceNode:
+		a := e.eval(n.Node)
+		var to, from interface{} = nil, 0
+		if n.To != nil {
+			to = e.eval(n.To)
+		} else {
+			to = length(a)
+		}
+		if n.From != nil {
+			from = e.eval(n.From)
+		}
+		return slice(a, from, to)
+	case *ast.MethodNode:
+		return e.method(n)
+	case *ast.CallNode:
+		fn := callValue(e.eval(n.Callee))
+		return result(fn.Call(values(e.arguments(n.Arguments))))
+	case *ast.FunctionNode:
+		return e.function(n)
+	case *ast.BuiltinNode:
+		return e.builtin(n)
+	case *ast.ClosureNode:
+		return e.eval(n.Node)
+	case *ast.PointerNode:
+		current := e.elements[len(e.elements)-1]
+		return fetch(current.array, current.i, false, e.options.MissingKey)
+	case *ast.ConditionalNode:
+		if e.eval(n.Cond).(bool) {
+			return e.eval(n.Exp1)
+		}
+		return e.eval(n.Exp2)
+	case *ast.ArrayNode:
+		array := make([]interface{}, len(n.Nodes))
+		for i, node := range n.Nodes {
+			array[i] = e.eval(node)
+		}
+		return array
+	case *ast.SequenceNode:
+		results := make([]interface{}, len(n.Nodes))
+		for i, node := range n.Nodes {
+			results[i] = e.eval(node)
+		}
+		return results
+	case *ast.LetNode:
+		e.lets[n.Index] = e.eval(n.Value)
+		return e.eval(n.Body)
+	case *ast.VariableNode:
+		return e.lets[n.Index]
+	case *ast.MapNode:
+		m := make(map[string]interface{})
+		for _, pair := range n.Pairs {
+			p := pair.(*ast.PairNode)
+			key := e.eval(p.Key)
+			m[key.(string)] = e.eval(p.Value)
+		}
+		return m
+	}
+	panic(fmt.Sprintf("undefined node type (%T)", node))
+}
+
+func (e *evaluator) unary(node *ast.UnaryNode) interface{} {
+	v := e.eval(node.Node)
+	switch node.Operator {
+	case "!", "not":
+		return !v.(bool)
+	case "+":
+		return v
+	case "-":
+		if e.options.NumericStrings {
+			v = numericString(v)
+		}
+		return negate(v)
+	}
+	panic(fmt.Sprintf("unknown operator (%v)", node.Operator))
+}
+
+func (e *evaluator) binary(node *ast.BinaryNode) interface{} {
+	switch node.Operator {
+	case "or", "||":
+		l := e.eval(node.Left)
+		if l.(bool) {
+			return l
+		}
+		return e.eval(node.Right)
+	case "and", "&&":
+		l := e.eval(node.Left)
+		if !l.(bool) {
+			return l
+		}
+		return e.eval(node.Right)
+	}
+
+	a := e.eval(node.Left)
+	b := e.eval(node.Right)
+	if e.options.NumericStrings {
+		switch node.Operator {
+		case "==", "!=", "<", ">", "<=", ">=", "+":
+			a, b = numericOperands(a, b, true)
+		case "-", "*", "/", "%", "**":
+			a, b = numericOperands(a, b, false)
+		}
+	}
+	if e.options.NoNaNComparison {
+		switch node.Operator {
+		case "==", "!=", "<", ">", "<=", ">=":
+			checkNaN(a, b)
+		}
+	}
+	switch node.Operator {
+	case "==":
+		return equal(a, b)
+	case "!=":
+		return !equal(a, b).(bool)
+	case "in":
+		return in(a, b)
+	case "not in":
+		return !in(a, b)
+	case "<":
+		return less(a, b)
+	case ">":
+		return more(a, b)
+	case "<=":
+		return lessOrEqual(a, b)
+	case ">=":
+		return moreOrEqual(a, b)
+	case "+":
+		return add(a, b)
+	case "-":
+		return subtract(a, b)
+	case "*":
+		return multiply(a, b)
+	case "/":
+		return divide(a, b)
+	case "%":
+		return modulo(a, b)
+	case "**":
+		return exponent(a, b)
+	case "contains":
+		return strings.Contains(a.(string), b.(string))
+	case "startsWith":
+		return strings.HasPrefix(a.(string), b.(string))
+	case "endsWith":
+		return strings.HasSuffix(a.(string), b.(string))
+	case "..":
+		return makeRange(toInt(a), toInt(b))
+	}
+	panic(fmt.Sprintf("unknown operator (%v)", node.Operator))
+}
+
+func (e *evaluator) matches(node *ast.MatchesNode) interface{} {
+	s := e.eval(node.Left)
+	if node.Regexp != nil {
+		return e.options.match(node.Regexp, s.(string))
+	}
+	pattern := e.eval(node.Right).(string)
+	if node.Flags != nil {
+		var err error
+		pattern, err = WithFlags(pattern, e.eval(node.Flags).(string))
+		if err != nil {
+			panic(err)
+		}
+	}
+	r, err := e.options.compileRegexp(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return e.options.match(r, s.(string))
+}
+
+func (e *evaluator) arguments(nodes []ast.Node) []interface{} {
+	args := make([]interface{}, len(nodes))
+	for i, node := range nodes {
+		args[i] = e.eval(node)
+	}
+	return args
+}
+
+// values converts arguments for reflect calls, like OpCall does.
+func values(args []interface{}) []reflect.Value {
+	in := make([]reflect.Value, len(args))
+	for i := range args {
+		if args[i] == nil && reflect.TypeOf(args[i]) == nil {
+			in[i] = reflect.ValueOf(&args[i]).Elem()
+		} else {
+			in[i] = reflect.ValueOf(args[i])
+		}
+	}
+	return in
+}
+
+func result(out []reflect.Value) interface{} {
+	if len(out) == 2 && out[1].Type() == errorType && !out[1].IsNil() {
+		panic(callError{out[1].Interface().(error)})
+	}
+	return out[0].Interface()
+}
+
+func (e *evaluator) method(node *ast.MethodNode) interface{} {
+	obj := e.eval(node.Node)
+	in := values(e.arguments(node.Arguments))
+	if node.NilSafe {
+		fn := FetchFnNil(obj, node.Method)
+		if !fn.IsValid() {
+			return nil
+		}
+		return fn.Call(in)[0].Interface()
+	}
+	return result(FetchFn(obj, node.Method).Call(in))
+}
+
+func (e *evaluator) function(node *ast.FunctionNode) interface{} {
+	if node.Builtin && (node.Name == "coalesce" || node.Name == "ifNull") {
+		var v interface{}
+		for _, arg := range node.Arguments {
+			v = e.eval(arg)
+			if !isNil(v) {
+				return v
+			}
+		}
+		return v
+	}
+
+	if node.Builtin && (node.Name == "try" || node.Name == "onError") {
+		if v, ok := e.try(node.Arguments[0]); ok {
+			return v
+		}
+		if len(node.Arguments) > 1 {
+			return e.eval(node.Arguments[1])
+		}
+		return nil
+	}
+
+	args := e.arguments(node.Arguments)
+	switch {
+	case node.Func.IsValid():
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			if arg == nil && reflect.TypeOf(arg) == nil {
+				in[i] = reflect.Zero(node.Func.Type().In(i))
+			} else {
+				in[i] = reflect.ValueOf(arg)
+			}
+		}
+		return node.Func.Call(in)[0].Interface()
+
+	case node.Builtin && node.Name == "var":
+		return fetchVar(e.env, args[0], false, e.options.MissingKey)
+
+	case node.Builtin:
+		builtin := Builtins[node.Name]
+		if e.options.NumericStrings {
+			numericArgs(builtin, args)
+		}
+		if e.options.NoNaNComparison && builtin.Compares {
+			checkNaNArgs(node.Name, args)
+		}
+		return builtin.Func(args...)
+
+	case node.Fast:
+		fn := FetchFn(e.env, node.Name).Interface()
+		if typed, ok := fn.(func(...interface{}) interface{}); ok {
+			return typed(args...)
+		} else if typed, ok := fn.(func(...interface{}) (interface{}, error)); ok {
+			res, err := typed(args...)
+			if err != nil {
+				panic(callError{err})
+			}
+			return res
+		}
+		return nil
+	}
+	return result(FetchFn(e.env, node.Name).Call(values(args)))
+}
+
+// try evaluates node for try(), reporting whether it did not fail.
+func (e *evaluator) try(node ast.Node) (out interface{}, ok bool) {
+	nodes, elements := len(e.nodes), len(e.elements)
+	defer func() {
+		if r := recover(); r != nil {
+			if !catchable(r) {
+				panic(r)
+			}
+			e.nodes = e.nodes[:nodes]
+			e.elements = e.elements[:elements]
+			out, ok = nil, false
+		}
+	}()
+	return e.eval(node), true
+}
+
+func (e *evaluator) builtin(node *ast.BuiltinNode) interface{} {
+	switch node.Name {
+	case "len":
+		return length(e.eval(node.Arguments[0]))
+
+	case "between":
+		x := e.eval(node.Arguments[0])
+		from := e.eval(node.Arguments[1])
+		to := e.eval(node.Arguments[2])
+		if e.options.NumericStrings {
+			from, x = numericOperands(from, x, true)
+			x, to = numericOperands(x, to, true)
+		}
+		if e.options.NoNaNComparison {
+			checkNaN(from, x)
+			checkNaN(x, to)
+		}
+		return lessOrEqual(from, x).(bool) && lessOrEqual(x, to).(bool)
+
+	case "fill":
+		indexes := Builtins["fill"].Func(e.eval(node.Arguments[0]))
+		out := []interface{}{}
+		e.loop(indexes, node.Arguments[1], func(v interface{}) bool {
+			out = append(out, v)
+			return true
+		})
+		return out
+
+	case "map":
+		var out []interface{}
+		e.each(node, func(v interface{}) bool {
+			out = append(out, v)
+			return true
+		})
+		if out == nil {
+			out = []interface{}{}
+		}
+		return out
+
+	case "filter":
+		out := []interface{}{}
+		e.each(node, func(v interface{}) bool {
+			if v.(bool) {
+				current := e.elements[len(e.elements)-1]
+				out = append(out, fetch(current.array, current.i, false, e.options.MissingKey))
+			}
+			return true
+		})
+		return out
+
+	case "all", "none", "any":
+		// all stops at the first false, none and any at the first true.
+		stop := node.Name != "all"
+		stopped := false
+		e.each(node, func(v interface{}) bool {
+			stopped = v.(bool) == stop
+			return !stopped
+		})
+		if node.Name == "any" {
+			return stopped
+		}
+		return !stopped
+
+	case "one", "count":
+		count := 0
+		e.each(node, func(v interface{}) bool {
+			if v.(bool) {
+				count++
+			}
+			return true
+		})
+		if node.Name == "one" {
+			return count == 1
+		}
+		return count
+	}
+	panic(fmt.Sprintf("unknown builtin %v", node.Name))
+}
+
+// each evaluates the closure of node for the elements of the array, until
+// fn returns false.
+func (e *evaluator) each(node *ast.BuiltinNode, fn func(interface{}) bool) {
+	e.loop(e.eval(node.Arguments[0]), node.Arguments[1], fn)
+}
+
+// loop evaluates closure for every element of array, until fn returns false.
+func (e *evaluator) loop(array interface{}, closure ast.Node, fn func(interface{}) bool) {
+	array = elements(array)
+	size := length(array)
+	e.elements = append(e.elements, element{array: array})
+	defer func() { e.elements = e.elements[:len(e.elements)-1] }()
+	for i := 0; i < size; i++ {
+		e.elements[len(e.elements)-1].i = i
+		if !fn(e.eval(closure)) {
+			return
+		}
+	}
+}
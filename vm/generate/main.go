@@ -7,6 +7,77 @@ import (
 	"strings"
 )
 
+// timeCases returns the cases of time.Time and time.Duration operands for
+// every helper.
+func timeCases(types []string) map[string]string {
+	number := func(f func(t string) string) string {
+		var s string
+		for _, t := range types {
+			s += f(t)
+		}
+		return s
+	}
+	compare := func(op, instant string) string {
+		return `case time.Time:
+switch y := b.(type) {
+case time.Time: return ` + instant + `
+}
+case time.Duration:
+switch y := b.(type) {
+case time.Duration: return x ` + op + ` y
+}`
+	}
+	return map[string]string{
+		"equal": `case time.Time:
+switch y := b.(type) {
+case time.Time: return x.Equal(y)
+}
+case time.Duration:
+switch y := b.(type) {
+case time.Duration: return x == y
+}`,
+		"less":        compare("<", "x.Before(y)"),
+		"more":        compare(">", "x.After(y)"),
+		"lessOrEqual": compare("<=", "!x.After(y)"),
+		"moreOrEqual": compare(">=", "!x.Before(y)"),
+		"add": `case time.Time:
+switch y := b.(type) {
+case time.Duration: return x.Add(y)
+}
+case time.Duration:
+switch y := b.(type) {
+case time.Duration: return x + y
+case time.Time: return y.Add(x)
+}`,
+		"subtract": `case time.Time:
+switch y := b.(type) {
+case time.Time: return x.Sub(y)
+case time.Duration: return x.Add(-y)
+}
+case time.Duration:
+switch y := b.(type) {
+case time.Duration: return x - y
+}`,
+		"multiply": `case time.Duration:
+switch y := b.(type) {
+` + number(func(t string) string {
+			if strings.HasPrefix(t, "float") {
+				return fmt.Sprintf("case %v: return time.Duration(float64(x) * float64(y))\n", t)
+			}
+			return fmt.Sprintf("case %v: return x * time.Duration(y)\n", t)
+		}) + `}`,
+		"divide": `case time.Duration:
+switch y := b.(type) {
+case time.Duration: return float64(x) / float64(y)
+` + number(func(t string) string {
+			if strings.HasPrefix(t, "float") {
+				return fmt.Sprintf("case %v: return time.Duration(float64(x) / float64(y))\n", t)
+			}
+			return fmt.Sprintf("case %v: return x / time.Duration(y)\n", t)
+		}) + `}`,
+	}
+}
+
 func check(e error) {
 	if e != nil {
 		panic(e)
@@ -23,8 +94,9 @@ func main() {
 	echo(``)
 	echo(`package vm`)
 	echo(`import (`)
+	echo(`"bytes"`)
 	echo(`"fmt"`)
-	echo(`"reflect"`)
+	echo(`"time"`)
 	echo(`)`)
 
 	types := []string{
@@ -45,6 +117,7 @@ func main() {
 	helpers := []struct {
 		name, op        string
 		noFloat, string bool
+		compare         bool
 	}{
 		{
 			name:   "equal",
@@ -52,24 +125,28 @@ func main() {
 			string: true,
 		},
 		{
-			name:   "less",
-			op:     "<",
-			string: true,
+			name:    "less",
+			op:      "<",
+			string:  true,
+			compare: true,
 		},
 		{
-			name:   "more",
-			op:     ">",
-			string: true,
+			name:    "more",
+			op:      ">",
+			string:  true,
+			compare: true,
 		},
 		{
-			name:   "lessOrEqual",
-			op:     "<=",
-			string: true,
+			name:    "lessOrEqual",
+			op:      "<=",
+			string:  true,
+			compare: true,
 		},
 		{
-			name:   "moreOrEqual",
-			op:     ">=",
-			string: true,
+			name:    "moreOrEqual",
+			op:      ">=",
+			string:  true,
+			compare: true,
 		},
 		{
 			name:   "add",
@@ -95,6 +172,7 @@ func main() {
 		},
 	}
 
+	durations := timeCases(types)
 	for _, helper := range helpers {
 		name := helper.name
 		op := helper.op
@@ -121,19 +199,47 @@ func main() {
 					echo(`return x %v %v(y)`, op, a)
 				}
 			}
+			if name == "multiply" {
+				echo(`case time.Duration:`)
+				if strings.HasPrefix(a, "float") {
+					echo(`return time.Duration(float64(x) * float64(y))`)
+				} else {
+					echo(`return time.Duration(x) * y`)
+				}
+			}
 			echo(`}`)
 		}
 		if helper.string {
 			echo(`case string:`)
 			echo(`switch y := b.(type) {`)
 			echo(`case string: return x %v y`, op)
+			if name == "equal" {
+				echo(`case []byte: return x == string(y)`)
+			}
+			echo(`}`)
+		}
+		if c, ok := durations[name]; ok {
+			echo(c)
+		}
+		if name == "equal" {
+			echo(`case []byte:`)
+			echo(`switch y := b.(type) {`)
+			echo(`case []byte: return bytes.Equal(x, y)`)
+			echo(`case string: return string(x) == y`)
 			echo(`}`)
 		}
 		echo(`}`)
+		echo(`if x, y, ok := numbers(a, b); ok { return %v(x, y) }`, name)
 		if name == "equal" {
+			echo(`if e, ok := a.(Equaler); ok { return e.Equal(b) }`)
+			echo(`if e, ok := b.(Equaler); ok { return e.Equal(a) }`)
 			echo(`if isNil(a) && isNil(b) { return true }`)
-			echo(`return reflect.DeepEqual(a, b)`)
+			echo(`return deepEqual(a, b, 0)`)
 		} else {
+			if helper.compare {
+				echo(`if c, ok := a.(Comparer); ok { return c.Compare(b) %v 0 }`, op)
+				echo(`if c, ok := b.(Comparer); ok { return 0 %v c.Compare(a) }`, op)
+			}
 			echo(`panic(fmt.Sprintf("invalid operation: %%T %%v %%T", a, "%v", b))`, op)
 		}
 		echo(`}`)
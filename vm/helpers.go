@@ -3,8 +3,9 @@
 package vm
 
 import (
+	"bytes"
 	"fmt"
-	"reflect"
+	"time"
 )
 
 func equal(a, b interface{}) interface{} {
@@ -337,12 +338,40 @@ func equal(a, b interface{}) interface{} {
 		switch y := b.(type) {
 		case string:
 			return x == y
+		case []byte:
+			return x == string(y)
 		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return x.Equal(y)
+		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return x == y
+		}
+	case []byte:
+		switch y := b.(type) {
+		case []byte:
+			return bytes.Equal(x, y)
+		case string:
+			return string(x) == y
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return equal(x, y)
+	}
+	if e, ok := a.(Equaler); ok {
+		return e.Equal(b)
+	}
+	if e, ok := b.(Equaler); ok {
+		return e.Equal(a)
 	}
 	if isNil(a) && isNil(b) {
 		return true
 	}
-	return reflect.DeepEqual(a, b)
+	return deepEqual(a, b, 0)
 }
 
 func less(a, b interface{}) interface{} {
@@ -676,6 +705,25 @@ func less(a, b interface{}) interface{} {
 		case string:
 			return x < y
 		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return x.Before(y)
+		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return x < y
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return less(x, y)
+	}
+	if c, ok := a.(Comparer); ok {
+		return c.Compare(b) < 0
+	}
+	if c, ok := b.(Comparer); ok {
+		return 0 < c.Compare(a)
 	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, "<", b))
 }
@@ -1011,6 +1059,25 @@ func more(a, b interface{}) interface{} {
 		case string:
 			return x > y
 		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return x.After(y)
+		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return x > y
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return more(x, y)
+	}
+	if c, ok := a.(Comparer); ok {
+		return c.Compare(b) > 0
+	}
+	if c, ok := b.(Comparer); ok {
+		return 0 > c.Compare(a)
 	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, ">", b))
 }
@@ -1346,6 +1413,25 @@ func lessOrEqual(a, b interface{}) interface{} {
 		case string:
 			return x <= y
 		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return !x.After(y)
+		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return x <= y
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return lessOrEqual(x, y)
+	}
+	if c, ok := a.(Comparer); ok {
+		return c.Compare(b) <= 0
+	}
+	if c, ok := b.(Comparer); ok {
+		return 0 <= c.Compare(a)
 	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, "<=", b))
 }
@@ -1681,6 +1767,25 @@ func moreOrEqual(a, b interface{}) interface{} {
 		case string:
 			return x >= y
 		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return !x.Before(y)
+		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return x >= y
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return moreOrEqual(x, y)
+	}
+	if c, ok := a.(Comparer); ok {
+		return c.Compare(b) >= 0
+	}
+	if c, ok := b.(Comparer); ok {
+		return 0 >= c.Compare(a)
 	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, ">=", b))
 }
@@ -2016,6 +2121,21 @@ func add(a, b interface{}) interface{} {
 		case string:
 			return x + y
 		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Duration:
+			return x.Add(y)
+		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return x + y
+		case time.Time:
+			return y.Add(x)
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return add(x, y)
 	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, "+", b))
 }
@@ -2346,6 +2466,21 @@ func subtract(a, b interface{}) interface{} {
 		case float64:
 			return x - y
 		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return x.Sub(y)
+		case time.Duration:
+			return x.Add(-y)
+		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return x - y
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return subtract(x, y)
 	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, "-", b))
 }
@@ -2378,6 +2513,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case uint8:
 		switch y := b.(type) {
@@ -2405,6 +2542,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case uint16:
 		switch y := b.(type) {
@@ -2432,6 +2571,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case uint32:
 		switch y := b.(type) {
@@ -2459,6 +2600,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case uint64:
 		switch y := b.(type) {
@@ -2486,6 +2629,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case int:
 		switch y := b.(type) {
@@ -2513,6 +2658,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case int8:
 		switch y := b.(type) {
@@ -2540,6 +2687,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case int16:
 		switch y := b.(type) {
@@ -2567,6 +2716,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case int32:
 		switch y := b.(type) {
@@ -2594,6 +2745,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case int64:
 		switch y := b.(type) {
@@ -2621,6 +2774,8 @@ func multiply(a, b interface{}) interface{} {
 			return float32(x) * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(x) * y
 		}
 	case float32:
 		switch y := b.(type) {
@@ -2648,6 +2803,8 @@ func multiply(a, b interface{}) interface{} {
 			return x * y
 		case float64:
 			return float64(x) * y
+		case time.Duration:
+			return time.Duration(float64(x) * float64(y))
 		}
 	case float64:
 		switch y := b.(type) {
@@ -2675,7 +2832,39 @@ func multiply(a, b interface{}) interface{} {
 			return x * float64(y)
 		case float64:
 			return x * y
+		case time.Duration:
+			return time.Duration(float64(x) * float64(y))
 		}
+	case time.Duration:
+		switch y := b.(type) {
+		case uint:
+			return x * time.Duration(y)
+		case uint8:
+			return x * time.Duration(y)
+		case uint16:
+			return x * time.Duration(y)
+		case uint32:
+			return x * time.Duration(y)
+		case uint64:
+			return x * time.Duration(y)
+		case int:
+			return x * time.Duration(y)
+		case int8:
+			return x * time.Duration(y)
+		case int16:
+			return x * time.Duration(y)
+		case int32:
+			return x * time.Duration(y)
+		case int64:
+			return x * time.Duration(y)
+		case float32:
+			return time.Duration(float64(x) * float64(y))
+		case float64:
+			return time.Duration(float64(x) * float64(y))
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return multiply(x, y)
 	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, "*", b))
 }
@@ -3006,6 +3195,38 @@ func divide(a, b interface{}) interface{} {
 		case float64:
 			return x / y
 		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return float64(x) / float64(y)
+		case uint:
+			return x / time.Duration(y)
+		case uint8:
+			return x / time.Duration(y)
+		case uint16:
+			return x / time.Duration(y)
+		case uint32:
+			return x / time.Duration(y)
+		case uint64:
+			return x / time.Duration(y)
+		case int:
+			return x / time.Duration(y)
+		case int8:
+			return x / time.Duration(y)
+		case int16:
+			return x / time.Duration(y)
+		case int32:
+			return x / time.Duration(y)
+		case int64:
+			return x / time.Duration(y)
+		case float32:
+			return time.Duration(float64(x) / float64(y))
+		case float64:
+			return time.Duration(float64(x) / float64(y))
+		}
+	}
+	if x, y, ok := numbers(a, b); ok {
+		return divide(x, y)
 	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, "/", b))
 }
@@ -3243,5 +3464,8 @@ func modulo(a, b interface{}) interface{} {
 			return x % y
 		}
 	}
+	if x, y, ok := numbers(a, b); ok {
+		return modulo(x, y)
+	}
 	panic(fmt.Sprintf("invalid operation: %T %v %T", a, "%", b))
 }
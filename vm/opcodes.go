@@ -1,5 +1,7 @@
 package vm
 
+// The values of opcodes are stable: new opcodes are added right before
+// OpEnd, so bytecode keeps its meaning across versions.
 const (
 	OpPush byte = iota
 	OpPop
@@ -33,15 +35,18 @@ const (
 	OpRange
 	OpMatches
 	OpMatchesConst
+	OpMatchesFlags
 	OpContains
 	OpStartsWith
 	OpEndsWith
+	OpBetween
 	OpIndex
 	OpSlice
 	OpProperty
 	OpPropertyNilSafe
 	OpCall
 	OpCallFast
+	OpCallBuiltin
 	OpMethod
 	OpMethodNilSafe
 	OpArray
@@ -52,5 +57,223 @@ const (
 	OpLoad
 	OpInc
 	OpBegin
+	OpStoreLocal
+	OpLoadLocal
+	OpCallFunc
+	OpJumpIfNotNil
+	OpApply
+	OpFetchVar
+	OpFetchStrict
+	OpFetchVarStrict
+	OpTry
+	OpRequire
+	OpDivideInf
+	OpCallValue
+	OpValues
+	OpNotEqual
+	OpNotEqualInt
+	OpNotEqualString
+	OpNotIn
+	OpIndexNilSafe
 	OpEnd // This opcode must be at the end of this list.
 )
+
+type argument int
+
+const (
+	noArgument       argument = iota
+	constantArgument          // index into Program.Constants
+	jumpArgument              // forward offset from the next instruction
+	backwardArgument          // backward offset from the next instruction
+	valueArgument             // plain uint16 value
+)
+
+type opcode struct {
+	name     string
+	argument argument
+}
+
+var opcodes = map[byte]opcode{
+	OpPush:            {"OpPush", constantArgument},
+	OpPop:             {"OpPop", noArgument},
+	OpRot:             {"OpRot", noArgument},
+	OpFetch:           {"OpFetch", constantArgument},
+	OpFetchNilSafe:    {"OpFetchNilSafe", constantArgument},
+	OpFetchMap:        {"OpFetchMap", constantArgument},
+	OpFetchStrict:     {"OpFetchStrict", constantArgument},
+	OpFetchVar:        {"OpFetchVar", noArgument},
+	OpFetchVarStrict:  {"OpFetchVarStrict", noArgument},
+	OpTrue:            {"OpTrue", noArgument},
+	OpFalse:           {"OpFalse", noArgument},
+	OpNil:             {"OpNil", noArgument},
+	OpNegate:          {"OpNegate", noArgument},
+	OpNot:             {"OpNot", noArgument},
+	OpEqual:           {"OpEqual", noArgument},
+	OpEqualInt:        {"OpEqualInt", noArgument},
+	OpEqualString:     {"OpEqualString", noArgument},
+	OpNotEqual:        {"OpNotEqual", noArgument},
+	OpNotEqualInt:     {"OpNotEqualInt", noArgument},
+	OpNotEqualString:  {"OpNotEqualString", noArgument},
+	OpJump:            {"OpJump", jumpArgument},
+	OpJumpIfTrue:      {"OpJumpIfTrue", jumpArgument},
+	OpJumpIfFalse:     {"OpJumpIfFalse", jumpArgument},
+	OpJumpBackward:    {"OpJumpBackward", backwardArgument},
+	OpJumpIfNotNil:    {"OpJumpIfNotNil", jumpArgument},
+	OpTry:             {"OpTry", jumpArgument},
+	OpIn:              {"OpIn", noArgument},
+	OpNotIn:           {"OpNotIn", noArgument},
+	OpLess:            {"OpLess", noArgument},
+	OpMore:            {"OpMore", noArgument},
+	OpLessOrEqual:     {"OpLessOrEqual", noArgument},
+	OpMoreOrEqual:     {"OpMoreOrEqual", noArgument},
+	OpAdd:             {"OpAdd", noArgument},
+	OpSubtract:        {"OpSubtract", noArgument},
+	OpMultiply:        {"OpMultiply", noArgument},
+	OpDivide:          {"OpDivide", noArgument},
+	OpDivideInf:       {"OpDivideInf", noArgument},
+	OpModulo:          {"OpModulo", noArgument},
+	OpExponent:        {"OpExponent", noArgument},
+	OpRange:           {"OpRange", noArgument},
+	OpMatches:         {"OpMatches", noArgument},
+	OpMatchesConst:    {"OpMatchesConst", constantArgument},
+	OpMatchesFlags:    {"OpMatchesFlags", noArgument},
+	OpContains:        {"OpContains", noArgument},
+	OpStartsWith:      {"OpStartsWith", noArgument},
+	OpEndsWith:        {"OpEndsWith", noArgument},
+	OpBetween:         {"OpBetween", noArgument},
+	OpIndex:           {"OpIndex", noArgument},
+	OpIndexNilSafe:    {"OpIndexNilSafe", noArgument},
+	OpSlice:           {"OpSlice", noArgument},
+	OpProperty:        {"OpProperty", constantArgument},
+	OpPropertyNilSafe: {"OpPropertyNilSafe", constantArgument},
+	OpCall:            {"OpCall", constantArgument},
+	OpCallFast:        {"OpCallFast", constantArgument},
+	OpCallBuiltin:     {"OpCallBuiltin", constantArgument},
+	OpCallFunc:        {"OpCallFunc", constantArgument},
+	OpApply:           {"OpApply", noArgument},
+	OpRequire:         {"OpRequire", noArgument},
+	OpMethod:          {"OpMethod", constantArgument},
+	OpMethodNilSafe:   {"OpMethodNilSafe", constantArgument},
+	OpCallValue:       {"OpCallValue", constantArgument},
+	OpArray:           {"OpArray", noArgument},
+	OpMap:             {"OpMap", noArgument},
+	OpLen:             {"OpLen", noArgument},
+	OpValues:          {"OpValues", noArgument},
+	OpCast:            {"OpCast", valueArgument},
+	OpStore:           {"OpStore", constantArgument},
+	OpLoad:            {"OpLoad", constantArgument},
+	OpInc:             {"OpInc", constantArgument},
+	OpBegin:           {"OpBegin", noArgument},
+	OpStoreLocal:      {"OpStoreLocal", valueArgument},
+	OpLoadLocal:       {"OpLoadLocal", valueArgument},
+	OpEnd:             {"OpEnd", noArgument},
+}
+
+// Opcodes returns all opcodes known to the VM, in order from OpPush to
+// OpEnd.
+func Opcodes() []byte {
+	ops := make([]byte, 0, OpEnd+1)
+	for op := OpPush; op <= OpEnd; op++ {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// OpcodeName returns the name of op, such as "OpPush", or an empty string
+// if op is not a known opcode.
+func OpcodeName(op byte) string {
+	return opcodes[op].name
+}
+
+// HasArgument reports whether op is followed by a two bytes argument in
+// Program.Bytecode.
+func HasArgument(op byte) bool {
+	info, ok := opcodes[op]
+	return ok && info.argument != noArgument
+}
+
+// StackEffect describes how an opcode changes the stack: it needs at least
+// Min values on the stack and changes the stack height by Delta.
+type StackEffect struct {
+	Min   int
+	Delta int
+}
+
+// StackEffects maps every opcode to its stack effect. Calls and methods
+// additionally pop Call.Size arguments, OpArray and OpMap additionally pop
+// as many elements or pairs as the size on top of the stack.
+var StackEffects = map[byte]StackEffect{
+	OpPush:            {0, 1},
+	OpPop:             {1, -1},
+	OpRot:             {2, 0},
+	OpFetch:           {0, 1},
+	OpFetchNilSafe:    {0, 1},
+	OpFetchMap:        {0, 1},
+	OpFetchStrict:     {0, 1},
+	OpFetchVar:        {1, 0},
+	OpFetchVarStrict:  {1, 0},
+	OpTrue:            {0, 1},
+	OpFalse:           {0, 1},
+	OpNil:             {0, 1},
+	OpNegate:          {1, 0},
+	OpNot:             {1, 0},
+	OpEqual:           {2, -1},
+	OpEqualInt:        {2, -1},
+	OpEqualString:     {2, -1},
+	OpNotEqual:        {2, -1},
+	OpNotEqualInt:     {2, -1},
+	OpNotEqualString:  {2, -1},
+	OpJump:            {0, 0},
+	OpJumpIfTrue:      {1, 0},
+	OpJumpIfFalse:     {1, 0},
+	OpJumpBackward:    {0, 0},
+	OpJumpIfNotNil:    {1, 0},
+	OpTry:             {0, 0},
+	OpIn:              {2, -1},
+	OpNotIn:           {2, -1},
+	OpLess:            {2, -1},
+	OpMore:            {2, -1},
+	OpLessOrEqual:     {2, -1},
+	OpMoreOrEqual:     {2, -1},
+	OpAdd:             {2, -1},
+	OpSubtract:        {2, -1},
+	OpMultiply:        {2, -1},
+	OpDivide:          {2, -1},
+	OpDivideInf:       {2, -1},
+	OpModulo:          {2, -1},
+	OpExponent:        {2, -1},
+	OpRange:           {2, -1},
+	OpMatches:         {2, -1},
+	OpMatchesConst:    {1, 0},
+	OpMatchesFlags:    {3, -2},
+	OpContains:        {2, -1},
+	OpStartsWith:      {2, -1},
+	OpEndsWith:        {2, -1},
+	OpBetween:         {3, -2},
+	OpIndex:           {2, -1},
+	OpIndexNilSafe:    {2, -1},
+	OpSlice:           {3, -2},
+	OpProperty:        {1, 0},
+	OpPropertyNilSafe: {1, 0},
+	OpCall:            {0, 1},
+	OpCallFast:        {0, 1},
+	OpCallBuiltin:     {0, 1},
+	OpCallFunc:        {0, 1},
+	OpApply:           {2, -1},
+	OpRequire:         {2, -1},
+	OpMethod:          {1, 0},
+	OpMethodNilSafe:   {1, 0},
+	OpCallValue:       {1, 0},
+	OpArray:           {1, 0},
+	OpMap:             {1, 0},
+	OpLen:             {1, 1},
+	OpValues:          {1, 0},
+	OpCast:            {1, 0},
+	OpStore:           {1, -1},
+	OpLoad:            {0, 1},
+	OpInc:             {0, 0},
+	OpBegin:           {0, 0},
+	OpStoreLocal:      {1, -1},
+	OpLoadLocal:       {0, 1},
+	OpEnd:             {0, 0},
+}
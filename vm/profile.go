@@ -0,0 +1,67 @@
+package vm
+
+import "time"
+
+// OpcodeProfile is the number of executions of an opcode and their total
+// time, as measured by a profiling VM.
+type OpcodeProfile struct {
+	Count int
+	Time  time.Duration
+}
+
+// profile accumulates the executions of opcodes over runs of a VM. The time
+// of an opcode lasts until the next opcode starts, or the run ends.
+type profile struct {
+	counts [256]int
+	times  [256]time.Duration
+	op     byte
+	start  time.Time
+}
+
+func (p *profile) begin(op byte) {
+	now := time.Now()
+	if !p.start.IsZero() {
+		p.times[p.op] += now.Sub(p.start)
+	}
+	p.counts[op]++
+	p.op, p.start = op, now
+}
+
+func (p *profile) end() {
+	if !p.start.IsZero() {
+		p.times[p.op] += time.Since(p.start)
+	}
+	p.start = time.Time{}
+}
+
+// EnableProfiling makes vm count the executions of every opcode and their
+// time in the following runs, which slows the runs down. Without it, the
+// VM does not measure anything.
+func (vm *VM) EnableProfiling() {
+	if vm.profile == nil {
+		vm.profile = &profile{}
+	}
+}
+
+// Profile returns the executions of opcodes by their name, such as
+// "OpFetch", accumulated over the runs since profiling was enabled or last
+// reset. Opcodes which did not run are left out.
+func (vm *VM) Profile() map[string]OpcodeProfile {
+	out := make(map[string]OpcodeProfile)
+	if vm.profile == nil {
+		return out
+	}
+	for op, count := range vm.profile.counts {
+		if count > 0 {
+			out[OpcodeName(byte(op))] = OpcodeProfile{Count: count, Time: vm.profile.times[op]}
+		}
+	}
+	return out
+}
+
+// ResetProfile discards the executions counted so far.
+func (vm *VM) ResetProfile() {
+	if vm.profile != nil {
+		vm.profile = &profile{}
+	}
+}
@@ -1,9 +1,13 @@
 package vm
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"reflect"
 	"regexp"
+	"strconv"
 
 	"github.com/ebusto/expr/file"
 )
@@ -13,213 +17,252 @@ type Program struct {
 	Locations map[int]file.Location
 	Constants []interface{}
 	Bytecode  []byte
+	Locals    int            // number of local slots
+	Paths     map[int]string // access paths of OpProperty and OpIndex
+
+	Options
+
+	// MultipleResults makes a program which leaves more than one value on
+	// the stack return all of them, as an array. Otherwise, it fails.
+	MultipleResults bool
 }
 
-func (program *Program) Disassemble() string {
-	out := ""
+// EvalBool runs the program with given env and returns its result,
+// which must be a bool.
+func (program *Program) EvalBool(env interface{}) (bool, error) {
+	out, err := Run(program, env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := out.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected bool, but got %T", out)
+	}
+	return b, nil
+}
+
+// EvalTruthy runs the program with given env and returns whether its
+// result is truthy, as with the bool builtin: nil, false, zero, NaN and
+// empty strings, arrays and maps are false.
+func (program *Program) EvalTruthy(env interface{}) (bool, error) {
+	out, err := Run(program, env)
+	if err != nil {
+		return false, err
+	}
+	return truthy(out), nil
+}
+
+// Equal reports whether both programs have the same instructions, options,
+// number of locals and handling of multiple results. The order of constants does not matter, arguments referring to
+// constants are compared by the constant values. Regexps are compared by
+// pattern, and functions by name, size and identity.
+func (program *Program) Equal(other *Program) bool {
+	if other == nil || len(program.Bytecode) != len(other.Bytecode) {
+		return false
+	}
+	if program.settings() != other.settings() {
+		return false
+	}
 	ip := 0
 	for ip < len(program.Bytecode) {
-		pp := ip
 		op := program.Bytecode[ip]
-		ip++
-
-		readArg := func() uint16 {
-			if ip+1 >= len(program.Bytecode) {
-				return 0
-			}
-
-			i := binary.LittleEndian.Uint16([]byte{program.Bytecode[ip], program.Bytecode[ip+1]})
-			ip += 2
-			return i
-		}
-
-		code := func(label string) {
-			out += fmt.Sprintf("%v\t%v\n", pp, label)
+		if op != other.Bytecode[ip] {
+			return false
 		}
-		jump := func(label string) {
-			a := readArg()
-			out += fmt.Sprintf("%v\t%v\t%v\t(%v)\n", pp, label, a, ip+int(a))
+		info, ok := opcodes[op]
+		if !ok || info.argument == noArgument {
+			ip++
+			continue
 		}
-		back := func(label string) {
-			a := readArg()
-			out += fmt.Sprintf("%v\t%v\t%v\t(%v)\n", pp, label, a, ip-int(a))
+		if ip+3 > len(program.Bytecode) {
+			return bytes.Equal(program.Bytecode[ip:], other.Bytecode[ip:])
 		}
-		argument := func(label string) {
-			a := readArg()
-			out += fmt.Sprintf("%v\t%v\t%v\n", pp, label, a)
-		}
-		constant := func(label string) {
-			a := readArg()
-			var c interface{}
-			if int(a) < len(program.Constants) {
-				c = program.Constants[a]
-			}
-			if r, ok := c.(*regexp.Regexp); ok {
-				c = r.String()
+		if info.argument == constantArgument {
+			if !equalConstant(program.rawConstant(ip), other.rawConstant(ip)) {
+				return false
 			}
-			out += fmt.Sprintf("%v\t%v\t%v\t%#v\n", pp, label, a, c)
+		} else if !bytes.Equal(program.Bytecode[ip+1:ip+3], other.Bytecode[ip+1:ip+3]) {
+			return false
 		}
+		ip += 3
+	}
+	return true
+}
 
-		switch op {
-		case OpPush:
-			constant("OpPush")
-
-		case OpPop:
-			code("OpPop")
-
-		case OpRot:
-			code("OpRot")
-
-		case OpFetch:
-			constant("OpFetch")
-
-		case OpFetchNilSafe:
-			constant("OpFetchNilSafe")
-
-		case OpFetchMap:
-			constant("OpFetchMap")
-
-		case OpTrue:
-			code("OpTrue")
-
-		case OpFalse:
-			code("OpFalse")
-
-		case OpNil:
-			code("OpNil")
-
-		case OpNegate:
-			code("OpNegate")
-
-		case OpNot:
-			code("OpNot")
-
-		case OpEqual:
-			code("OpEqual")
-
-		case OpEqualInt:
-			code("OpEqualInt")
-
-		case OpEqualString:
-			code("OpEqualString")
-
-		case OpJump:
-			jump("OpJump")
-
-		case OpJumpIfTrue:
-			jump("OpJumpIfTrue")
-
-		case OpJumpIfFalse:
-			jump("OpJumpIfFalse")
-
-		case OpJumpBackward:
-			back("OpJumpBackward")
-
-		case OpIn:
-			code("OpIn")
-
-		case OpLess:
-			code("OpLess")
-
-		case OpMore:
-			code("OpMore")
-
-		case OpLessOrEqual:
-			code("OpLessOrEqual")
-
-		case OpMoreOrEqual:
-			code("OpMoreOrEqual")
-
-		case OpAdd:
-			code("OpAdd")
-
-		case OpSubtract:
-			code("OpSubtract")
-
-		case OpMultiply:
-			code("OpMultiply")
-
-		case OpDivide:
-			code("OpDivide")
-
-		case OpModulo:
-			code("OpModulo")
-
-		case OpExponent:
-			code("OpExponent")
-
-		case OpRange:
-			code("OpRange")
-
-		case OpMatches:
-			code("OpMatches")
-
-		case OpMatchesConst:
-			constant("OpMatchesConst")
-
-		case OpContains:
-			code("OpContains")
-
-		case OpStartsWith:
-			code("OpStartsWith")
-
-		case OpEndsWith:
-			code("OpEndsWith")
-
-		case OpIndex:
-			code("OpIndex")
-
-		case OpSlice:
-			code("OpSlice")
-
-		case OpProperty:
-			constant("OpProperty")
-
-		case OpPropertyNilSafe:
-			constant("OpPropertyNilSafe")
-
-		case OpCall:
-			constant("OpCall")
-
-		case OpCallFast:
-			constant("OpCallFast")
+// Hash returns a 64-bit FNV-1a hash of the program instructions and of the
+// settings compared by Equal. Arguments referring to constants are hashed as the type of the
+// constant and a representation which does not depend on addresses, so
+// programs which are Equal have the same hash, in every process.
+func (program *Program) Hash() uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%+v;", program.settings())
+	ip := 0
+	for ip < len(program.Bytecode) {
+		op := program.Bytecode[ip]
+		info, ok := opcodes[op]
+		if !ok || info.argument == noArgument || ip+3 > len(program.Bytecode) {
+			h.Write([]byte{op})
+			ip++
+			continue
+		}
+		if info.argument == constantArgument {
+			c := program.rawConstant(ip)
+			fmt.Fprintf(h, "%c%T:%v;", op, c, hashConstant(c))
+		} else {
+			h.Write(program.Bytecode[ip : ip+3])
+		}
+		ip += 3
+	}
+	return h.Sum64()
+}
 
-		case OpMethod:
-			constant("OpMethod")
+// settings holds what changes the results of a program besides its
+// instructions, for Equal and Hash.
+type settings struct {
+	options         Options
+	regexpCache     int // size of the regexp cache, -1 for the shared one
+	locals          int
+	multipleResults bool
+}
 
-		case OpMethodNilSafe:
-			constant("OpMethodNilSafe")
+func (program *Program) settings() settings {
+	s := settings{
+		options:         program.Options,
+		regexpCache:     -1,
+		locals:          program.Locals,
+		multipleResults: program.MultipleResults,
+	}
+	if c := s.options.RegexpCache; c != nil {
+		s.regexpCache = c.size
+	}
+	s.options.RegexpCache = nil
+	return s
+}
 
-		case OpArray:
-			code("OpArray")
+func (program *Program) Disassemble() string {
+	out := ""
+	ip := 0
+	for ip < len(program.Bytecode) {
+		pp := ip
+		op := program.Bytecode[ip]
+		ip++
 
-		case OpMap:
-			code("OpMap")
+		info, ok := opcodes[op]
+		if !ok {
+			out += fmt.Sprintf("%v\t%#x\n", pp, op)
+			continue
+		}
 
-		case OpLen:
-			code("OpLen")
+		if info.argument == noArgument {
+			out += fmt.Sprintf("%v\t%v\n", pp, info.name)
+			continue
+		}
 
-		case OpCast:
-			argument("OpCast")
+		var a uint16
+		if ip+1 < len(program.Bytecode) {
+			a = binary.LittleEndian.Uint16([]byte{program.Bytecode[ip], program.Bytecode[ip+1]})
+			ip += 2
+		}
 
-		case OpStore:
-			constant("OpStore")
+		switch info.argument {
+		case jumpArgument:
+			out += fmt.Sprintf("%v\t%v\t%v\t(%v)\n", pp, info.name, a, ip+int(a))
+		case backwardArgument:
+			out += fmt.Sprintf("%v\t%v\t%v\t(%v)\n", pp, info.name, a, ip-int(a))
+		case valueArgument:
+			out += fmt.Sprintf("%v\t%v\t%v\n", pp, info.name, a)
+		case constantArgument:
+			out += fmt.Sprintf("%v\t%v\t%v\t%v\n", pp, info.name, a, formatConstant(program.constant(a)))
+		}
+	}
+	return out
+}
 
-		case OpLoad:
-			constant("OpLoad")
+// constant returns the constant at index a in a printable form.
+func (program *Program) constant(a uint16) interface{} {
+	var c interface{}
+	if int(a) < len(program.Constants) {
+		c = program.Constants[a]
+	}
+	if r, ok := c.(*regexp.Regexp); ok {
+		c = r.String()
+	}
+	if f, ok := c.(Func); ok {
+		c = Call{Name: f.Name, Size: f.Size}
+	}
+	return c
+}
 
-		case OpInc:
-			constant("OpInc")
+// formatConstant formats c for Disassemble. Floats use the shortest
+// representation which reads back to the same value, so the output is the
+// same on every platform.
+func formatConstant(c interface{}) string {
+	switch f := c.(type) {
+	case float64:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(f), 'g', -1, 32)
+	}
+	return fmt.Sprintf("%#v", c)
+}
 
-		case OpBegin:
-			code("OpBegin")
+// rawConstant returns the constant referred to by the argument of the
+// instruction at ip, as stored in the program.
+func (program *Program) rawConstant(ip int) interface{} {
+	a := binary.LittleEndian.Uint16([]byte{program.Bytecode[ip+1], program.Bytecode[ip+2]})
+	if int(a) < len(program.Constants) {
+		return program.Constants[a]
+	}
+	return nil
+}
 
-		case OpEnd:
-			code("OpEnd")
+// equalConstant reports whether constants a and b of two programs are the
+// same.
+func equalConstant(a, b interface{}) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	switch x := a.(type) {
+	case *regexp.Regexp:
+		return x.String() == b.(*regexp.Regexp).String()
+	case Func:
+		y := b.(Func)
+		return x.Name == y.Name && x.Size == y.Size && x.Fn.IsValid() == y.Fn.IsValid() &&
+			(!x.Fn.IsValid() || x.Fn.Pointer() == y.Fn.Pointer())
+	}
+	return equal(a, b).(bool)
+}
 
-		default:
-			out += fmt.Sprintf("%v\t%#x\n", pp, op)
+// hashConstant formats the constant c for Hash. Pointers are formatted by
+// the value they point to, and functions by name and size, so the result
+// does not depend on addresses.
+func hashConstant(c interface{}) string {
+	switch x := c.(type) {
+	case *regexp.Regexp:
+		return x.String()
+	case Func:
+		return fmt.Sprintf("%v/%v", x.Name, x.Size)
+	}
+	v := reflect.ValueOf(c)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "nil"
 		}
+		return "&" + hashConstant(v.Elem().Interface())
 	}
-	return out
+	return formatConstant(c)
+}
+
+// operand decodes the argument of the instruction at ip. Constant
+// arguments are resolved to the constant itself.
+func (program *Program) operand(ip int) interface{} {
+	info, ok := opcodes[program.Bytecode[ip]]
+	if !ok || info.argument == noArgument || ip+2 >= len(program.Bytecode) {
+		return nil
+	}
+	a := binary.LittleEndian.Uint16([]byte{program.Bytecode[ip+1], program.Bytecode[ip+2]})
+	if info.argument == constantArgument {
+		return program.constant(a)
+	}
+	return a
 }
@@ -1,10 +1,15 @@
 package vm_test
 
 import (
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/ebusto/expr/compiler"
+	"github.com/ebusto/expr/parser"
 	"github.com/ebusto/expr/vm"
+	"github.com/stretchr/testify/require"
 )
 
 func TestProgram_Disassemble(t *testing.T) {
@@ -19,3 +24,254 @@ func TestProgram_Disassemble(t *testing.T) {
 		}
 	}
 }
+
+func TestProgram_Disassemble_floats(t *testing.T) {
+	program := vm.Program{
+		Constants: []interface{}{0.1, float32(0.1), 1e21, 2.5e-8, float64(3)},
+		Bytecode:  []byte{vm.OpPush, 0, 0, vm.OpPush, 1, 0, vm.OpPush, 2, 0, vm.OpPush, 3, 0, vm.OpPush, 4, 0},
+	}
+	require.Equal(t, "0\tOpPush\t0\t0.1\n"+
+		"3\tOpPush\t1\t0.1\n"+
+		"6\tOpPush\t2\t1e+21\n"+
+		"9\tOpPush\t3\t2.5e-08\n"+
+		"12\tOpPush\t4\t3\n", program.Disassemble())
+}
+
+func TestOpcodes(t *testing.T) {
+	ops := vm.Opcodes()
+	require.Equal(t, vm.OpPush, ops[0])
+	require.Equal(t, vm.OpEnd, ops[len(ops)-1])
+	for i, op := range ops {
+		require.Equal(t, byte(i), op)
+		require.NotEmpty(t, vm.OpcodeName(op), "opcode %v has no name", op)
+	}
+	require.Empty(t, vm.OpcodeName(vm.OpEnd+1))
+
+	// Values of opcodes do not change when opcodes are added.
+	require.Equal(t, byte(0), vm.OpPush)
+	require.Equal(t, byte(32), vm.OpMatchesFlags)
+	require.Equal(t, byte(53), vm.OpBegin)
+	require.Equal(t, byte(54), vm.OpStoreLocal)
+	require.Equal(t, byte(71), vm.OpIndexNilSafe)
+	require.True(t, vm.HasArgument(vm.OpPush))
+	require.False(t, vm.HasArgument(vm.OpPop))
+}
+
+func compile(t *testing.T, code string) *vm.Program {
+	tree, err := parser.Parse(code)
+	require.NoError(t, err)
+	program, err := compiler.Compile(tree, nil)
+	require.NoError(t, err)
+	return program
+}
+
+func TestProgram_Equal(t *testing.T) {
+	require.True(t, compile(t, `foo > 1`).Equal(compile(t, `foo  >  1`)))
+	require.True(t, compile(t, `foo matches "a+" && bar`).Equal(compile(t, `(foo matches "a+") and bar`)))
+	require.False(t, compile(t, `foo > 1`).Equal(compile(t, `foo > 2`)))
+	require.False(t, compile(t, `foo > 1`).Equal(compile(t, `foo > 1.0`)))
+	require.False(t, compile(t, `foo > 1`).Equal(compile(t, `bar > 1`)))
+	require.False(t, compile(t, `foo > 1`).Equal(nil))
+
+	// Same instructions with constants in a different order.
+	a := &vm.Program{
+		Constants: []interface{}{"foo", 1},
+		Bytecode:  []byte{vm.OpFetch, 0, 0, vm.OpPush, 1, 0, vm.OpMore},
+	}
+	b := &vm.Program{
+		Constants: []interface{}{1, "foo"},
+		Bytecode:  []byte{vm.OpFetch, 1, 0, vm.OpPush, 0, 0, vm.OpMore},
+	}
+	require.True(t, a.Equal(b))
+}
+
+func TestProgram_Hash(t *testing.T) {
+	require.Equal(t, compile(t, `foo > 1 && bar in ["a", "b"]`).Hash(), compile(t, `foo>1 and bar in ['a','b']`).Hash())
+	require.NotEqual(t, compile(t, `foo > 1`).Hash(), compile(t, `foo > 2`).Hash())
+	require.NotEqual(t, compile(t, `foo > 1`).Hash(), compile(t, `foo > 1.0`).Hash())
+	require.NotEqual(t, compile(t, `foo > 1`).Hash(), compile(t, `foo < 1`).Hash())
+
+	a := &vm.Program{
+		Constants: []interface{}{"foo", 1},
+		Bytecode:  []byte{vm.OpFetch, 0, 0, vm.OpPush, 1, 0, vm.OpMore},
+	}
+	b := &vm.Program{
+		Constants: []interface{}{1, "foo"},
+		Bytecode:  []byte{vm.OpFetch, 1, 0, vm.OpPush, 0, 0, vm.OpMore},
+	}
+	require.Equal(t, a.Hash(), b.Hash())
+
+	// Pointer constants hash by the value they point to.
+	type point struct{ X, Y int }
+	a = &vm.Program{Constants: []interface{}{&point{1, 2}}, Bytecode: []byte{vm.OpPush, 0, 0}}
+	b = &vm.Program{Constants: []interface{}{&point{1, 2}}, Bytecode: []byte{vm.OpPush, 0, 0}}
+	require.True(t, a.Equal(b))
+	require.Equal(t, a.Hash(), b.Hash())
+	b.Constants[0] = &point{2, 1}
+	require.False(t, a.Equal(b))
+	require.NotEqual(t, a.Hash(), b.Hash())
+}
+
+func TestProgram_Equal_options(t *testing.T) {
+	for _, set := range []func(p *vm.Program){
+		func(p *vm.Program) { p.MissingKey = vm.MissingKeyError },
+		func(p *vm.Program) { p.MaxApplyDepth = 5 },
+		func(p *vm.Program) { p.MaxRecursion = 5 },
+		func(p *vm.Program) { p.NumericStrings = true },
+		func(p *vm.Program) { p.NoNaNComparison = true },
+		func(p *vm.Program) { p.RegexpCache = vm.NewRegexpCache(10) },
+		func(p *vm.Program) { p.MaxPatternLength = 5 },
+		func(p *vm.Program) { p.MaxMatchLength = 5 },
+		func(p *vm.Program) { p.Locals = 2 },
+		func(p *vm.Program) { p.MultipleResults = true },
+	} {
+		a, b := compile(t, `m.a`), compile(t, `m.a`)
+		set(b)
+		require.False(t, a.Equal(b))
+		require.NotEqual(t, a.Hash(), b.Hash())
+
+		set(a)
+		require.True(t, a.Equal(b))
+		require.Equal(t, a.Hash(), b.Hash())
+	}
+}
+
+func TestProgram_Equal_constants(t *testing.T) {
+	inc := reflect.ValueOf(func(x int) int { return x + 1 })
+	dec := reflect.ValueOf(func(x int) int { return x - 1 })
+	program := func(c interface{}) *vm.Program {
+		return &vm.Program{Constants: []interface{}{c}, Bytecode: []byte{vm.OpCallFunc, 0, 0}}
+	}
+	require.True(t, program(vm.Func{Name: "f", Fn: inc, Size: 1}).Equal(program(vm.Func{Name: "f", Fn: inc, Size: 1})))
+	require.False(t, program(vm.Func{Name: "f", Fn: inc, Size: 1}).Equal(program(vm.Func{Name: "f", Fn: dec, Size: 1})))
+	require.False(t, program(vm.Func{Name: "f", Fn: inc, Size: 1}).Equal(program(vm.Call{Name: "f", Size: 1})))
+	require.NotEqual(t, program(vm.Func{Name: "f", Fn: inc, Size: 1}).Hash(), program(vm.Call{Name: "f", Size: 1}).Hash())
+	require.False(t, program(regexp.MustCompile("a+")).Equal(program("a+")))
+	require.True(t, program(regexp.MustCompile("a+")).Equal(program(regexp.MustCompile("a+"))))
+}
+
+func TestProgram_EvalBool(t *testing.T) {
+	tree, err := parser.Parse(`foo > 1`)
+	require.NoError(t, err)
+
+	program, err := compiler.Compile(tree, nil)
+	require.NoError(t, err)
+
+	ok, err := program.EvalBool(map[string]interface{}{"foo": 2})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	tree, err = parser.Parse(`foo + 1`)
+	require.NoError(t, err)
+
+	program, err = compiler.Compile(tree, nil)
+	require.NoError(t, err)
+
+	_, err = program.EvalBool(map[string]interface{}{"foo": 2})
+	require.EqualError(t, err, "expected bool, but got int")
+}
+
+func TestProgram_EvalTruthy(t *testing.T) {
+	program := compile(t, `foo`)
+	for _, tt := range []struct {
+		foo  interface{}
+		want bool
+	}{
+		{nil, false},
+		{0, false},
+		{0.0, false},
+		{"", false},
+		{[]interface{}{}, false},
+		{map[string]interface{}{}, false},
+		{false, false},
+		{true, true},
+		{2, true},
+		{"0", true},
+		{[]int{0}, true},
+		{map[string]int{"a": 0}, true},
+	} {
+		ok, err := program.EvalTruthy(map[string]interface{}{"foo": tt.foo})
+		require.NoError(t, err, "%#v", tt.foo)
+		require.Equal(t, tt.want, ok, "%#v", tt.foo)
+	}
+
+	_, err := compile(t, `foo.bar`).EvalTruthy(map[string]interface{}{"foo": 1})
+	require.Error(t, err)
+}
+
+func TestStackEffects(t *testing.T) {
+	for _, op := range vm.Opcodes() {
+		_, ok := vm.StackEffects[op]
+		require.True(t, ok, "opcode %v has no stack effect", vm.OpcodeName(op))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, code := range []string{
+		`foo > 1 && bar`,
+		`foo ? [1, 2] : {a: 1}`,
+		`map(filter(Array, {# > 1}), {# * 2})`,
+		`all(Array, {one(#, {# > 0})})`,
+		`let x = foo.Bar(1, 2); x[1:2]`,
+		`try(foo[1], 0) + try(map(Array, {# / 0}))`,
+	} {
+		require.NoError(t, vm.Verify(compile(t, code)), code)
+	}
+
+	tests := []struct {
+		program *vm.Program
+		err     string
+	}{
+		{
+			&vm.Program{Bytecode: []byte{vm.OpTrue, vm.OpAdd}},
+			"stack underflow at 1: OpAdd needs 2 values, but got 1",
+		},
+		{
+			&vm.Program{Bytecode: []byte{vm.OpTrue, vm.OpJumpIfTrue, 1, 0, vm.OpPop, vm.OpPop, vm.OpPop}},
+			"stack underflow at 5: OpPop needs 1 values, but got 0",
+		},
+		{
+			&vm.Program{
+				Constants: []interface{}{vm.Call{Name: "foo", Size: 2}},
+				Bytecode:  []byte{vm.OpTrue, vm.OpCall, 0, 0},
+			},
+			"stack underflow at 1: OpCall needs 2 values, but got 1",
+		},
+		{
+			&vm.Program{
+				Constants: []interface{}{2},
+				Bytecode:  []byte{vm.OpTrue, vm.OpPush, 0, 0, vm.OpArray},
+			},
+			"stack underflow at 4: OpArray needs 3 values, but got 2",
+		},
+		{
+			&vm.Program{Bytecode: []byte{vm.OpPush, 0}},
+			"missing argument of OpPush at 0",
+		},
+		{
+			// Jump into the argument of OpPush.
+			&vm.Program{
+				Constants: []interface{}{1},
+				Bytecode:  []byte{vm.OpTrue, vm.OpJumpIfTrue, 1, 0, vm.OpPush, 0, 0},
+			},
+			"invalid target 5 of OpJumpIfTrue at 1",
+		},
+		{
+			&vm.Program{Bytecode: []byte{vm.OpJump, 2, 0, vm.OpTrue}},
+			"invalid target 5 of OpJump at 0",
+		},
+		{
+			&vm.Program{Bytecode: []byte{vm.OpTrue, vm.OpJumpBackward, 5, 0}},
+			"invalid target -1 of OpJumpBackward at 1",
+		},
+		{
+			&vm.Program{Bytecode: []byte{0xff}},
+			"unknown bytecode 0xff at 0",
+		},
+	}
+	for _, test := range tests {
+		err := vm.Verify(test.program)
+		require.Error(t, err)
+		require.Equal(t, test.err, err.Error())
+	}
+}
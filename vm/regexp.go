@@ -0,0 +1,119 @@
+package vm
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// DefaultRegexpCacheSize is the number of regexps kept by the cache shared
+// by all programs which are not given another one.
+const DefaultRegexpCacheSize = 1000
+
+// regexps caches the compiled patterns of matches for programs without a
+// cache of their own, as programs often share a few patterns, and patterns
+// computed at runtime are compiled on every run otherwise.
+var regexps = NewRegexpCache(DefaultRegexpCacheSize)
+
+// RegexpCache keeps the most recently used regexps compiled by matches. It
+// may be shared by programs, and used by several goroutines at once.
+type RegexpCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List // most recently used first
+}
+
+type regexpItem struct {
+	pattern string
+	regexp  *regexp.Regexp
+}
+
+// NewRegexpCache returns a cache of at most size regexps. A cache of size 0
+// keeps none, so patterns are compiled every time.
+func NewRegexpCache(size int) *RegexpCache {
+	return &RegexpCache{
+		size:  size,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Compile compiles the pattern of matches, or returns the regexp cached
+// for it.
+func (c *RegexpCache) Compile(pattern string) (*regexp.Regexp, error) {
+	if r, ok := c.get(pattern); ok {
+		return r, nil
+	}
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.add(pattern, r)
+	return r, nil
+}
+
+func (c *RegexpCache) get(pattern string) (*regexp.Regexp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[pattern]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*regexpItem).regexp, true
+}
+
+func (c *RegexpCache) add(pattern string, r *regexp.Regexp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[pattern]; ok || c.size <= 0 {
+		return
+	}
+	c.items[pattern] = c.order.PushFront(&regexpItem{pattern, r})
+	for c.order.Len() > c.size {
+		last := c.order.Remove(c.order.Back()).(*regexpItem)
+		delete(c.items, last.pattern)
+	}
+}
+
+// Clear discards the regexps compiled so far.
+func (c *RegexpCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// ClearRegexpCache discards the regexps compiled so far by the cache shared
+// by programs without one of their own.
+func ClearRegexpCache() {
+	regexps.Clear()
+}
+
+// regexpCache returns the cache of the options, or the shared one.
+func (o Options) regexpCache() *RegexpCache {
+	if o.RegexpCache != nil {
+		return o.RegexpCache
+	}
+	return regexps
+}
+
+// compileRegexp compiles the pattern of matches with the regexp cache of
+// the program, unless it is longer than MaxPatternLength.
+func (o Options) compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if err := ValidatePatternLength(pattern, o.MaxPatternLength); err != nil {
+		return nil, err
+	}
+	return o.regexpCache().Compile(pattern)
+}
+
+// match panics if s is longer than MaxMatchLength. Go regexps run in time
+// linear in the length of s, so the limit bounds the time of matches.
+func (o Options) match(r *regexp.Regexp, s string) bool {
+	if o.MaxMatchLength > 0 && len(s) > o.MaxMatchLength {
+		panic(fmt.Sprintf("string of %v bytes exceeds the limit of %v for matches", len(s), o.MaxMatchLength))
+	}
+	return r.MatchString(s)
+}
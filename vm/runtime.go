@@ -3,9 +3,14 @@ package vm
 //go:generate go run ./generate
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"math"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 type Call struct {
@@ -13,20 +18,49 @@ type Call struct {
 	Size int
 }
 
+// Func is a function called by OpCallFunc, which does not come from env,
+// such as a function of an overloaded operator.
+type Func struct {
+	Name string
+	Fn   reflect.Value
+	Size int
+}
+
 type Scope map[string]interface{}
 
 type Fetcher interface {
 	Fetch(interface{}) interface{}
 }
 
-func fetch(from, i interface{}, nilsafe bool) interface{} {
+// Lookuper is implemented by a Fetcher which can tell a variable which is
+// nil apart from one it does not have. Lookup reports whether it has the
+// variable. Without it, undefined variables of a Fetcher env cannot be
+// reported by name with DisallowUndefinedVariables.
+type Lookuper interface {
+	Lookup(interface{}) (interface{}, bool)
+}
+
+// Equaler is implemented by values with their own notion of equality.
+// It is used by ==, !=, in and every other operator relying on equality.
+type Equaler interface {
+	Equal(interface{}) bool
+}
+
+// Comparer is implemented by values with their own ordering. Compare
+// returns a negative number, zero or a positive number when the value is
+// less than, equal to or greater than its argument.
+type Comparer interface {
+	Compare(interface{}) int
+}
+
+func fetch(from, i interface{}, nilsafe bool, missing MissingKeyPolicy) interface{} {
 	if fetcher, ok := from.(Fetcher); ok {
 		value := fetcher.Fetch(i)
 		if value != nil {
 			return value
 		}
 		if !nilsafe {
-			panic(fmt.Sprintf("cannot fetch %v from %T", i, from))
+			panic(fetchError{i, from})
 		}
 		return nil
 	}
@@ -50,30 +84,145 @@ func fetch(from, i interface{}, nilsafe bool) interface{} {
 
 	switch kind {
 	case reflect.Array, reflect.Slice, reflect.String:
-		return normalize(v.Index(toInt(i)))
+		index := toInt(i)
+		if nilsafe && (index < 0 || index >= v.Len()) {
+			return nil
+		}
+		return normalize(v.Index(index))
 
 	case reflect.Map:
+		if v.IsNil() {
+			if !nilsafe {
+				panic(fetchError{i, from})
+			}
+			return nil
+		}
 		value := v.MapIndex(reflect.ValueOf(i))
 
 		if value.IsValid() {
 			return normalize(value)
 		}
 
-		elem := reflect.TypeOf(from).Elem()
-
-		return reflect.Zero(elem).Interface()
+		switch missing {
+		case MissingKeyNil:
+			return nil
+		case MissingKeyError:
+			if !nilsafe {
+				panic(fetchError{i, from})
+			}
+			return nil
+		}
+		return reflect.Zero(v.Type().Elem()).Interface()
 
 	case reflect.Struct:
-		return normalize(v.FieldByName(reflect.ValueOf(i).String()))
+		if field := v.FieldByName(reflect.ValueOf(i).String()); field.IsValid() {
+			return normalize(field)
+		}
+		return nil
 	}
 
 	if !nilsafe {
-		panic(fmt.Sprintf("cannot fetch %v from %T", i, from))
+		panic(fetchError{i, from})
 	}
 
 	return nil
 }
 
+// fetchEnv returns the variable of env with the given name, or nil if env
+// is nil.
+func fetchEnv(env, name interface{}, nilsafe bool, missing MissingKeyPolicy) interface{} {
+	if env == nil {
+		return nil
+	}
+	return fetch(env, name, nilsafe, missing)
+}
+
+// fetchStrict returns the variable of env with the given name, and fails
+// naming it if env does not have it, even if env is a map with a policy
+// for missing keys.
+func fetchStrict(env interface{}, name string, missing MissingKeyPolicy) interface{} {
+	if lookuper, ok := env.(Lookuper); ok {
+		if value, ok := lookuper.Lookup(name); ok {
+			return value
+		}
+		panic(fmt.Sprintf("unknown variable %v", name))
+	}
+	if _, ok := env.(Fetcher); ok {
+		return fetch(env, name, false, missing)
+	}
+	v := reflect.Indirect(reflect.ValueOf(env))
+	switch v.Kind() {
+	case reflect.Invalid:
+	case reflect.Map:
+		if value := v.MapIndex(reflect.ValueOf(name)); value.IsValid() {
+			return normalize(value)
+		}
+	case reflect.Struct:
+		if f, ok := v.Type().FieldByName(name); ok && f.PkgPath == "" {
+			return normalize(v.FieldByIndex(f.Index))
+		}
+	default:
+		return fetch(env, name, false, missing)
+	}
+	panic(fmt.Sprintf("unknown variable %v", name))
+}
+
+// fetchVar returns the variable of env with the given name, for var().
+func fetchVar(env interface{}, name interface{}, strict bool, missing MissingKeyPolicy) interface{} {
+	s, ok := name.(string)
+	if !ok {
+		panic(fmt.Sprintf("cannot use %T as variable name in var", name))
+	}
+	if strict {
+		return fetchStrict(env, s, missing)
+	}
+	return fetchEnv(env, s, false, missing)
+}
+
+// divideInf is divide, except that dividing an integer by integer zero
+// gives +Inf, -Inf or NaN, as dividing floats does.
+func divideInf(a, b interface{}) interface{} {
+	if isIntegerKind(kindOf(a)) && isIntegerKind(kindOf(b)) && toFloat64(b) == 0 {
+		var zero float64
+		return toFloat64(a) / zero
+	}
+	return divide(a, b)
+}
+
+func isIntegerKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// require returns true if cond is truthy, for require(), and otherwise fails
+// with the message.
+func require(cond, message interface{}) bool {
+	if truthy(cond) {
+		return true
+	}
+	if s, ok := message.(string); ok {
+		panic(s)
+	}
+	panic(fmt.Sprintf("%v", message))
+}
+
+// fetchError is raised by fetch if the value has no such property.
+type fetchError struct {
+	property interface{}
+	from     interface{}
+}
+
+func (e fetchError) Error() string {
+	if v := reflect.ValueOf(e.from); v.Kind() == reflect.Map && v.IsNil() {
+		return fmt.Sprintf("cannot fetch %v from nil map %T", e.property, e.from)
+	}
+	return fmt.Sprintf("cannot fetch %v from %T", e.property, e.from)
+}
+
 // normalize dereferences pointers to basic types, returning the
 // underlying value.
 func normalize(v reflect.Value) interface{} {
@@ -140,6 +289,19 @@ func slice(array, from, to interface{}) interface{} {
 	panic(fmt.Sprintf("cannot slice %v", from))
 }
 
+// callValue returns the function called by OpCallValue, which must be a
+// function returning a value.
+func callValue(fn interface{}) reflect.Value {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		panic(fmt.Sprintf("cannot call %T", fn))
+	}
+	if v.Type().NumOut() == 0 {
+		panic(fmt.Sprintf("func %T doesn't return value", fn))
+	}
+	return v
+}
+
 func FetchFn(from interface{}, name string) reflect.Value {
 	v := reflect.ValueOf(from)
 
@@ -184,6 +346,17 @@ func in(needle interface{}, array interface{}) bool {
 	if array == nil {
 		return false
 	}
+
+	// Byte slices are searched for a subsequence, like strings.
+	if b, ok := array.([]byte); ok {
+		switch n := needle.(type) {
+		case []byte:
+			return bytes.Contains(b, n)
+		case string:
+			return bytes.Contains(b, []byte(n))
+		}
+	}
+
 	v := reflect.ValueOf(array)
 
 	switch v.Kind() {
@@ -208,7 +381,7 @@ func in(needle interface{}, array interface{}) bool {
 		if value.IsValid() {
 			return true
 		}
-		return false
+		return inPath(needle, array)
 
 	case reflect.Struct:
 		n := reflect.ValueOf(needle)
@@ -219,7 +392,7 @@ func in(needle interface{}, array interface{}) bool {
 		if value.IsValid() {
 			return true
 		}
-		return false
+		return inPath(needle, array)
 
 	case reflect.Ptr:
 		value := v.Elem()
@@ -232,6 +405,121 @@ func in(needle interface{}, array interface{}) bool {
 	panic(fmt.Sprintf(`operator "in"" not defined on %T`, array))
 }
 
+// maxEqualDepth limits how deep deepEqual descends into nested arrays and
+// maps before handing over to reflect.DeepEqual, which copes with cycles.
+const maxEqualDepth = 100
+
+// deepEqual compares arrays and slices element by element and maps key by
+// key, using equal for the values, so [1, 2] equals []float64{1, 2}.
+func deepEqual(a, b interface{}, depth int) bool {
+	if depth > maxEqualDepth {
+		return reflect.DeepEqual(a, b)
+	}
+
+	x := reflect.ValueOf(a)
+	y := reflect.ValueOf(b)
+	if !x.IsValid() || !y.IsValid() {
+		return reflect.DeepEqual(a, b)
+	}
+
+	switch {
+	case isSequence(x) && isSequence(y):
+		if x.Len() != y.Len() {
+			return false
+		}
+		for i := 0; i < x.Len(); i++ {
+			if !equalElement(x.Index(i).Interface(), y.Index(i).Interface(), depth) {
+				return false
+			}
+		}
+		return true
+
+	case x.Kind() == reflect.Map && y.Kind() == reflect.Map:
+		if x.Len() != y.Len() {
+			return false
+		}
+		for _, key := range x.MapKeys() {
+			if !key.Type().AssignableTo(y.Type().Key()) {
+				return false
+			}
+			value := y.MapIndex(key)
+			if !value.IsValid() {
+				return false
+			}
+			if !equalElement(x.MapIndex(key).Interface(), value.Interface(), depth) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// equalElement compares a pair of nested values, keeping track of depth
+// for nested arrays and maps.
+func equalElement(a, b interface{}, depth int) bool {
+	x := reflect.ValueOf(a)
+	y := reflect.ValueOf(b)
+	if (isSequence(x) && isSequence(y)) || (x.Kind() == reflect.Map && y.Kind() == reflect.Map) {
+		return deepEqual(a, b, depth+1)
+	}
+	return equal(a, b).(bool)
+}
+
+func isSequence(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice || v.Kind() == reflect.Array
+}
+
+// inPath reports whether the needle is a dotted path, such as "a.b", which
+// exists in the value.
+func inPath(needle interface{}, from interface{}) bool {
+	path, ok := needle.(string)
+	if !ok || !strings.Contains(path, ".") {
+		return false
+	}
+	_, ok = lookupPath(from, path)
+	return ok
+}
+
+// WithFlags prefixes the regexp pattern with inline flags, such as "i" for
+// case-insensitive matching. It returns an error if flags contain an
+// unknown flag.
+func WithFlags(pattern, flags string) (string, error) {
+	if err := ValidateFlags(flags); err != nil {
+		return "", err
+	}
+	if flags == "" {
+		return pattern, nil
+	}
+	return "(?" + flags + ")" + pattern, nil
+}
+
+// CompileRegexp compiles the pattern of matches. Regexps are kept by the
+// cache shared by programs.
+func CompileRegexp(pattern string) (*regexp.Regexp, error) {
+	return regexps.Compile(pattern)
+}
+
+// ValidatePatternLength reports an error if the pattern is longer than max
+// bytes, unless max is 0.
+func ValidatePatternLength(pattern string, max int) error {
+	if max > 0 && len(pattern) > max {
+		return fmt.Errorf("regexp of %v bytes exceeds the limit of %v", len(pattern), max)
+	}
+	return nil
+}
+
+// ValidateFlags reports an error if flags are not valid regexp flags.
+func ValidateFlags(flags string) error {
+	for _, f := range flags {
+		if !strings.ContainsRune("imsU", f) {
+			return fmt.Errorf("invalid regexp flag %q in %q", f, flags)
+		}
+	}
+	return nil
+}
+
 func length(a interface{}) int {
 	v := reflect.ValueOf(a)
 	switch v.Kind() {
@@ -242,6 +530,22 @@ func length(a interface{}) int {
 	}
 }
 
+// elements returns the values of a map, in the order of its sorted keys, so
+// that closures visit maps as arrays. Other values are returned as is.
+func elements(a interface{}) interface{} {
+	v := reflect.ValueOf(a)
+	if v.Kind() != reflect.Map {
+		return a
+	}
+	keys := v.MapKeys()
+	sortKeys(keys)
+	out := make([]interface{}, len(keys))
+	for i, k := range keys {
+		out[i] = v.MapIndex(k).Interface()
+	}
+	return out
+}
+
 func negate(i interface{}) interface{} {
 	switch v := i.(type) {
 	case float32:
@@ -272,6 +576,9 @@ func negate(i interface{}) interface{} {
 		return -v
 
 	default:
+		if n, ok := number(v); ok {
+			return negate(n)
+		}
 		panic(fmt.Sprintf("invalid operation: - %T", v))
 	}
 }
@@ -322,6 +629,9 @@ func toInt(a interface{}) int {
 		return int(x)
 
 	default:
+		if n, ok := number(x); ok {
+			return toInt(n)
+		}
 		panic(fmt.Sprintf("invalid operation: int(%T)", x))
 	}
 }
@@ -356,6 +666,9 @@ func toInt64(a interface{}) int64 {
 		return int64(x)
 
 	default:
+		if n, ok := number(x); ok {
+			return toInt64(n)
+		}
 		panic(fmt.Sprintf("invalid operation: int64(%T)", x))
 	}
 }
@@ -390,10 +703,187 @@ func toFloat64(a interface{}) float64 {
 		return float64(x)
 
 	default:
+		if n, ok := number(x); ok {
+			return toFloat64(n)
+		}
 		panic(fmt.Sprintf("invalid operation: float64(%T)", x))
 	}
 }
 
+// jsonNumber returns the value of n as an int64, or as a float64 if it is
+// not an integer which fits.
+func jsonNumber(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, err := n.Float64()
+	if err != nil {
+		panic(fmt.Sprintf("invalid number %q", string(n)))
+	}
+	return f
+}
+
+// number returns the value of a json.Number as an int64 or a float64, and
+// reports whether x was a json.Number.
+func number(x interface{}) (interface{}, bool) {
+	if n, ok := x.(json.Number); ok {
+		return jsonNumber(n), true
+	}
+	return x, false
+}
+
+// numericString returns the number held by x as an int64 or a float64 if
+// x is a string holding one, or x otherwise.
+func numericString(x interface{}) interface{} {
+	s, ok := x.(string)
+	if !ok {
+		return x
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+	return x
+}
+
+// numericOperands converts the strings holding numbers among the operands
+// of a binary operator, for the NumericStrings option. A string is only
+// converted against a number, or against another string if the operator
+// is not defined on strings, so "1" + "2" is still "12".
+func numericOperands(a, b interface{}, stringOperator bool) (interface{}, interface{}) {
+	_, isStringA := a.(string)
+	_, isStringB := b.(string)
+	switch {
+	case isStringA && isStringB:
+		if !stringOperator {
+			return numericString(a), numericString(b)
+		}
+	case isStringA && isNumber(b):
+		return numericString(a), b
+	case isStringB && isNumber(a):
+		return a, numericString(b)
+	}
+	return a, b
+}
+
+// numericArgs converts the strings holding numbers among the arguments of
+// the builtin which take numbers, for the NumericStrings option.
+func numericArgs(builtin *Builtin, in []interface{}) {
+	for i := range in {
+		kind := ArgAny
+		switch {
+		case i < len(builtin.Args):
+			kind = builtin.Args[i]
+		case builtin.Variadic && len(builtin.Args) > 0:
+			kind = builtin.Args[len(builtin.Args)-1]
+		}
+		if kind == ArgNumber {
+			in[i] = numericString(in[i])
+		}
+	}
+}
+
+// isNumber reports whether x is a number or a json.Number.
+func isNumber(x interface{}) bool {
+	if _, ok := x.(json.Number); ok {
+		return true
+	}
+	switch kindOf(x) {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// numbers returns the operands of a binary operator converted by number,
+// and reports whether any of them was converted.
+func numbers(a, b interface{}) (interface{}, interface{}, bool) {
+	a, okA := number(a)
+	b, okB := number(b)
+	return a, b, okA || okB
+}
+
+// Integer converts the value of an integer literal to its checked type t,
+// which may be any numeric type.
+func Integer(value int, t reflect.Type) interface{} {
+	if t == nil {
+		return value
+	}
+
+	switch t.Kind() {
+	case reflect.Float32:
+		return float32(value)
+	case reflect.Float64:
+		return float64(value)
+
+	case reflect.Int:
+		return int(value)
+	case reflect.Int8:
+		return int8(value)
+	case reflect.Int16:
+		return int16(value)
+	case reflect.Int32:
+		return int32(value)
+	case reflect.Int64:
+		return int64(value)
+
+	case reflect.Uint:
+		return uint(value)
+	case reflect.Uint8:
+		return uint8(value)
+	case reflect.Uint16:
+		return uint16(value)
+	case reflect.Uint32:
+		return uint32(value)
+	case reflect.Uint64:
+		return uint64(value)
+
+	default:
+		return value
+	}
+}
+
+// checkNaN panics if a or b is NaN, as comparisons with NaN are always
+// false, except for !=.
+func checkNaN(a, b interface{}) {
+	if isNaN(a) || isNaN(b) {
+		panic(fmt.Sprintf("comparison of %v and %v", a, b))
+	}
+}
+
+// checkNaNArgs panics if any argument of the builtin, or any element of its
+// array arguments, is NaN, as the builtin compares them.
+func checkNaNArgs(builtin string, args []interface{}) {
+	for _, arg := range args {
+		if isNaN(arg) {
+			panic(fmt.Sprintf("comparison of %v in %v", arg, builtin))
+		}
+		v := reflect.ValueOf(arg)
+		switch v.Kind() {
+		case reflect.Array, reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				if x := v.Index(i).Interface(); isNaN(x) {
+					panic(fmt.Sprintf("comparison of %v in %v", x, builtin))
+				}
+			}
+		}
+	}
+}
+
+func isNaN(v interface{}) bool {
+	switch f := v.(type) {
+	case float32:
+		return f != f
+	case float64:
+		return f != f
+	}
+	return false
+}
+
 func isNil(v interface{}) bool {
 	if v == nil {
 		return true
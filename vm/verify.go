@@ -0,0 +1,176 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Verify checks that every jump of the program targets the start of an
+// instruction or the end of the bytecode, and that no instruction pops a
+// value from an empty stack, following every path through the bytecode.
+//
+// The number of elements popped by OpArray and OpMap is only known if the
+// size is pushed by the preceding OpPush, as the compiler does for array
+// and map literals. Otherwise only the size itself is accounted for, as
+// the elements are pushed by a loop.
+func Verify(program *Program) error {
+	if program == nil {
+		return fmt.Errorf("program is nil")
+	}
+	v := verifier{
+		program:  program,
+		heights:  make(map[int]int),
+		previous: make(map[int]int),
+	}
+	for ip, prev := 0, -1; ip < len(program.Bytecode); {
+		v.previous[ip] = prev
+		prev = ip
+		ip++
+		if HasArgument(program.Bytecode[prev]) {
+			ip += 2
+		}
+	}
+	if err := v.jumps(); err != nil {
+		return err
+	}
+	v.visit(0, 0)
+	for len(v.queue) > 0 {
+		ip := v.queue[len(v.queue)-1]
+		v.queue = v.queue[:len(v.queue)-1]
+		if err := v.step(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	program  *Program
+	heights  map[int]int // lowest known stack height before each instruction
+	previous map[int]int // start of the instruction preceding each one
+	queue    []int
+}
+
+// visit schedules ip to be checked with the given stack height, unless it
+// was already checked with the same or a lower height.
+func (v *verifier) visit(ip, height int) {
+	if ip >= len(v.program.Bytecode) {
+		return
+	}
+	if h, ok := v.heights[ip]; ok && h <= height {
+		return
+	}
+	v.heights[ip] = height
+	v.queue = append(v.queue, ip)
+}
+
+func (v *verifier) step(ip int) error {
+	bytecode := v.program.Bytecode
+	op := bytecode[ip]
+	info, ok := opcodes[op]
+	if !ok {
+		return fmt.Errorf("unknown bytecode %#x at %v", op, ip)
+	}
+	next := ip + 1
+	var arg int
+	if info.argument != noArgument {
+		next += 2
+		if next > len(bytecode) {
+			return fmt.Errorf("missing argument of %v at %v", info.name, ip)
+		}
+		arg = int(binary.LittleEndian.Uint16(bytecode[ip+1 : ip+3]))
+	}
+
+	effect := StackEffects[op]
+	min, delta := effect.Min, effect.Delta
+	switch op {
+	case OpCall, OpCallFast, OpCallBuiltin, OpMethod, OpMethodNilSafe, OpCallValue:
+		call, ok := v.constant(arg).(Call)
+		if !ok {
+			return fmt.Errorf("%v at %v expects call constant", info.name, ip)
+		}
+		min += call.Size
+		delta -= call.Size
+	case OpCallFunc:
+		fn, ok := v.constant(arg).(Func)
+		if !ok {
+			return fmt.Errorf("%v at %v expects func constant", info.name, ip)
+		}
+		min += fn.Size
+		delta -= fn.Size
+	case OpArray, OpMap:
+		if size, ok := v.size(ip); ok {
+			if op == OpMap {
+				size *= 2
+			}
+			min += size
+			delta -= size
+		}
+	}
+
+	height := v.heights[ip]
+	if height < min {
+		return fmt.Errorf("stack underflow at %v: %v needs %v values, but got %v", ip, info.name, min, height)
+	}
+	height += delta
+
+	switch info.argument {
+	case jumpArgument:
+		v.visit(next+arg, height)
+		if op == OpJump {
+			return nil
+		}
+	case backwardArgument:
+		v.visit(next-arg, height)
+		return nil
+	}
+	v.visit(next, height)
+	return nil
+}
+
+// jumps checks the targets of all jumps, including unreachable ones.
+func (v *verifier) jumps() error {
+	bytecode := v.program.Bytecode
+	for ip := 0; ip < len(bytecode); ip++ {
+		info := opcodes[bytecode[ip]]
+		if info.argument == noArgument {
+			continue
+		}
+		next := ip + 3
+		if next > len(bytecode) {
+			break // reported as missing argument
+		}
+		if info.argument != jumpArgument && info.argument != backwardArgument {
+			ip += 2
+			continue
+		}
+		offset := int(binary.LittleEndian.Uint16(bytecode[ip+1 : ip+3]))
+		target := next + offset
+		if info.argument == backwardArgument {
+			target = next - offset
+		}
+		if _, ok := v.previous[target]; !ok && target != len(bytecode) {
+			return fmt.Errorf("invalid target %v of %v at %v", target, info.name, ip)
+		}
+		ip += 2
+	}
+	return nil
+}
+
+func (v *verifier) constant(index int) interface{} {
+	if index < len(v.program.Constants) {
+		return v.program.Constants[index]
+	}
+	return nil
+}
+
+// size returns the size pushed by the instruction right before ip.
+func (v *verifier) size(ip int) (int, bool) {
+	prev, ok := v.previous[ip]
+	if !ok || prev < 0 || v.program.Bytecode[prev] != OpPush {
+		return 0, false
+	}
+	index := binary.LittleEndian.Uint16(v.program.Bytecode[prev+1 : prev+3])
+	size, ok := v.constant(int(index)).(int)
+	return size, ok
+}
@@ -0,0 +1,14 @@
+package vm
+
+import "github.com/ebusto/expr/internal/version"
+
+// Version is a version number, such as "1.2.0", ordered as in semantic
+// versioning: by its numeric segments, with missing ones being 0, and then
+// by its pre-release identifiers, such as "rc.1" in "1.2.0-rc.1", which
+// order it before the release. Build metadata after "+" is ignored.
+type Version = version.Version
+
+// ParseVersion parses a version, which may start with "v".
+func ParseVersion(s string) (Version, error) {
+	return version.Parse(s)
+}
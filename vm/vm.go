@@ -1,9 +1,11 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/ebusto/expr/file"
@@ -15,6 +17,69 @@ var (
 	MemoryBudget int = 1e6
 )
 
+// ErrMaxRecursion is the cause of the error of a run nesting deeper than
+// the MaxRecursion option. It is not caught by try().
+var ErrMaxRecursion = errors.New("maximum recursion depth exceeded")
+
+// ErrMemoryBudget is the cause of the error of a run allocating more than
+// MemoryBudget. It is not caught by try().
+var ErrMemoryBudget = errors.New("memory budget exceeded")
+
+// MissingKeyPolicy is the result of accessing a key which is not in a map.
+type MissingKeyPolicy int
+
+const (
+	// MissingKeyZero returns the zero value of the map elements, e.g. 0 for
+	// a map[string]int.
+	MissingKeyZero MissingKeyPolicy = iota
+	// MissingKeyNil returns nil.
+	MissingKeyNil
+	// MissingKeyError fails, unless the key is accessed with "?.".
+	MissingKeyError
+)
+
+// Options are the settings of a program which change how it runs, as set
+// by the options of the expression it is compiled from.
+type Options struct {
+	// MissingKey is the result of accessing a key which is not in a map.
+	MissingKey MissingKeyPolicy
+	// MaxApplyDepth limits how deep programs run by apply may nest, so a
+	// program applying itself fails instead of exhausting the stack. It is
+	// DefaultMaxApplyDepth if 0. Applied programs are held to the lowest
+	// limit of the programs applying them.
+	MaxApplyDepth int
+	// RegexpCache keeps the regexps compiled by matches at runtime. If nil,
+	// the cache shared by all programs is used.
+	RegexpCache *RegexpCache
+	// MaxRecursion limits how deep closures of builtins such as map, try()
+	// and programs run by apply may nest. It is DefaultMaxRecursion if 0,
+	// and there is no limit if it is negative. Applied programs are held
+	// to the lowest limit of the programs applying them.
+	MaxRecursion int
+	// NumericStrings makes arithmetic, comparisons, negation and builtins
+	// taking numbers accept strings holding numbers, such as "42" or "1.5",
+	// where they would fail otherwise, so "1" + "2" is still "12".
+	NumericStrings bool
+	// NoNaNComparison makes comparisons with NaN fail, including those of
+	// between and of builtins such as min, clamp and median.
+	NoNaNComparison bool
+	// MaxPatternLength limits the length of regular expressions of matches
+	// computed at runtime, 0 means no limit.
+	MaxPatternLength int
+	// MaxMatchLength limits the length of strings matched against regular
+	// expressions, 0 means no limit.
+	MaxMatchLength int
+}
+
+const (
+	// DefaultMaxApplyDepth is the limit of nested programs run by apply,
+	// unless the program sets another one.
+	DefaultMaxApplyDepth = 100
+	// DefaultMaxRecursion is the limit of nested closures, try() and
+	// programs, unless the program sets another one.
+	DefaultMaxRecursion = 1000
+)
+
 func Run(program *Program, env interface{}) (interface{}, error) {
 	if program == nil {
 		return nil, fmt.Errorf("program is nil")
@@ -28,14 +93,23 @@ type VM struct {
 	stack     []interface{}
 	constants []interface{}
 	bytecode  []byte
+	options   Options
 	ip        int
 	pp        int
 	scopes    []Scope
+	locals    []interface{}
 	debug     bool
 	step      chan struct{}
 	curr      chan int
 	memory    int
 	limit     int
+	depth     int // of programs run by apply
+	maxDepth  int // of programs run by apply, set by the outer VM
+	nesting   int // of closures, try() and apply
+	maxNest   int // limit of nesting, 0 for none
+	outerMax  int // limit of nesting of the VM running this one with apply
+	outer     int // nesting of the VM running this one with apply
+	profile   *profile
 }
 
 func Debug() *VM {
@@ -49,16 +123,33 @@ func Debug() *VM {
 
 func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error) {
 	defer func() {
+		if vm.profile != nil {
+			vm.profile.end()
+		}
 		if r := recover(); r != nil {
+			cause := newRuntimeError(program, vm.pp, r)
 			f := &file.Error{
 				Location: program.Locations[vm.pp],
-				Message:  fmt.Sprintf("%v", r),
+				Message:  cause.Message,
+				Err:      cause,
 			}
 			err = f.Bind(program.Source)
 		}
 	}()
 
 	vm.limit = MemoryBudget
+	vm.nesting = vm.outer
+	vm.maxNest = program.MaxRecursion
+	switch {
+	case vm.maxNest == 0:
+		vm.maxNest = DefaultMaxRecursion
+	case vm.maxNest < 0:
+		vm.maxNest = 0
+	}
+	if vm.outerMax > 0 && (vm.maxNest == 0 || vm.outerMax < vm.maxNest) {
+		vm.maxNest = vm.outerMax
+	}
+	vm.memory = 0
 	vm.ip = 0
 	vm.pp = 0
 
@@ -74,8 +165,107 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 
 	vm.bytecode = program.Bytecode
 	vm.constants = program.Constants
+	vm.options = program.Options
+
+	if cap(vm.locals) < program.Locals {
+		vm.locals = make([]interface{}, program.Locals)
+	} else {
+		vm.locals = vm.locals[:program.Locals]
+	}
+
+	if err := vm.execute(env, len(vm.bytecode)); err != nil {
+		return nil, err
+	}
+
+	if vm.debug {
+		close(vm.curr)
+		close(vm.step)
+	}
+
+	if len(vm.stack) > 1 {
+		if !program.MultipleResults {
+			return nil, fmt.Errorf("program left %v values on the stack", len(vm.stack))
+		}
+		results := make([]interface{}, len(vm.stack))
+		copy(results, vm.stack)
+		return results, nil
+	}
+
+	if len(vm.stack) > 0 {
+		return vm.pop(), nil
+	}
+
+	return nil, nil
+}
+
+// try runs the protected bytecode of try(), from vm.ip up to end, where the
+// fallback starts. The protected bytecode ends with a jump past the
+// fallback. If it fails with an error of the expression, the stack, scopes
+// and locals are restored, and the fallback runs instead.
+func (vm *VM) try(env interface{}, end int) (err error) {
+	stack, scopes, nesting := len(vm.stack), len(vm.scopes), vm.nesting
+	var locals []interface{}
+	if len(vm.locals) > 0 {
+		locals = append(locals, vm.locals...)
+	}
+	vm.enter()
+	failed := true
+	defer func() {
+		r := recover()
+		if r != nil && !catchable(r) {
+			panic(r)
+		}
+		if r != nil || failed {
+			vm.stack = vm.stack[:stack]
+			vm.scopes = vm.scopes[:scopes]
+			copy(vm.locals, locals)
+			vm.ip = end
+		}
+		vm.nesting = nesting
+	}()
+	err = vm.execute(env, end)
+	if err != nil && !catchable(err) {
+		return err
+	}
+	failed = err != nil
+	return nil
+}
 
-	for vm.ip < len(vm.bytecode) {
+// catchable reports whether r, the cause of a failure, is an error of the
+// expression which try() may catch. Exceeding the limits of the run is not,
+// and neither are runtime errors of Go other than operands of the wrong type
+// and integer division by zero, as they are bugs rather than errors of the
+// expression.
+func catchable(r interface{}) bool {
+	err, ok := r.(error)
+	if !ok {
+		return true
+	}
+	if errors.Is(err, ErrMaxRecursion) || errors.Is(err, ErrMemoryBudget) {
+		return false
+	}
+	switch err := err.(type) {
+	case *runtime.TypeAssertionError:
+		return true
+	case runtime.Error:
+		return strings.HasSuffix(err.Error(), "integer divide by zero")
+	}
+	return true
+}
+
+// enter counts the start of a nested closure, try() or program, which must
+// not nest deeper than the MaxRecursion option.
+func (vm *VM) enter() {
+	vm.nesting++
+	if vm.maxNest > 0 && vm.nesting > vm.maxNest {
+		panic(ErrMaxRecursion)
+	}
+}
+
+// execute runs the bytecode from vm.ip up to end. Errors returned by
+// functions are returned, and other failures panic.
+func (vm *VM) execute(env interface{}, end int) error {
+	for vm.ip < end {
 
 		if vm.debug {
 			<-vm.step
@@ -85,6 +275,10 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 		vm.ip++
 		op := vm.bytecode[vm.pp]
 
+		if vm.profile != nil {
+			vm.profile.begin(op)
+		}
+
 		switch op {
 
 		case OpPush:
@@ -100,14 +294,23 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			vm.push(a)
 
 		case OpFetch:
-			vm.push(fetch(env, vm.constant(), false))
+			vm.push(fetchEnv(env, vm.constant(), false, vm.options.MissingKey))
 
 		case OpFetchNilSafe:
-			vm.push(fetch(env, vm.constant(), true))
+			vm.push(fetchEnv(env, vm.constant(), true, vm.options.MissingKey))
+
+		case OpFetchStrict:
+			vm.push(fetchStrict(env, vm.constant().(string), vm.options.MissingKey))
 
 		case OpFetchMap:
 			vm.push(env.(map[string]interface{})[vm.constant().(string)])
 
+		case OpFetchVar:
+			vm.push(fetchVar(env, vm.pop(), false, vm.options.MissingKey))
+
+		case OpFetchVarStrict:
+			vm.push(fetchVar(env, vm.pop(), true, vm.options.MissingKey))
+
 		case OpTrue:
 			vm.push(true)
 
@@ -118,8 +321,11 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			vm.push(nil)
 
 		case OpNegate:
-			v := negate(vm.pop())
-			vm.push(v)
+			v := vm.pop()
+			if vm.options.NumericStrings {
+				v = numericString(v)
+			}
+			vm.push(negate(v))
 
 		case OpNot:
 			v := vm.pop().(bool)
@@ -128,6 +334,8 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 		case OpEqual:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, true)
+			vm.checkNaN(a, b)
 			vm.push(equal(a, b))
 
 		case OpEqualInt:
@@ -140,6 +348,23 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			a := vm.pop()
 			vm.push(a.(string) == b.(string))
 
+		case OpNotEqual:
+			b := vm.pop()
+			a := vm.pop()
+			a, b = vm.numeric(a, b, true)
+			vm.checkNaN(a, b)
+			vm.push(!equal(a, b).(bool))
+
+		case OpNotEqualInt:
+			b := vm.pop()
+			a := vm.pop()
+			vm.push(a.(int) != b.(int))
+
+		case OpNotEqualString:
+			b := vm.pop()
+			a := vm.pop()
+			vm.push(a.(string) != b.(string))
+
 		case OpJump:
 			offset := vm.arg()
 			vm.ip += int(offset)
@@ -160,59 +385,96 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			offset := vm.arg()
 			vm.ip -= int(offset)
 
+		case OpJumpIfNotNil:
+			offset := vm.arg()
+			if !isNil(vm.current()) {
+				vm.ip += int(offset)
+			}
+
+		case OpTry:
+			offset := vm.arg()
+			if err := vm.try(env, vm.ip+int(offset)); err != nil {
+				return err
+			}
+
 		case OpIn:
 			b := vm.pop()
 			a := vm.pop()
 			vm.push(in(a, b))
 
+		case OpNotIn:
+			b := vm.pop()
+			a := vm.pop()
+			vm.push(!in(a, b))
+
 		case OpLess:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, true)
+			vm.checkNaN(a, b)
 			vm.push(less(a, b))
 
 		case OpMore:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, true)
+			vm.checkNaN(a, b)
 			vm.push(more(a, b))
 
 		case OpLessOrEqual:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, true)
+			vm.checkNaN(a, b)
 			vm.push(lessOrEqual(a, b))
 
 		case OpMoreOrEqual:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, true)
+			vm.checkNaN(a, b)
 			vm.push(moreOrEqual(a, b))
 
 		case OpAdd:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, true)
 			vm.push(add(a, b))
 
 		case OpSubtract:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, false)
 			vm.push(subtract(a, b))
 
 		case OpMultiply:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, false)
 			vm.push(multiply(a, b))
 
 		case OpDivide:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, false)
 			vm.push(divide(a, b))
 
+		case OpDivideInf:
+			b := vm.pop()
+			a := vm.pop()
+			a, b = vm.numeric(a, b, false)
+			vm.push(divideInf(a, b))
+
 		case OpModulo:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, false)
 			vm.push(modulo(a, b))
 
 		case OpExponent:
 			b := vm.pop()
 			a := vm.pop()
+			a, b = vm.numeric(a, b, false)
 			vm.push(exponent(a, b))
 
 		case OpRange:
@@ -222,7 +484,7 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			max := toInt(b)
 			size := max - min + 1
 			if vm.memory+size >= vm.limit {
-				panic("memory budget exceeded")
+				panic(ErrMemoryBudget)
 			}
 			vm.push(makeRange(min, max))
 			vm.memory += size
@@ -230,17 +492,30 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 		case OpMatches:
 			b := vm.pop()
 			a := vm.pop()
-			match, err := regexp.MatchString(b.(string), a.(string))
+			r, err := vm.options.compileRegexp(b.(string))
 			if err != nil {
 				panic(err)
 			}
-
-			vm.push(match)
+			vm.push(vm.options.match(r, a.(string)))
 
 		case OpMatchesConst:
 			a := vm.pop()
 			r := vm.constant().(*regexp.Regexp)
-			vm.push(r.MatchString(a.(string)))
+			vm.push(vm.options.match(r, a.(string)))
+
+		case OpMatchesFlags:
+			c := vm.pop()
+			b := vm.pop()
+			a := vm.pop()
+			pattern, err := WithFlags(b.(string), c.(string))
+			if err != nil {
+				panic(err)
+			}
+			r, err := vm.options.compileRegexp(pattern)
+			if err != nil {
+				panic(err)
+			}
+			vm.push(vm.options.match(r, a.(string)))
 
 		case OpContains:
 			b := vm.pop()
@@ -257,10 +532,25 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			a := vm.pop()
 			vm.push(strings.HasSuffix(a.(string), b.(string)))
 
+		case OpBetween:
+			to := vm.pop()
+			from := vm.pop()
+			x := vm.pop()
+			from, x = vm.numeric(from, x, true)
+			x, to = vm.numeric(x, to, true)
+			vm.checkNaN(from, x)
+			vm.checkNaN(x, to)
+			vm.push(lessOrEqual(from, x).(bool) && lessOrEqual(x, to).(bool))
+
 		case OpIndex:
 			b := vm.pop()
 			a := vm.pop()
-			vm.push(fetch(a, b, false))
+			vm.push(fetch(a, b, false, vm.options.MissingKey))
+
+		case OpIndexNilSafe:
+			b := vm.pop()
+			a := vm.pop()
+			vm.push(fetch(a, b, true, vm.options.MissingKey))
 
 		case OpSlice:
 			from := vm.pop()
@@ -271,12 +561,12 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 		case OpProperty:
 			a := vm.pop()
 			b := vm.constant()
-			vm.push(fetch(a, b, false))
+			vm.push(fetch(a, b, false, vm.options.MissingKey))
 
 		case OpPropertyNilSafe:
 			a := vm.pop()
 			b := vm.constant()
-			vm.push(fetch(a, b, true))
+			vm.push(fetch(a, b, true, vm.options.MissingKey))
 
 		case OpCall:
 			call := vm.constant().(Call)
@@ -293,7 +583,7 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			}
 			out := FetchFn(env, call.Name).Call(in)
 			if len(out) == 2 && out[1].Type() == errorType && !out[1].IsNil() {
-				return nil, out[1].Interface().(error)
+				return out[1].Interface().(error)
 			}
 			vm.push(out[0].Interface())
 
@@ -309,11 +599,51 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			} else if typed, ok := fn.(func(...interface{}) (interface{}, error)); ok {
 				res, err := typed(in...)
 				if err != nil {
-					return nil, err
+					return err
 				}
 				vm.push(res)
 			}
 
+		case OpCallFunc:
+			fn := vm.constant().(Func)
+			in := make([]reflect.Value, fn.Size)
+			for i := fn.Size - 1; i >= 0; i-- {
+				param := vm.pop()
+				if param == nil && reflect.TypeOf(param) == nil {
+					in[i] = reflect.Zero(fn.Fn.Type().In(i))
+				} else {
+					in[i] = reflect.ValueOf(param)
+				}
+			}
+			vm.push(fn.Fn.Call(in)[0].Interface())
+
+		case OpCallBuiltin:
+			call := vm.constant().(Call)
+			in := make([]interface{}, call.Size)
+			for i := call.Size - 1; i >= 0; i-- {
+				in[i] = vm.pop()
+			}
+			builtin := Builtins[call.Name]
+			if vm.options.NumericStrings {
+				numericArgs(builtin, in)
+			}
+			if vm.options.NoNaNComparison && builtin.Compares {
+				checkNaNArgs(call.Name, in)
+			}
+			vm.push(builtin.Func(in...))
+
+		case OpApply:
+			env := vm.pop()
+			out, err := vm.apply(vm.pop(), env)
+			if err != nil {
+				return err
+			}
+			vm.push(out)
+
+		case OpRequire:
+			message := vm.pop()
+			vm.push(require(vm.pop(), message))
+
 		case OpMethod:
 			call := vm.constants[vm.arg()].(Call)
 			in := make([]reflect.Value, call.Size)
@@ -329,7 +659,26 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			}
 			out := FetchFn(vm.pop(), call.Name).Call(in)
 			if len(out) == 2 && out[1].Type() == errorType && !out[1].IsNil() {
-				return nil, out[1].Interface().(error)
+				return out[1].Interface().(error)
+			}
+			vm.push(out[0].Interface())
+
+		case OpCallValue:
+			call := vm.constant().(Call)
+			in := make([]reflect.Value, call.Size)
+			for i := call.Size - 1; i >= 0; i-- {
+				param := vm.pop()
+				if param == nil && reflect.TypeOf(param) == nil {
+					// In case of nil value and nil type use this hack,
+					// otherwise reflect.Call will panic on zero value.
+					in[i] = reflect.ValueOf(&param).Elem()
+				} else {
+					in[i] = reflect.ValueOf(param)
+				}
+			}
+			out := callValue(vm.pop()).Call(in)
+			if len(out) == 2 && out[1].Type() == errorType && !out[1].IsNil() {
+				return out[1].Interface().(error)
 			}
 			vm.push(out[0].Interface())
 
@@ -363,7 +712,7 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			vm.push(array)
 			vm.memory += size
 			if vm.memory >= vm.limit {
-				panic("memory budget exceeded")
+				panic(ErrMemoryBudget)
 			}
 
 		case OpMap:
@@ -377,12 +726,15 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			vm.push(m)
 			vm.memory += size
 			if vm.memory >= vm.limit {
-				panic("memory budget exceeded")
+				panic(ErrMemoryBudget)
 			}
 
 		case OpLen:
 			vm.push(length(vm.current()))
 
+		case OpValues:
+			vm.push(elements(vm.pop()))
+
 		case OpCast:
 			t := vm.arg()
 			switch t {
@@ -410,12 +762,20 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			i++
 			scope[key] = i
 
+		case OpStoreLocal:
+			vm.locals[vm.arg()] = vm.pop()
+
+		case OpLoadLocal:
+			vm.push(vm.locals[vm.arg()])
+
 		case OpBegin:
+			vm.enter()
 			scope := make(Scope)
 			vm.scopes = append(vm.scopes, scope)
 
 		case OpEnd:
 			vm.scopes = vm.scopes[:len(vm.scopes)-1]
+			vm.nesting--
 
 		default:
 			panic(fmt.Sprintf("unknown bytecode %#x", op))
@@ -425,17 +785,7 @@ func (vm *VM) Run(program *Program, env interface{}) (out interface{}, err error
 			vm.curr <- vm.ip
 		}
 	}
-
-	if vm.debug {
-		close(vm.curr)
-		close(vm.step)
-	}
-
-	if len(vm.stack) > 0 {
-		return vm.pop(), nil
-	}
-
-	return nil, nil
+	return nil
 }
 
 func (vm *VM) push(value interface{}) {
@@ -452,6 +802,23 @@ func (vm *VM) pop() interface{} {
 	return value
 }
 
+// checkNaN fails the comparison of a and b if either of them is NaN and
+// the program disallows comparisons with NaN.
+func (vm *VM) checkNaN(a, b interface{}) {
+	if vm.options.NoNaNComparison {
+		checkNaN(a, b)
+	}
+}
+
+// numeric returns the operands of a binary operator converted by
+// numericOperands if the program accepts numeric strings.
+func (vm *VM) numeric(a, b interface{}, stringOperator bool) (interface{}, interface{}) {
+	if !vm.options.NumericStrings {
+		return a, b
+	}
+	return numericOperands(a, b, stringOperator)
+}
+
 func (vm *VM) arg() uint16 {
 	b0, b1 := vm.bytecode[vm.ip], vm.bytecode[vm.ip+1]
 	vm.ip += 2
@@ -462,6 +829,30 @@ func (vm *VM) constant() interface{} {
 	return vm.constants[vm.arg()]
 }
 
+// apply runs program, which must be a *Program, with env as its env, one
+// level deeper than vm. Errors of the program are returned as is, so they
+// point into its own source.
+func (vm *VM) apply(program interface{}, env interface{}) (interface{}, error) {
+	p, ok := program.(*Program)
+	if !ok || p == nil {
+		panic(fmt.Sprintf("cannot use %T as program in apply", program))
+	}
+	max := vm.options.MaxApplyDepth
+	if max == 0 {
+		max = DefaultMaxApplyDepth
+	}
+	if vm.maxDepth > 0 && vm.maxDepth < max {
+		max = vm.maxDepth
+	}
+	if vm.depth >= max {
+		panic(fmt.Sprintf("apply nested deeper than %v programs", max))
+	}
+	vm.enter()
+	defer func() { vm.nesting-- }()
+	sub := VM{depth: vm.depth + 1, maxDepth: max, outer: vm.nesting, outerMax: vm.maxNest}
+	return sub.Run(p, env)
+}
+
 func (vm *VM) Stack() []interface{} {
 	return vm.stack
 }
@@ -3,6 +3,7 @@ package vm_test
 import (
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/ebusto/expr/checker"
 	"github.com/ebusto/expr/compiler"
 	"github.com/ebusto/expr/conf"
+	"github.com/ebusto/expr/internal/difftest"
 	"github.com/ebusto/expr/parser"
 	"github.com/ebusto/expr/vm"
 	"github.com/stretchr/testify/require"
@@ -97,6 +99,51 @@ func TestRun_helpers(t *testing.T) {
 	}
 }
 
+func TestRun_self_referential_equal(t *testing.T) {
+	a := []interface{}{nil}
+	a[0] = a
+	b := []interface{}{nil}
+	b[0] = b
+
+	tree, err := parser.Parse(`a == b && a == a`)
+	require.NoError(t, err)
+
+	program, err := compiler.Compile(tree, nil)
+	require.NoError(t, err)
+
+	out, err := vm.Run(program, map[string]interface{}{"a": a, "b": b})
+	require.NoError(t, err)
+	require.Equal(t, true, out)
+}
+
+func TestBatchRunner(t *testing.T) {
+	var programs []*vm.Program
+	for _, code := range []string{`a > 1`, `a.b`, `[a, a + 1]`, `a * 2`} {
+		tree, err := parser.Parse(code)
+		require.NoError(t, err)
+
+		program, err := compiler.Compile(tree, nil)
+		require.NoError(t, err)
+
+		programs = append(programs, program)
+	}
+
+	results := vm.NewBatchRunner(programs...).Run(map[string]interface{}{"a": 2})
+	require.Len(t, results, 4)
+
+	require.NoError(t, results[0].Err)
+	require.Equal(t, true, results[0].Output)
+
+	require.Error(t, results[1].Err)
+	require.Contains(t, results[1].Err.Error(), "cannot fetch b from int")
+
+	require.NoError(t, results[2].Err)
+	require.Equal(t, []interface{}{2, 3}, results[2].Output)
+
+	require.NoError(t, results[3].Err)
+	require.Equal(t, 4, results[3].Output)
+}
+
 func TestRun_memory_budget(t *testing.T) {
 	input := `map(1..100, {map(1..100, {map(1..100, {0})})})`
 
@@ -229,3 +276,291 @@ func TestRun_inner_method_with_error(t *testing.T) {
 
 	require.Equal(t, nil, out)
 }
+
+func TestRun_runtime_error(t *testing.T) {
+	input := `foo.bar`
+
+	tree, err := parser.Parse(input)
+	require.NoError(t, err)
+
+	program, err := compiler.Compile(tree, nil)
+	require.NoError(t, err)
+
+	_, err = vm.Run(program, map[string]interface{}{"foo": 1})
+	require.Error(t, err)
+
+	var runtimeErr *vm.RuntimeError
+	require.True(t, errors.As(err, &runtimeErr), "error should wrap *vm.RuntimeError")
+	require.Equal(t, vm.OpProperty, runtimeErr.Opcode)
+	require.Equal(t, "OpProperty", runtimeErr.Name)
+	require.Equal(t, 3, runtimeErr.IP)
+	require.Equal(t, "bar", runtimeErr.Operand)
+	require.Equal(t, "foo.bar", runtimeErr.Path)
+	require.Equal(t, `cannot fetch bar from int at foo.bar (OpProperty "bar" at 3)`, runtimeErr.Error())
+	require.Contains(t, program.Disassemble(), "3\tOpProperty\t1\t\"bar\"")
+}
+
+func TestRun_missing_key(t *testing.T) {
+	env := map[string]interface{}{
+		"scores": map[string]int{"a": 1},
+		"ptr":    &map[string]int{"a": 1},
+	}
+	tests := []struct {
+		policy vm.MissingKeyPolicy
+		code   string
+		want   interface{}
+	}{
+		{vm.MissingKeyZero, `scores.b`, 0},
+		{vm.MissingKeyZero, `ptr["b"]`, 0},
+		{vm.MissingKeyNil, `scores.b`, nil},
+		{vm.MissingKeyNil, `scores["a"]`, 1},
+		{vm.MissingKeyError, `scores?.b`, nil},
+		{vm.MissingKeyError, `scores.a`, 1},
+	}
+	for _, tt := range tests {
+		program := compile(t, tt.code)
+		program.MissingKey = tt.policy
+		out, err := vm.Run(program, env)
+		require.NoError(t, err, tt.code)
+		require.Equal(t, tt.want, out, tt.code)
+	}
+
+	program := compile(t, `scores.b`)
+	program.MissingKey = vm.MissingKeyError
+	_, err := vm.Run(program, env)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot fetch b from map[string]int at scores.b")
+}
+
+func TestRun_nil_map(t *testing.T) {
+	env := map[string]interface{}{
+		"scores": map[string]int(nil),
+	}
+
+	out, err := vm.Run(compile(t, `scores?.a`), env)
+	require.NoError(t, err)
+	require.Nil(t, out)
+
+	_, err = vm.Run(compile(t, `scores.a`), env)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot fetch a from nil map map[string]int at scores.a")
+
+	_, err = vm.Run(compile(t, `scores["a"]`), env)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "nil map")
+}
+
+func TestWithFlags(t *testing.T) {
+	pattern, err := vm.WithFlags("^a", "im")
+	require.NoError(t, err)
+	require.Equal(t, "(?im)^a", pattern)
+
+	pattern, err = vm.WithFlags("^a", "")
+	require.NoError(t, err)
+	require.Equal(t, "^a", pattern)
+
+	_, err = vm.WithFlags("^a", "x")
+	require.EqualError(t, err, `invalid regexp flag 'x' in "x"`)
+
+	tree, err := parser.Parse(`matches(s, "^a", f)`)
+	require.NoError(t, err)
+	program, err := compiler.Compile(tree, nil)
+	require.NoError(t, err)
+	_, err = vm.Run(program, map[string]interface{}{"s": "a", "f": "x"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid regexp flag 'x' in "x"`)
+}
+
+func TestRun_regexp_limits(t *testing.T) {
+	config := &conf.Config{MaxPatternLength: 5, MaxMatchLength: 5}
+
+	tree, err := parser.Parse(`s matches "^abcdef"`)
+	require.NoError(t, err)
+	_, err = checker.Check(tree, config)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "regexp of 7 bytes exceeds the limit of 5 (1:11)")
+
+	env := map[string]interface{}{"s": "abc", "long": "abcdef", "p": "^abcdef"}
+	for code, want := range map[string]string{
+		`long matches "^a"`:  "string of 6 bytes exceeds the limit of 5 for matches",
+		`s matches p`:        "regexp of 7 bytes exceeds the limit of 5",
+		`matches(s, p, "i")`: "regexp of 11 bytes exceeds the limit of 5",
+	} {
+		tree, err := parser.Parse(code)
+		require.NoError(t, err, code)
+		program, err := compiler.Compile(tree, config)
+		require.NoError(t, err, code)
+
+		_, err = vm.Run(program, env)
+		require.Error(t, err, code)
+		require.Contains(t, err.Error(), want, code)
+
+		// Other programs are not limited.
+		program, err = compiler.Compile(tree, nil)
+		require.NoError(t, err, code)
+		_, err = vm.Run(program, env)
+		require.NoError(t, err, code)
+	}
+
+	tree, err = parser.Parse(`s matches "^a"`)
+	require.NoError(t, err)
+	program, err := compiler.Compile(tree, config)
+	require.NoError(t, err)
+	out, err := vm.Run(program, env)
+	require.NoError(t, err)
+	require.Equal(t, true, out)
+}
+
+func TestRun_max_recursion(t *testing.T) {
+	run := func(input string) error {
+		tree, err := parser.Parse(input)
+		require.NoError(t, err)
+		_, err = checker.Check(tree, nil)
+		require.NoError(t, err)
+		program, err := compiler.Compile(tree, &conf.Config{MaxRecursion: 3})
+		require.NoError(t, err)
+		_, err = vm.Run(program, nil)
+		return err
+	}
+	require.NoError(t, run(`map(1..2, {map(1..2, {map(1..2, {#})})})`))
+	require.NoError(t, run(`try(map(1..2, {map(1..2, {#})}), 0)`))
+
+	for _, input := range []string{
+		`map(1..2, {map(1..2, {map(1..2, {map(1..2, {#})})})})`,
+		`try(map(1..2, {map(1..2, {map(1..2, {#})})}), 0)`,
+	} {
+		err := run(input)
+		require.Error(t, err, input)
+		require.True(t, errors.Is(err, vm.ErrMaxRecursion), input)
+	}
+}
+
+func TestRegexpCache(t *testing.T) {
+	cache := vm.NewRegexpCache(2)
+
+	get := func(pattern string) interface{} {
+		r, err := cache.Compile(pattern)
+		require.NoError(t, err)
+		return r
+	}
+	a := get("a+")
+	require.True(t, a == get("a+"))
+
+	b := get("b+")
+	get("a+")
+	get("c+") // evicts b+, the least recently used
+	require.True(t, a == get("a+"))
+	require.False(t, b == get("b+"))
+
+	cache.Clear()
+	require.False(t, a == get("a+"))
+
+	program := compile(t, `foo matches bar`)
+	program.RegexpCache = vm.NewRegexpCache(0)
+	out, err := vm.Run(program, map[string]interface{}{"foo": "aaa", "bar": "^a+$"})
+	require.NoError(t, err)
+	require.Equal(t, true, out)
+}
+
+func TestRun_multiple_results(t *testing.T) {
+	program := &vm.Program{Bytecode: []byte{vm.OpTrue, vm.OpFalse}}
+
+	_, err := vm.Run(program, nil)
+	require.Error(t, err)
+	require.Equal(t, "program left 2 values on the stack", err.Error())
+
+	program.MultipleResults = true
+	out, err := vm.Run(program, nil)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{true, false}, out)
+}
+
+func TestRun_profile(t *testing.T) {
+	tree, err := parser.Parse(`A + A`)
+	require.NoError(t, err)
+
+	program, err := compiler.Compile(tree, nil)
+	require.NoError(t, err)
+
+	env := map[string]interface{}{"A": 1}
+	machine := vm.VM{}
+	_, err = machine.Run(program, env)
+	require.NoError(t, err)
+	require.Empty(t, machine.Profile())
+
+	machine.EnableProfiling()
+	for i := 0; i < 3; i++ {
+		_, err = machine.Run(program, env)
+		require.NoError(t, err)
+	}
+	profile := machine.Profile()
+	require.Equal(t, 6, profile["OpFetch"].Count)
+	require.Equal(t, 3, profile["OpAdd"].Count)
+	require.Len(t, profile, 2)
+
+	machine.ResetProfile()
+	require.Empty(t, machine.Profile())
+}
+
+func TestEval(t *testing.T) {
+	env := map[string]interface{}{
+		"a":      1,
+		"b":      2.5,
+		"s":      "hello",
+		"array":  []int{1, 2, 3, 4},
+		"object": map[string]interface{}{"x": 42},
+		"double": func(i int) int { return i * 2 },
+	}
+	for _, input := range []string{
+		`a + b * 2`,
+		`-a * 7 % 3 + a ** 2`,
+		`not (a > 1) and b >= 2.5 || false`,
+		`s contains "ell" && s startsWith "he" && s endsWith "lo"`,
+		`s matches "^h.*o$"`,
+		`s[1:3] + s[:1]`,
+		`object.x == 42 ? "yes" : "no"`,
+		`object?.y`,
+		`array[1] in 1..3`,
+		`all(array, {# > 0}) && none(array, {# > 4}) && any(array, {# == 2}) && one(array, {# == 3})`,
+		`map(filter(array, {# % 2 == 0}), {# * 10})`,
+		`count(array, {# > 1}) + len(array)`,
+		`double(a) + len([1, 2])`,
+		`{"k": s}.k`,
+		`let x = a + 1; x * x`,
+		`indexOf(s, "l") + len(toArray(nil))`,
+		`coalesce(nil, a, b)`,
+		`array[a * 10]`,
+		`s matches s + "("`,
+		`object.x.y`,
+	} {
+		difftest.Check(t, input, env)
+	}
+	difftest.Check(t, `WillError()`, ErrorEnv{})
+	difftest.Check(t, `InnerEnv.WillError()`, ErrorEnv{})
+}
+
+func TestEvalWith_noNaNComparison(t *testing.T) {
+	env := map[string]interface{}{"x": math.NaN()}
+	for _, input := range []string{`x < 1`, `x between 0 and 1`, `min(x, 1)`} {
+		tree, err := parser.Parse(input)
+		require.NoError(t, err)
+		_, err = checker.Check(tree, nil)
+		require.NoError(t, err)
+
+		_, err = vm.EvalWith(tree.Node, env, vm.Options{})
+		require.NoError(t, err, input)
+
+		_, err = vm.EvalWith(tree.Node, env, vm.Options{NoNaNComparison: true})
+		require.Error(t, err, input)
+		require.Contains(t, err.Error(), "comparison of", input)
+	}
+}
+
+func TestEval_error(t *testing.T) {
+	tree, err := parser.Parse(`1 + "a"`)
+	require.NoError(t, err)
+
+	_, err = vm.Eval(tree.Node, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid operation: int + string`)
+}